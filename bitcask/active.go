@@ -0,0 +1,379 @@
+package bitcask
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/pro0o/deslocado/types"
+	"github.com/rs/zerolog/log"
+)
+
+const activeFile = "data.txt"
+
+// Active is the file every write goes to. it remembers where each key's
+// latest record landed, so sealing it emits a hint without re-reading it.
+// its records are located by the name it gets sealed under, fileID, so
+// sealing moves no keyDir entry.
+type Active struct {
+	family Family
+	path   string
+	fileID string
+	file   *os.File
+	writer *bufio.Writer
+	offset int64
+	hints  map[string]hintEntry
+	drops  map[string]hintEntry
+	lastTs int64
+	seq    *sequence
+	// records the file may not hold whole yet by offset, bufio writes a full
+	// buffer out on its own & can cut one in two. written is how far the
+	// file goes.
+	unflushed map[int64]Record
+	written   int64
+}
+
+// hands out seqs. the families of a store share one, so seqs order writes
+// across all of them.
+type sequence struct {
+	last atomic.Uint64
+}
+
+// keeps the highest seq seen, it never goes back.
+func (s *sequence) observe(seq uint64) {
+	for {
+		last := s.last.Load()
+		if seq <= last || s.last.CompareAndSwap(last, seq) {
+			return
+		}
+	}
+}
+
+// OpenActive opens the default family's data.txt.
+func OpenActive() (*Active, error) {
+	return Family{}.OpenActive()
+}
+
+// OpenActive opens the family's data.txt, creating it if needed. an
+// existing file is scanned once to pick up its offsets, a torn record or an
+// unfinished batch at the tail left by a crash is cut off. a cross-family
+// batch part that never got committed is skipped, whatever follows it stays.
+func (f Family) OpenActive() (*Active, error) {
+	if err := f.create(); err != nil {
+		return nil, err
+	}
+	batches, err := loadBatchLog()
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := f.LoadManifest()
+	if err != nil {
+		return nil, fmt.Errorf("load manifest: %w", err)
+	}
+	// written right away, a store with data but no MANIFEST is then never
+	// one of ours.
+	if !manifest.onDisk {
+		if err := manifest.save(); err != nil {
+			return nil, fmt.Errorf("save manifest: %w", err)
+		}
+	}
+	path := f.path(activeFile)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+
+	a := &Active{family: f, path: path, fileID: f.path(sealedName(manifest.activeID())), file: file, hints: make(map[string]hintEntry), drops: make(map[string]hintEntry), seq: &sequence{}, unflushed: make(map[int64]Record)}
+	a.seq.observe(manifest.LastSeq)
+	// batch records only count once the whole batch is there.
+	var (
+		batchStart int64
+		batchLeft  uint32
+		batchID    uint64
+		batched    []hintEntry
+	)
+	end, err := scanRecords(bufio.NewReader(file), func(offset int64, h recordHeader, key []byte) error {
+		a.seq.observe(h.seq)
+		if h.flag == types.FlagBatch {
+			batchStart, batchLeft, batchID, batched = offset, batchCount(key), familyBatchID(key), nil
+			return nil
+		}
+		a.lastTs = max(a.lastTs, h.ts)
+		entry := hintFromRecord(h, key, offset)
+		if batchLeft == 0 {
+			trackHint(a.hints, a.drops, entry)
+			return nil
+		}
+		batched = append(batched, entry)
+		if batchLeft--; batchLeft > 0 {
+			return nil
+		}
+		if !batches.isCommitted(batchID) {
+			log.Warn().Int64("offset", batchStart).Uint64("batch", batchID).Str("file", path).Msg("Skipping cross-family batch that never committed!!")
+			return nil
+		}
+		a.track(batched)
+		return nil
+	})
+	if batchLeft > 0 && (err == nil || errors.Is(err, io.ErrUnexpectedEOF)) {
+		end, err = batchStart, io.ErrUnexpectedEOF
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		log.Warn().Int64("offset", end).Str("file", path).Msg("Truncating torn record at the tail of data.txt!!")
+		if err := file.Truncate(end); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("truncate torn tail of %s: %w", path, err)
+		}
+	} else if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("scan %s: %w", path, err)
+	}
+
+	a.offset, a.written = end, end
+	a.writer = bufio.NewWriter(file)
+	return a, nil
+}
+
+func (a *Active) Put(key, val []byte) (types.FileOffset, error) {
+	return a.PutIn("", key, val, 0)
+}
+
+// expiry in unix nanos, 0 never expires.
+func (a *Active) PutExpiring(key, val []byte, expiry int64) (types.FileOffset, error) {
+	return a.PutIn("", key, val, expiry)
+}
+
+// PutIn writes key into bucket, "" is the default bucket.
+func (a *Active) PutIn(bucket string, key, val []byte, expiry int64) (types.FileOffset, error) {
+	offset, err := a.append(recordHeader{flag: types.FlagNormal, expiry: expiry, bucket: bucket}, key, val)
+	if err != nil {
+		return types.FileOffset{}, err
+	}
+	return types.FileOffset{FileID: a.fileID, Offset: offset, Expiry: expiry}, nil
+}
+
+func (a *Active) Delete(key []byte) error {
+	return a.DeleteIn("", key)
+}
+
+func (a *Active) DeleteIn(bucket string, key []byte) error {
+	_, err := a.append(recordHeader{flag: types.FlagTombstone, bucket: bucket}, key, nil)
+	return err
+}
+
+// DropBucket writes one record that deletes every key bucket holds so far.
+// keys written to it afterwards are a fresh bucket.
+func (a *Active) DropBucket(bucket string) error {
+	_, err := a.append(recordHeader{flag: types.FlagDropBucket, bucket: bucket}, nil, nil)
+	return err
+}
+
+// BatchOp is one write of an atomic batch, Delete writes a tombstone.
+type BatchOp struct {
+	Bucket string
+	Key    []byte
+	Val    []byte
+	Delete bool
+}
+
+// WriteBatch writes ops behind a batch header, a crash half way drops all of
+// them. returns where each op landed & its seq.
+func (a *Active) WriteBatch(ops []BatchOp) ([]types.FileOffset, []uint64, error) {
+	locs, entries, err := a.writeBatch(ops, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	a.track(entries)
+	return locs, entrySeqs(entries), nil
+}
+
+// the header's key is count u32, plus the batch id u64 for one part of a
+// cross-family batch. the ops' hints come back untracked, the caller tracks
+// them once the batch counts.
+func (a *Active) writeBatch(ops []BatchOp, id uint64) ([]types.FileOffset, []hintEntry, error) {
+	header := binary.BigEndian.AppendUint32(nil, uint32(len(ops)))
+	if id != 0 {
+		header = binary.BigEndian.AppendUint64(header, id)
+	}
+	if _, err := a.write(recordHeader{flag: types.FlagBatch}, header, nil); err != nil {
+		return nil, nil, err
+	}
+
+	locs := make([]types.FileOffset, 0, len(ops))
+	entries := make([]hintEntry, 0, len(ops))
+	for _, op := range ops {
+		h := recordHeader{flag: types.FlagNormal, bucket: op.Bucket}
+		if op.Delete {
+			h.flag = types.FlagTombstone
+		}
+		entry, err := a.write(h, op.Key, op.Val)
+		if err != nil {
+			return nil, nil, err
+		}
+		locs = append(locs, types.FileOffset{FileID: a.fileID, Offset: entry.offset})
+		entries = append(entries, entry)
+	}
+	return locs, entries, nil
+}
+
+func entrySeqs(entries []hintEntry) []uint64 {
+	seqs := make([]uint64, 0, len(entries))
+	for _, entry := range entries {
+		seqs = append(seqs, entry.seq)
+	}
+	return seqs
+}
+
+func (a *Active) track(entries []hintEntry) {
+	for _, entry := range entries {
+		trackHint(a.hints, a.drops, entry)
+	}
+}
+
+func batchCount(key []byte) uint32 {
+	if len(key) != 4 && len(key) != 12 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(key)
+}
+
+// 0 for a batch that stays within one family.
+func familyBatchID(key []byte) uint64 {
+	if len(key) != 12 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(key[4:])
+}
+
+// stamps the record with its ts & seq & remembers it for the hint,
+// tombstones included.
+func (a *Active) append(h recordHeader, key, val []byte) (int64, error) {
+	entry, err := a.write(h, key, val)
+	if err != nil {
+		return 0, err
+	}
+	trackHint(a.hints, a.drops, entry)
+	return entry.offset, nil
+}
+
+// stamps & writes the record, its hint is left to the caller.
+func (a *Active) write(h recordHeader, key, val []byte) (hintEntry, error) {
+	// strictly increasing, a record's ts doubles as its key's version.
+	h.ts = max(time.Now().UnixNano(), a.lastTs+1)
+	a.lastTs = h.ts
+	h.seq = a.seq.last.Add(1)
+	h.keyLen, h.valLen = uint32(len(key)), uint32(len(val))
+	offset := a.offset
+	if err := writeRecord(a.writer, h, key, val); err != nil {
+		return hintEntry{}, err
+	}
+	a.offset += h.size()
+	if h.flag != types.FlagBatch {
+		a.unflushed[offset] = Record{Flag: h.flag, Timestamp: h.ts, Seq: h.seq, Expiry: h.expiry, Bucket: h.bucket, Key: bytes.Clone(key), Val: bytes.Clone(val)}
+	}
+	a.dropWritten()
+	return hintFromRecord(h, bytes.Clone(key), offset), nil
+}
+
+// forgets the records bufio already wrote out whole.
+func (a *Active) dropWritten() {
+	written := a.offset - int64(a.writer.Buffered())
+	if written <= a.written {
+		return
+	}
+	a.written = written
+	for offset, rec := range a.unflushed {
+		if offset+int64(recordHeaderSize+len(rec.Bucket)+len(rec.Key)+len(rec.Val)) <= written {
+			delete(a.unflushed, offset)
+		}
+	}
+}
+
+// ReadRecord reads the record at offset, from memory while it hasn't been
+// flushed, so a write reads back right away.
+func (a *Active) ReadRecord(offset int64) (Record, error) {
+	if rec, ok := a.unflushed[offset]; ok {
+		return rec, nil
+	}
+	return ReadRecordAt(a.file, offset)
+}
+
+// Size is how much has been written to the file, buffered writes included.
+func (a *Active) Size() int64 {
+	return a.offset
+}
+
+// LastSeq is the seq of the newest record any active sharing its sequence
+// wrote, recovered on open.
+func (a *Active) LastSeq() uint64 {
+	return a.seq.last.Load()
+}
+
+// ShareSeq makes a draw its seqs from the same sequence as other, which
+// moves past whatever a already wrote. every family of a store shares one.
+func (a *Active) ShareSeq(other *Active) {
+	other.seq.observe(a.seq.last.Load())
+	a.seq = other.seq
+}
+
+// Path is where the file lives until it's sealed.
+func (a *Active) Path() string {
+	return a.path
+}
+
+// FileID is the name the file gets sealed under & the FileID of every
+// record in it, before & after.
+func (a *Active) FileID() string {
+	return a.fileID
+}
+
+func (a *Active) Flush() error {
+	if err := a.writer.Flush(); err != nil {
+		return err
+	}
+	clear(a.unflushed)
+	a.written = a.offset
+	return nil
+}
+
+func (a *Active) Sync() error {
+	if err := a.Flush(); err != nil {
+		return err
+	}
+	return a.file.Sync()
+}
+
+func (a *Active) Close() error {
+	if err := a.Sync(); err != nil {
+		a.file.Close()
+		return err
+	}
+	return a.file.Close()
+}
+
+// LoadInto adds what data.txt holds on top of the sealed files' keyDir.
+// sealed files are older, so a drop here clears their part of the bucket.
+func (a *Active) LoadInto(keyDir *KeyDir) {
+	for bucket := range a.drops {
+		keyDir.DropBucket(bucket)
+	}
+	now := time.Now().UnixNano()
+	for key, entry := range a.hints {
+		if entry.flag == types.FlagTombstone || entry.expired(now) {
+			keyDir.Delete(key)
+			continue
+		}
+		keyDir.Put(key, types.FileOffset{FileID: a.fileID, Offset: entry.offset, Expiry: entry.expiry})
+	}
+}
+
+// hint of everything written so far, sorted by key & fsynced.
+func (a *Active) writeHint(path string) error {
+	return writeHintFile(path, collectHints(a.hints, a.drops))
+}
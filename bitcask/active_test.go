@@ -0,0 +1,376 @@
+package bitcask
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/pro0o/deslocado/types"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func TestRotatorHintsEverySealedFile(t *testing.T) {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	tempDir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(tempDir)
+	defer os.Chdir(oldDir)
+
+	active, err := OpenActive()
+	if err != nil {
+		t.Fatalf("OpenActive failed: %v", err)
+	}
+	keyDir := NewKeyDir(nil)
+	for _, kv := range [][2]string{{"a", "1"}, {"b", "2"}, {"a", "3"}, {"gone", "4"}} {
+		at, err := active.Put([]byte(kv[0]), []byte(kv[1]))
+		if err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		keyDir.Put(kv[0], at)
+	}
+	if err := active.Delete([]byte("gone")); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	keyDir.Delete("gone")
+
+	// below the merge threshold, the sealed file keeps its own hint.
+	active, err = Rotator(context.Background(), active, keyDir, nil)
+	if err != nil {
+		t.Fatalf("Rotator failed: %v", err)
+	}
+	defer active.Close()
+
+	manifest, err := LoadManifest()
+	if err != nil {
+		t.Fatalf("LoadManifest failed: %v", err)
+	}
+	if len(manifest.Files) != 1 || manifest.Files[0].Hint == "" {
+		t.Fatalf("Expected one sealed file with a hint, got %+v", manifest.Files)
+	}
+	sealed := manifest.Files[0]
+
+	entries, err := readHint(sealed.Hint)
+	if err != nil {
+		t.Fatalf("Failed to read hint file: %v", err)
+	}
+	hints := make(map[string]hintEntry)
+	for _, entry := range entries {
+		hints[string(entry.key)] = entry
+	}
+	size := recordSize([]byte("a"), []byte("1"))
+	expected := map[string]int64{"a": 2 * size, "b": size}
+	if len(hints) != len(expected)+1 {
+		t.Errorf("Expected %d hint entries, got %v", len(expected)+1, hints)
+	}
+	for key, offset := range expected {
+		if hints[key].offset != offset || hints[key].flag != types.FlagNormal || hints[key].valSize != 1 {
+			t.Errorf("Key %q: expected value at offset %d, got %+v", key, offset, hints[key])
+		}
+	}
+	// the delete is in the hint, so older files can't bring the key back.
+	goneAt := 3*size + recordSize([]byte("gone"), []byte("4"))
+	if gone := hints["gone"]; gone.flag != types.FlagTombstone || gone.offset != goneAt {
+		t.Errorf("Expected a tombstone for gone at %d, got %+v", goneAt, gone)
+	}
+
+	// cold start -> hints alone.
+	coldKeyDir, err := BuildKeyDir()
+	if err != nil {
+		t.Fatalf("BuildKeyDir failed: %v", err)
+	}
+	for key, offset := range expected {
+		if coldKeyDir[key] != (types.FileOffset{FileID: sealed.Data, Offset: offset}) {
+			t.Errorf("Key %q: expected %s@%d, got %+v", key, sealed.Data, offset, coldKeyDir[key])
+		}
+	}
+	if _, ok := coldKeyDir["gone"]; ok {
+		t.Error("Expected deleted key to stay out of the keyDir")
+	}
+}
+
+func TestOpenActiveRecovers(t *testing.T) {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	tempDir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(tempDir)
+	defer os.Chdir(oldDir)
+
+	entries := []testEntry{
+		{flag: byte(types.FlagNormal), key: "a", value: []byte("1")},
+		{flag: byte(types.FlagNormal), key: "b", value: []byte("2")},
+	}
+	if err := createDataFile(activeFile, entries); err != nil {
+		t.Fatalf("Failed to create data.txt: %v", err)
+	}
+	clean, _ := os.Stat(activeFile)
+
+	// half a record from a crash mid write.
+	file, _ := os.OpenFile(activeFile, os.O_WRONLY|os.O_APPEND, 0644)
+	file.Write([]byte{byte(types.FlagNormal), 0, 0, 0, 9})
+	file.Close()
+
+	active, err := OpenActive()
+	if err != nil {
+		t.Fatalf("OpenActive failed: %v", err)
+	}
+	defer active.Close()
+
+	if info, _ := os.Stat(activeFile); info.Size() != clean.Size() {
+		t.Errorf("Expected torn tail truncated to %d bytes, got %d", clean.Size(), info.Size())
+	}
+	if active.offset != clean.Size() {
+		t.Errorf("Expected write offset %d, got %d", clean.Size(), active.offset)
+	}
+
+	at, err := active.Put([]byte("c"), []byte("3"))
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if at.Offset != clean.Size() {
+		t.Errorf("Expected new record at %d, got %d", clean.Size(), at.Offset)
+	}
+	if len(active.hints) != 3 || active.hints["b"].offset != recordSize([]byte("a"), []byte("1")) {
+		t.Errorf("Unexpected recovered hints %v", active.hints)
+	}
+}
+
+func TestOpenActiveDropsTornBatch(t *testing.T) {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	tempDir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(tempDir)
+	defer os.Chdir(oldDir)
+
+	active, err := OpenActive()
+	if err != nil {
+		t.Fatalf("OpenActive failed: %v", err)
+	}
+	if _, err := active.Put([]byte("before"), []byte("1")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	batchStart := active.offset
+	if _, _, err := active.WriteBatch([]BatchOp{
+		{Key: []byte("x"), Val: []byte("1")},
+		{Key: []byte("y"), Val: []byte("2")},
+		{Key: []byte("before"), Delete: true},
+	}); err != nil {
+		t.Fatalf("WriteBatch failed: %v", err)
+	}
+	active.Close()
+
+	// a complete batch survives a reopen.
+	active, err = OpenActive()
+	if err != nil {
+		t.Fatalf("OpenActive failed: %v", err)
+	}
+	if len(active.hints) != 3 || active.hints["before"].flag != types.FlagTombstone {
+		t.Errorf("Expected the whole batch applied, got %v", active.hints)
+	}
+	end := active.offset
+	active.Close()
+
+	// the last record of the batch never made it.
+	os.Truncate(activeFile, end-1)
+	active, err = OpenActive()
+	if err != nil {
+		t.Fatalf("OpenActive failed: %v", err)
+	}
+	defer active.Close()
+
+	if active.offset != batchStart {
+		t.Errorf("Expected data.txt cut back to %d, got %d", batchStart, active.offset)
+	}
+	if info, _ := os.Stat(activeFile); info.Size() != batchStart {
+		t.Errorf("Expected file size %d, got %d", batchStart, info.Size())
+	}
+	if len(active.hints) != 1 || active.hints["before"].flag != types.FlagNormal {
+		t.Errorf("Expected only before from outside the batch, got %v", active.hints)
+	}
+}
+
+func TestDropBucket(t *testing.T) {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	tempDir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(tempDir)
+	defer os.Chdir(oldDir)
+
+	active, err := OpenActive()
+	if err != nil {
+		t.Fatalf("OpenActive failed: %v", err)
+	}
+	keyDir := NewKeyDir(nil)
+	put := func(bucket, key, val string) {
+		at, err := active.PutIn(bucket, []byte(key), []byte(val), 0)
+		if err != nil {
+			t.Fatalf("PutIn failed: %v", err)
+		}
+		keyDir.Put(BucketKey(bucket, []byte(key)), at)
+	}
+	rotate := func() {
+		if active, err = Rotator(context.Background(), active, keyDir, nil); err != nil {
+			t.Fatalf("Rotator failed: %v", err)
+		}
+	}
+	keys := func(entries map[string]types.FileOffset) []string {
+		var keys []string
+		for key := range entries {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		return keys
+	}
+
+	put("users", "a", "1")
+	put("users", "b", "2")
+	put("", "a", "3")
+	rotate()
+	if err := active.DropBucket("users"); err != nil {
+		t.Fatalf("DropBucket failed: %v", err)
+	}
+	keyDir.DropBucket("users")
+	put("users", "c", "4")
+	if keyDir.Count("users") != 1 || keyDir.Count("") != 1 {
+		t.Errorf("Expected one key in each bucket, got %d & %d", keyDir.Count("users"), keyDir.Count(""))
+	}
+
+	// the drop in data.txt hides the sealed file's part of the bucket.
+	if err := active.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if active, err = OpenActive(); err != nil {
+		t.Fatalf("OpenActive failed: %v", err)
+	}
+	cold, err := BuildKeyDir()
+	if err != nil {
+		t.Fatalf("BuildKeyDir failed: %v", err)
+	}
+	reopened := NewKeyDir(cold)
+	active.LoadInto(reopened)
+	want := []string{BucketKey("users", []byte("c")), "a"}
+	if got := keys(reopened.Snapshot()); !slices.Equal(got, want) {
+		t.Errorf("Reopened: expected %q, got %q", want, got)
+	}
+	rotate()
+
+	manifest, err := LoadManifest()
+	if err != nil {
+		t.Fatalf("LoadManifest failed: %v", err)
+	}
+	first, second := manifest.Files[0].Data, manifest.Files[1].Data
+	cold, err = BuildKeyDir()
+	if err != nil {
+		t.Fatalf("BuildKeyDir failed: %v", err)
+	}
+	if got := keys(cold); !slices.Equal(got, want) {
+		t.Errorf("Sealed: expected %q, got %q", want, got)
+	}
+
+	// a merge with older files left out carries the drop over, a full one
+	// has nothing left for it to hide.
+	partial, err := Merger(context.Background(), logMetas(second), logMetas(first), nil)
+	if err != nil {
+		t.Fatalf("partial Merger failed: %v", err)
+	}
+	full, err := Merger(context.Background(), logMetas(first, second), nil, nil)
+	if err != nil {
+		t.Fatalf("full Merger failed: %v", err)
+	}
+	for _, tc := range []struct {
+		merge *MergeResult
+		drops int
+	}{{partial, 1}, {full, 0}} {
+		entries, err := readHint(tc.merge.Hint)
+		if err != nil {
+			t.Fatalf("readHint failed: %v", err)
+		}
+		var drops []string
+		live := make(map[string]types.FileOffset)
+		for _, entry := range entries {
+			if entry.flag == types.FlagDropBucket {
+				drops = append(drops, entry.bucket)
+			} else {
+				live[BucketKey(entry.bucket, entry.key)] = types.FileOffset{Offset: entry.offset}
+			}
+		}
+		if len(drops) != tc.drops || tc.drops > 0 && drops[0] != "users" {
+			t.Errorf("Expected %d drops of users, got %q", tc.drops, drops)
+		}
+		if tc.merge == full {
+			if got := keys(live); !slices.Equal(got, want) {
+				t.Errorf("Full merge: expected %q, got %q", want, got)
+			}
+		}
+	}
+	active.Close()
+}
+
+func TestActiveReadsUnflushed(t *testing.T) {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	tempDir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(tempDir)
+	defer os.Chdir(oldDir)
+
+	active, err := OpenActive()
+	if err != nil {
+		t.Fatalf("OpenActive failed: %v", err)
+	}
+	defer active.Close()
+
+	// nothing flushed, the file is still empty.
+	small, err := active.Put([]byte("a"), []byte("1"))
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if info, _ := os.Stat(activeFile); info.Size() != 0 {
+		t.Fatalf("Expected nothing on disk yet, got %d bytes", info.Size())
+	}
+	// bigger than the buffer, it gets flushed half way through.
+	big := make([]byte, 10000)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	large, err := active.Put([]byte("b"), big)
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	after, err := active.Put([]byte("c"), []byte("3"))
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	check := func(when string) {
+		t.Helper()
+		for _, c := range []struct {
+			loc      types.FileOffset
+			key, val string
+		}{{small, "a", "1"}, {large, "b", string(big)}, {after, "c", "3"}} {
+			rec, err := active.ReadRecord(c.loc.Offset)
+			if err != nil {
+				t.Fatalf("%s: ReadRecord of %s failed: %v", when, c.key, err)
+			}
+			if string(rec.Key) != c.key || string(rec.Val) != c.val {
+				t.Errorf("%s: record at %d is %q, want %q", when, c.loc.Offset, rec.Key, c.key)
+			}
+		}
+	}
+	check("before flush")
+	if err := active.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	check("after flush")
+
+	// records bufio wrote out on its own aren't kept around.
+	for i := range 1000 {
+		if _, err := active.Put([]byte(fmt.Sprint("k", i)), []byte("v")); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if len(active.unflushed) > 4096/recordHeaderSize {
+		t.Errorf("Expected only what the buffer holds kept, got %d records", len(active.unflushed))
+	}
+}
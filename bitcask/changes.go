@@ -0,0 +1,275 @@
+package bitcask
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pro0o/deslocado/types"
+)
+
+// ErrCompacted means a merge already took the position in, the records from
+// there on aren't all around anymore.
+var ErrCompacted = errors.New("position compacted away")
+
+// Change is one committed record of a family. Flag is FlagNormal,
+// FlagTombstone or FlagDropBucket, a drop has no key. Timestamp & Expiry are
+// unix nanos.
+type Change struct {
+	Seq       uint64
+	Flag      types.RecordFlag
+	Timestamp int64
+	Expiry    int64
+	Bucket    string
+	Key       []byte
+	Val       []byte
+}
+
+// ChangeReader replays a family's records in seq order straight from its
+// data files: the immutables no merge took in yet, then data.txt. the file
+// it's in stays pinned, so it follows the file when data.txt gets sealed.
+type ChangeReader struct {
+	family  Family
+	next    uint64
+	pin     *Pin
+	file    *os.File
+	offset  int64
+	pending []Change
+}
+
+// Changes reads the default family from seq from on.
+func Changes(from uint64) (*ChangeReader, error) {
+	return Family{}.Changes(from)
+}
+
+// Changes reads from seq from on, 0 being the start. a consumer that handled
+// seq n resumes with n+1. a from some merge already took in is ErrCompacted.
+func (f Family) Changes(from uint64) (*ChangeReader, error) {
+	r := &ChangeReader{family: f, next: max(from, 1)}
+	if err := r.seek(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Next returns the next change, io.EOF once it caught up with data.txt.
+// calling it again later picks up whatever was written since. the caller
+// keeps rotations of the family out while it runs.
+func (r *ChangeReader) Next() (Change, error) {
+	for len(r.pending) == 0 {
+		if err := r.fill(); err != nil {
+			return Change{}, err
+		}
+	}
+	c := r.pending[0]
+	r.pending = r.pending[1:]
+	return c, nil
+}
+
+func (r *ChangeReader) Close() error {
+	if r.pin != nil {
+		r.pin.Release()
+	}
+	if r.file == nil {
+		return nil
+	}
+	return r.file.Close()
+}
+
+// what's new in the current file, else the file after it once the current
+// one got sealed. sealing writes nothing after the rename, so reading first
+// & checking the name after misses nothing.
+func (r *ChangeReader) fill() error {
+	n, err := r.read()
+	if err != nil || n > 0 {
+		return err
+	}
+	if r.pin.path(0) == r.family.path(activeFile) {
+		return io.EOF
+	}
+	return r.advance()
+}
+
+// the file after the sealed one, in MANIFEST order.
+func (r *ChangeReader) advance() error {
+	manifest, err := r.family.LoadManifest()
+	if err != nil {
+		return fmt.Errorf("load manifest: %w", err)
+	}
+	current := r.pin.path(0)
+	for i, meta := range manifest.Files {
+		if meta.Data != current {
+			continue
+		}
+		next := r.family.path(activeFile)
+		if i+1 < len(manifest.Files) {
+			next = manifest.Files[i+1].Data
+		}
+		if err := r.open(next); errors.Is(err, os.ErrNotExist) {
+			return r.seek()
+		} else if err != nil {
+			return err
+		}
+		return nil
+	}
+	// a merge took the file in meanwhile.
+	return r.seek()
+}
+
+// the last file starting at or before next, merged files only hold records
+// up to CompactedSeq so they're never it.
+func (r *ChangeReader) seek() error {
+	manifest, err := r.family.LoadManifest()
+	if err != nil {
+		return fmt.Errorf("load manifest: %w", err)
+	}
+	if r.next <= manifest.CompactedSeq {
+		return fmt.Errorf("seq %d, merged up to %d: %w", r.next, manifest.CompactedSeq, ErrCompacted)
+	}
+
+	var paths []string
+	for _, meta := range manifest.Files {
+		if meta.Generation == 0 {
+			paths = append(paths, meta.Data)
+		}
+	}
+	paths = append(paths, r.family.path(activeFile))
+
+	start := ""
+	for _, path := range paths {
+		first, ok, err := firstSeq(path)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if first > r.next && start != "" {
+			break
+		}
+		start = path
+		if first >= r.next {
+			break
+		}
+	}
+	if start == "" {
+		start = r.family.path(activeFile)
+	}
+	return r.open(start)
+}
+
+// false for an empty file.
+func firstSeq(path string) (uint64, bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, false, fmt.Errorf("open %s: %w", path, err)
+	}
+	defer file.Close()
+	h, err := readRecordHeader(bufio.NewReader(file))
+	if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, fmt.Errorf("read %s: %w", path, err)
+	}
+	return h.seq, true, nil
+}
+
+func (r *ChangeReader) open(path string) error {
+	pin := PinFiles([]string{path})
+	file, err := os.Open(path)
+	if err != nil {
+		pin.Release()
+		return fmt.Errorf("open %s: %w", path, err)
+	}
+	r.Close()
+	r.pin, r.file, r.offset = pin, file, 0
+	return nil
+}
+
+// queues every whole record past offset from seq next on, batch headers
+// aside. a record or batch still being written, or a cross-family batch
+// part not committed yet, is left for the next call. a part that never
+// committed is skipped.
+func (r *ChangeReader) read() (int, error) {
+	// only sealed logs & data.txt are read, never a sorted run, so the
+	// records run to EOF.
+	info, err := r.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	end := info.Size()
+	reader := bufio.NewReader(io.NewSectionReader(r.file, r.offset, end-r.offset))
+
+	var (
+		queued    int
+		offset    = r.offset
+		batch     []Change
+		batchLeft uint32
+		batchID   uint64
+	)
+	queue := func(changes ...Change) {
+		for _, c := range changes {
+			if c.Seq >= r.next {
+				r.pending = append(r.pending, c)
+				r.next = c.Seq + 1
+				queued++
+			}
+		}
+		r.offset = offset
+	}
+	for {
+		h, err := readRecordHeader(reader)
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+			return queued, nil
+		} else if err != nil {
+			return queued, err
+		}
+		c := Change{Seq: h.seq, Flag: h.flag, Timestamp: h.ts, Expiry: h.expiry, Bucket: h.bucket, Key: make([]byte, h.keyLen), Val: make([]byte, h.valLen)}
+		if _, err := io.ReadFull(reader, c.Key); err != nil {
+			return queued, ignoreTorn(err)
+		}
+		if _, err := io.ReadFull(reader, c.Val); err != nil {
+			return queued, ignoreTorn(err)
+		}
+		offset += h.size()
+
+		switch {
+		case h.flag == types.FlagBatch:
+			batch, batchLeft, batchID = nil, batchCount(c.Key), familyBatchID(c.Key)
+			if batchLeft == 0 {
+				queue()
+			}
+		case batchLeft > 0:
+			batch = append(batch, c)
+			if batchLeft--; batchLeft > 0 {
+				continue
+			}
+			if batchID != 0 {
+				batches, err := loadBatchLog()
+				if err != nil {
+					return queued, err
+				}
+				if batchID == batches.pending {
+					return queued, nil
+				}
+				// it never committed & never will, skipped.
+				if !batches.isCommitted(batchID) {
+					batch = nil
+				}
+			}
+			queue(batch...)
+		default:
+			queue(c)
+		}
+	}
+}
+
+// the rest of the record isn't there yet.
+func ignoreTorn(err error) error {
+	if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil
+	}
+	return err
+}
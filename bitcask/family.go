@@ -0,0 +1,243 @@
+package bitcask
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/pro0o/deslocado/types"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	familiesDir = "families"
+	// which cross-family batches landed everywhere, see batchLog.
+	batchFile = "BATCH"
+	lockFile  = "data.txt.lock"
+)
+
+var ErrBadFamily = errors.New("invalid family name")
+
+// Family is one independent set of files: its own data.txt, immutables,
+// hints & MANIFEST, merged on its own threshold. a named family lives in
+// families/<name>, the default one is the store dir itself. every family
+// shares the store's lock.
+type Family struct {
+	Name string
+	// merge once this many immutables pile up, 0 is MAX_IMMUTABLES.
+	MaxImmutables int
+}
+
+// names end up as a directory, so no separators & nothing special.
+func (f Family) Validate() error {
+	if f.Name == "" {
+		return nil
+	}
+	if f.Name == "." || f.Name == ".." || filepath.Base(f.Name) != f.Name || len(f.Name) > 255 {
+		return fmt.Errorf("family %q: %w", f.Name, ErrBadFamily)
+	}
+	return nil
+}
+
+func (f Family) dir() string {
+	if f.Name == "" {
+		return "."
+	}
+	return filepath.Join(familiesDir, f.Name)
+}
+
+// "." joins away, the default family keeps its bare names.
+func (f Family) path(name string) string {
+	return filepath.Join(f.dir(), name)
+}
+
+func (f Family) maxImmutables() int {
+	if f.MaxImmutables > 0 {
+		return f.MaxImmutables
+	}
+	return MAX_IMMUTABLES
+}
+
+// creates the family's directory, the default family's is already there.
+func (f Family) create() error {
+	if f.Name == "" {
+		return nil
+	}
+	if _, err := os.Stat(f.dir()); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(f.dir(), 0755); err != nil {
+		return fmt.Errorf("create family %s: %w", f.Name, err)
+	}
+	if err := syncDir(familiesDir); err != nil {
+		return err
+	}
+	return syncDir(".")
+}
+
+// FamilyOp is a batch op & the family it goes to.
+type FamilyOp struct {
+	Family *Active
+	BatchOp
+}
+
+// WriteFamilyBatch writes ops as one atomic batch across families: the
+// batch id goes in BATCH as pending, a part per family, every part synced,
+// then the id is committed. a part whose id never got committed is skipped
+// by every reader, writes after it stay. returns where each op landed &
+// its seq, in order.
+// the caller keeps every other write out until it returns.
+func WriteFamilyBatch(ops []FamilyOp) ([]types.FileOffset, []uint64, error) {
+	var order []*Active
+	parts := make(map[*Active][]BatchOp)
+	for _, op := range ops {
+		if _, ok := parts[op.Family]; !ok {
+			order = append(order, op.Family)
+		}
+		parts[op.Family] = append(parts[op.Family], op.BatchOp)
+	}
+
+	batches, err := loadBatchLog()
+	if err != nil {
+		return nil, nil, err
+	}
+	id := uint64(0)
+	if len(order) > 1 {
+		id = max(uint64(time.Now().UnixNano()), batches.committed+1, batches.pending+1)
+		// still pending, a crash cut that batch short.
+		if batches.pending != 0 {
+			batches.aborted = append(batches.aborted, batches.pending)
+		}
+		batches.pending = id
+		if err := batches.save(); err != nil {
+			return nil, nil, err
+		}
+	}
+	// the parts already written stay, BATCH is what says they don't count.
+	abort := func(err error) ([]types.FileOffset, []uint64, error) {
+		if id != 0 {
+			batches.aborted = append(batches.aborted, id)
+			batches.pending = 0
+			// best effort, a batch left pending is aborted by the next one.
+			if serr := batches.save(); serr != nil {
+				log.Error().Err(serr).Uint64("batch", id).Msg("Failed to record aborted batch!!")
+			}
+		}
+		return nil, nil, err
+	}
+
+	landed := make(map[*Active][]types.FileOffset, len(order))
+	written := make(map[*Active][]hintEntry, len(order))
+	for _, active := range order {
+		locs, entries, err := active.writeBatch(parts[active], id)
+		if err != nil {
+			return abort(err)
+		}
+		if err := active.Sync(); err != nil {
+			return abort(fmt.Errorf("sync batch part: %w", err))
+		}
+		landed[active], written[active] = locs, entries
+	}
+	if id != 0 {
+		done := batches
+		done.committed, done.pending = id, 0
+		if err := done.save(); err != nil {
+			return abort(fmt.Errorf("commit batch %d: %w", id, err))
+		}
+	}
+	for _, active := range order {
+		active.track(written[active])
+	}
+
+	locs := make([]types.FileOffset, 0, len(ops))
+	seqs := make([]uint64, 0, len(ops))
+	next := make(map[*Active]int, len(order))
+	for _, op := range ops {
+		i := next[op.Family]
+		locs = append(locs, landed[op.Family][i])
+		seqs = append(seqs, written[op.Family][i].seq)
+		next[op.Family]++
+	}
+	return locs, seqs, nil
+}
+
+// batchLog is what BATCH holds: the id of the last cross-family batch that
+// landed everywhere, the one being written & every one that didn't make
+// it. ids only grow, a part's id alone says whether it counts.
+// aborted is never pruned, it only grows on a failed or crashed batch.
+type batchLog struct {
+	committed uint64
+	pending   uint64
+	aborted   []uint64
+}
+
+// whole parts only, 0 is a batch within one family.
+func (b batchLog) isCommitted(id uint64) bool {
+	return id == 0 || id <= b.committed && !slices.Contains(b.aborted, id)
+}
+
+// committed u64 | pending u64 | count u32 | aborted u64 * count | crc32 u32,
+// all zero when no cross-family batch was ever written.
+func loadBatchLog() (batchLog, error) {
+	raw, err := os.ReadFile(batchFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return batchLog{}, nil
+	} else if err != nil {
+		return batchLog{}, fmt.Errorf("read %s: %w", batchFile, err)
+	}
+	damaged := fmt.Errorf("%s is damaged", batchFile)
+	if len(raw) < 24 {
+		return batchLog{}, damaged
+	}
+	body, sum := raw[:len(raw)-4], binary.BigEndian.Uint32(raw[len(raw)-4:])
+	count := binary.BigEndian.Uint32(body[16:20])
+	if crc32.ChecksumIEEE(body) != sum || uint64(len(body)) != 20+8*uint64(count) {
+		return batchLog{}, damaged
+	}
+	b := batchLog{
+		committed: binary.BigEndian.Uint64(body[:8]),
+		pending:   binary.BigEndian.Uint64(body[8:16]),
+	}
+	for i := range int(count) {
+		b.aborted = append(b.aborted, binary.BigEndian.Uint64(body[20+8*i:]))
+	}
+	return b, nil
+}
+
+// BATCH.tmp -> fsync -> BATCH -> fsync dir, same as the MANIFEST.
+func (b batchLog) save() error {
+	raw := binary.BigEndian.AppendUint64(nil, b.committed)
+	raw = binary.BigEndian.AppendUint64(raw, b.pending)
+	raw = binary.BigEndian.AppendUint32(raw, uint32(len(b.aborted)))
+	for _, id := range b.aborted {
+		raw = binary.BigEndian.AppendUint64(raw, id)
+	}
+	raw = binary.BigEndian.AppendUint32(raw, crc32.ChecksumIEEE(raw))
+
+	tmp := batchFile + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("create %s: %w", tmp, err)
+	}
+	if _, err := file.Write(raw); err != nil {
+		file.Close()
+		return fmt.Errorf("write %s: %w", tmp, err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("sync %s: %w", tmp, err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("close %s: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, batchFile); err != nil {
+		return fmt.Errorf("rename %s: %w", tmp, err)
+	}
+	return syncDir(".")
+}
@@ -0,0 +1,162 @@
+package bitcask
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func TestFamilyBatch(t *testing.T) {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	tempDir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(tempDir)
+	defer os.Chdir(oldDir)
+
+	hot := Family{Name: "hot"}
+	open := func() (*Active, *Active) {
+		t.Helper()
+		def, err := OpenActive()
+		if err != nil {
+			t.Fatalf("OpenActive failed: %v", err)
+		}
+		fam, err := hot.OpenActive()
+		if err != nil {
+			t.Fatalf("OpenActive hot failed: %v", err)
+		}
+		fam.ShareSeq(def)
+		return def, fam
+	}
+
+	def, fam := open()
+	locs, seqs, err := WriteFamilyBatch([]FamilyOp{
+		{Family: def, BatchOp: BatchOp{Key: []byte("a"), Val: []byte("1")}},
+		{Family: fam, BatchOp: BatchOp{Key: []byte("b"), Val: []byte("2")}},
+		{Family: def, BatchOp: BatchOp{Key: []byte("c"), Val: []byte("3")}},
+	})
+	if err != nil {
+		t.Fatalf("WriteFamilyBatch failed: %v", err)
+	}
+	// each data.txt's records carry the name it gets sealed under.
+	if locs[1].FileID != filepath.Join("families", "hot", sealedName(1)) || locs[2].FileID != sealedName(1) {
+		t.Errorf("Expected each op in its family's active file, got %+v", locs)
+	}
+	// def's header & a & c, then hot's header & b.
+	if fmt.Sprint(seqs) != "[2 5 3]" {
+		t.Errorf("Expected the ops' own seqs, got %v", seqs)
+	}
+	if batches, _ := loadBatchLog(); batches.committed == 0 || batches.pending != 0 {
+		t.Errorf("Expected the batch id committed, got %+v", batches)
+	}
+
+	// the second part fails, the first one is already in data.txt.
+	fam.file.Close()
+	if _, _, err := WriteFamilyBatch([]FamilyOp{
+		{Family: def, BatchOp: BatchOp{Key: []byte("lost"), Val: []byte("x")}},
+		{Family: fam, BatchOp: BatchOp{Key: []byte("lost"), Val: []byte("x")}},
+	}); err == nil {
+		t.Fatal("Expected the batch to fail")
+	}
+	if _, ok := def.hints["lost"]; ok {
+		t.Error("Expected the failed batch kept out of the hints")
+	}
+	after, err := def.Put([]byte("after"), []byte("1"))
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	def.Close()
+
+	def, fam = open()
+	// a later batch commits a higher id, the failed one still doesn't count.
+	if _, _, err := WriteFamilyBatch([]FamilyOp{
+		{Family: def, BatchOp: BatchOp{Key: []byte("d"), Val: []byte("4")}},
+		{Family: fam, BatchOp: BatchOp{Key: []byte("e"), Val: []byte("5")}},
+	}); err != nil {
+		t.Fatalf("WriteFamilyBatch failed: %v", err)
+	}
+	def.Close()
+	fam.Close()
+
+	def, fam = open()
+	defer func() { def.Close() }()
+	defer fam.Close()
+	if _, ok := def.hints["lost"]; ok || len(def.hints) != 4 || len(fam.hints) != 2 {
+		t.Errorf("Expected a, c, after & d and b & e, got %v & %v", def.hints, fam.hints)
+	}
+	if rec, err := def.ReadRecord(after.Offset); err != nil || string(rec.Key) != "after" {
+		t.Errorf("Expected the write after the failed batch kept, got %+v (%v)", rec, err)
+	}
+
+	// a hint rebuilt from the sealed log skips the part too.
+	sealed := def.FileID()
+	keyDir := NewKeyDir(nil)
+	if def, err = Rotator(context.Background(), def, keyDir, nil); err != nil {
+		t.Fatalf("Rotator failed: %v", err)
+	}
+	entries, err := rebuildHint(FileMeta{Data: sealed, Hint: hintName(sealed)})
+	if err != nil {
+		t.Fatalf("rebuildHint failed: %v", err)
+	}
+	for _, e := range entries {
+		if string(e.key) == "lost" {
+			t.Error("Expected the rebuilt hint to skip the failed batch")
+		}
+	}
+	if len(entries) != 4 {
+		t.Errorf("Expected 4 hint entries, got %d", len(entries))
+	}
+}
+
+func TestFamilyRotatesOnItsOwn(t *testing.T) {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	tempDir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(tempDir)
+	defer os.Chdir(oldDir)
+
+	// merges on every rotation.
+	archive := Family{Name: "archive", MaxImmutables: 1}
+	active, err := archive.OpenActive()
+	if err != nil {
+		t.Fatalf("OpenActive failed: %v", err)
+	}
+	keyDir := NewKeyDir(nil)
+	at, err := active.Put([]byte("k"), []byte("v"))
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	keyDir.Put("k", at)
+	if active, err = Rotator(context.Background(), active, keyDir, nil); err != nil {
+		t.Fatalf("Rotator failed: %v", err)
+	}
+	defer active.Close()
+
+	compacted := filepath.Join("families", "archive", compactedName(2))
+	if loc, _ := keyDir.Get("k"); loc.FileID != compacted {
+		t.Errorf("Expected k in %s, got %+v", compacted, loc)
+	}
+	cold, err := archive.BuildKeyDir()
+	if err != nil {
+		t.Fatalf("BuildKeyDir failed: %v", err)
+	}
+	if cold["k"].FileID != compacted {
+		t.Errorf("Expected a cold start to find k in %s, got %+v", compacted, cold)
+	}
+
+	// the default family has no files of its own yet.
+	manifest, err := LoadManifest()
+	if err != nil {
+		t.Fatalf("LoadManifest failed: %v", err)
+	}
+	if len(manifest.Files) != 0 {
+		t.Errorf("Expected the default family untouched, got %v", manifest.Files)
+	}
+	if _, err := os.Stat(manifestFile); err == nil {
+		t.Error("Expected no MANIFEST in the store dir")
+	}
+}
@@ -2,25 +2,18 @@ package bitcask
 
 import (
 	"fmt"
-	"path/filepath"
-	"sort"
+	"os"
 )
 
-func sorted(pattern string) ([]string, error) {
-	logs, err := filepath.Glob(pattern)
+// renames & removals only hit the disk once the dir entry is synced.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
 	if err != nil {
-		return nil, fmt.Errorf("glob logs: %w", err)
+		return fmt.Errorf("open dir %s: %w", dir, err)
 	}
-
-	getTS := func(name string) int64 {
-		var ts int64
-		fmt.Sscanf(name, "data_%d.log", &ts)
-		return ts
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("sync dir %s: %w", dir, err)
 	}
-
-	sort.Slice(logs, func(i, j int) bool {
-		return getTS(logs[i]) > getTS(logs[j])
-	})
-
-	return logs, nil
+	return nil
 }
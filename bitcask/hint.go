@@ -0,0 +1,275 @@
+package bitcask
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pro0o/deslocado/types"
+)
+
+// hint file: entries... | count u32 | crc32 u32
+// entry: flag u8 | bucketLen u16 | bucket | keyLen u32 | key | offset u64 |
+// valSize u32 | ts u64 | seq u64 | expiry u64
+// the crc covers every entry byte plus the count. a tombstone entry says the
+// key was deleted at offset, it has no value. a bucket drop entry has no key.
+const (
+	hintTrailerSize = 4 + 4
+	hintTempPattern = "hint_*.tmp"
+)
+
+var ErrBadHint = errors.New("invalid hint file")
+
+type hintEntry struct {
+	flag    types.RecordFlag
+	bucket  string
+	key     []byte
+	offset  int64
+	valSize uint32
+	ts      int64
+	seq     uint64
+	expiry  int64
+}
+
+func hintFromRecord(h recordHeader, key []byte, offset int64) hintEntry {
+	return hintEntry{flag: h.flag, bucket: h.bucket, key: key, offset: offset, valSize: h.valLen, ts: h.ts, seq: h.seq, expiry: h.expiry}
+}
+
+// keeps the latest entry of every key & the latest drop of every bucket.
+// a drop wins over the bucket's older entries by seq, whatever order they
+// come in.
+func trackHint(latest, drops map[string]hintEntry, e hintEntry) {
+	if e.flag == types.FlagDropBucket {
+		if d, ok := drops[e.bucket]; ok && d.seq >= e.seq {
+			return
+		}
+		drops[e.bucket] = e
+		for key, entry := range latest {
+			if entry.bucket == e.bucket && entry.seq < e.seq {
+				delete(latest, key)
+			}
+		}
+		return
+	}
+	if d, ok := drops[e.bucket]; ok && e.seq < d.seq {
+		return
+	}
+	latest[BucketKey(e.bucket, e.key)] = e
+}
+
+// drops first, then every entry by bucket & key.
+func collectHints(latest, drops map[string]hintEntry) []hintEntry {
+	entries := make([]hintEntry, 0, len(drops)+len(latest))
+	for _, entry := range drops {
+		entries = append(entries, entry)
+	}
+	for _, entry := range latest {
+		entries = append(entries, entry)
+	}
+	sortHints(entries)
+	return entries
+}
+
+func (e hintEntry) expired(now int64) bool {
+	return e.expiry != 0 && e.expiry <= now
+}
+
+func sortHints(entries []hintEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if (a.flag == types.FlagDropBucket) != (b.flag == types.FlagDropBucket) {
+			return a.flag == types.FlagDropBucket
+		}
+		if a.bucket != b.bucket {
+			return a.bucket < b.bucket
+		}
+		return bytes.Compare(a.key, b.key) < 0
+	})
+}
+
+type hintWriter struct {
+	writer io.Writer
+	crc    hash.Hash32
+	count  uint32
+}
+
+func newHintWriter(writer io.Writer) *hintWriter {
+	crc := crc32.NewIEEE()
+	return &hintWriter{writer: io.MultiWriter(writer, crc), crc: crc}
+}
+
+func (h *hintWriter) add(entry hintEntry) error {
+	raw := make([]byte, 0, 1+2+len(entry.bucket)+4+len(entry.key)+8+4+8+8+8)
+	raw = append(raw, byte(entry.flag))
+	raw = binary.BigEndian.AppendUint16(raw, uint16(len(entry.bucket)))
+	raw = append(raw, entry.bucket...)
+	raw = binary.BigEndian.AppendUint32(raw, uint32(len(entry.key)))
+	raw = append(raw, entry.key...)
+	raw = binary.BigEndian.AppendUint64(raw, uint64(entry.offset))
+	raw = binary.BigEndian.AppendUint32(raw, entry.valSize)
+	raw = binary.BigEndian.AppendUint64(raw, uint64(entry.ts))
+	raw = binary.BigEndian.AppendUint64(raw, entry.seq)
+	raw = binary.BigEndian.AppendUint64(raw, uint64(entry.expiry))
+	if _, err := h.writer.Write(raw); err != nil {
+		return err
+	}
+	h.count++
+	return nil
+}
+
+// trailer goes last, the caller still flushes & syncs.
+func (h *hintWriter) finish() error {
+	if err := binary.Write(h.writer, binary.BigEndian, h.count); err != nil {
+		return err
+	}
+	_, err := h.writer.Write(binary.BigEndian.AppendUint32(nil, h.crc.Sum32()))
+	return err
+}
+
+// sorted by key, fsynced.
+func writeHintFile(path string, entries []hintEntry) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("create hint file: %w", err)
+	}
+
+	writer := bufio.NewWriter(file)
+	hw := newHintWriter(writer)
+	for _, entry := range entries {
+		if err := hw.add(entry); err != nil {
+			file.Close()
+			return fmt.Errorf("write hint entry for %q: %w", entry.key, err)
+		}
+	}
+	if err := hw.finish(); err != nil {
+		file.Close()
+		return fmt.Errorf("write hint trailer: %w", err)
+	}
+	return flushSyncClose(writer, file)
+}
+
+// every failed check wraps ErrBadHint, I/O errors come back as they are.
+func readHint(path string) ([]hintEntry, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < hintTrailerSize {
+		return nil, fmt.Errorf("%s: %w: truncated", path, ErrBadHint)
+	}
+
+	body := raw[:len(raw)-4]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(raw[len(raw)-4:]) {
+		return nil, fmt.Errorf("%s: %w: checksum mismatch", path, ErrBadHint)
+	}
+	count := binary.BigEndian.Uint32(body[len(body)-4:])
+
+	reader := bytes.NewReader(body[:len(body)-4])
+	entries := make([]hintEntry, 0, count)
+	for reader.Len() > 0 {
+		flag, _ := reader.ReadByte()
+		var bucketLen uint16
+		if err := binary.Read(reader, binary.BigEndian, &bucketLen); err != nil {
+			return nil, fmt.Errorf("%s: %w: %v", path, ErrBadHint, err)
+		}
+		if int(bucketLen) > reader.Len() {
+			return nil, fmt.Errorf("%s: %w: bucket length %d past the end", path, ErrBadHint, bucketLen)
+		}
+		bucket := make([]byte, bucketLen)
+		io.ReadFull(reader, bucket)
+
+		var keyLen uint32
+		if err := binary.Read(reader, binary.BigEndian, &keyLen); err != nil {
+			return nil, fmt.Errorf("%s: %w: %v", path, ErrBadHint, err)
+		}
+		if int64(keyLen) > int64(reader.Len()) {
+			return nil, fmt.Errorf("%s: %w: key length %d past the end", path, ErrBadHint, keyLen)
+		}
+		entry := hintEntry{flag: types.RecordFlag(flag), bucket: string(bucket), key: make([]byte, keyLen)}
+		io.ReadFull(reader, entry.key)
+
+		var fixed struct {
+			Offset  uint64
+			ValSize uint32
+			Ts      uint64
+			Seq     uint64
+			Expiry  uint64
+		}
+		if err := binary.Read(reader, binary.BigEndian, &fixed); err != nil {
+			return nil, fmt.Errorf("%s: %w: %v", path, ErrBadHint, err)
+		}
+		entry.offset = int64(fixed.Offset)
+		entry.valSize = fixed.ValSize
+		entry.ts = int64(fixed.Ts)
+		entry.seq = fixed.Seq
+		entry.expiry = int64(fixed.Expiry)
+		entries = append(entries, entry)
+	}
+	if uint32(len(entries)) != count {
+		return nil, fmt.Errorf("%s: %w: %d entries, trailer says %d", path, ErrBadHint, len(entries), count)
+	}
+	return entries, nil
+}
+
+// the slow path: scan the data log for the latest record of every key,
+// tombstones & bucket drops included, & write the hint back.
+func rebuildHint(meta FileMeta) ([]hintEntry, error) {
+	data, hint := meta.Data, meta.Hint
+	file, err := os.Open(data)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	records, err := recordReader(file, meta.Generation > 0)
+	if err != nil {
+		return nil, err
+	}
+	batches, err := loadBatchLog()
+	if err != nil {
+		return nil, err
+	}
+	latest, drops := make(map[string]hintEntry), make(map[string]hintEntry)
+	// records left of a batch part that never committed.
+	var skip uint32
+	if _, err := scanRecords(bufio.NewReader(records), func(offset int64, h recordHeader, key []byte) error {
+		switch {
+		case h.flag == types.FlagBatch:
+			if !batches.isCommitted(familyBatchID(key)) {
+				skip = batchCount(key)
+			}
+		case skip > 0:
+			skip--
+		default:
+			trackHint(latest, drops, hintFromRecord(h, key, offset))
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("scan %s: %w", data, err)
+	}
+	entries := collectHints(latest, drops)
+
+	// temp -> rename, a crash never leaves a half written hint in place.
+	tmp, err := os.CreateTemp(filepath.Dir(hint), hintTempPattern)
+	if err != nil {
+		return nil, fmt.Errorf("create hint temp: %w", err)
+	}
+	tmp.Close()
+	if err := writeHintFile(tmp.Name(), entries); err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), hint); err != nil {
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("install rebuilt hint %s: %w", hint, err)
+	}
+	return entries, syncDir(filepath.Dir(hint))
+}
@@ -0,0 +1,228 @@
+package bitcask
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pro0o/deslocado/types"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func TestReadHintRejectsDamage(t *testing.T) {
+	tempDir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(tempDir)
+	defer os.Chdir(oldDir)
+
+	entries := []hintEntry{
+		{key: []byte("a"), offset: 0},
+		{key: []byte("b"), offset: 10, seq: 7},
+	}
+	if err := writeHintFile("good.hint", entries); err != nil {
+		t.Fatalf("writeHintFile failed: %v", err)
+	}
+	good, _ := os.ReadFile("good.hint")
+
+	loaded, err := readHint("good.hint")
+	if err != nil {
+		t.Fatalf("readHint failed: %v", err)
+	}
+	if len(loaded) != 2 || string(loaded[1].key) != "b" || loaded[1].offset != 10 || loaded[1].seq != 7 {
+		t.Errorf("Unexpected entries %+v", loaded)
+	}
+
+	// right checksum, wrong count.
+	miscounted := append([]byte{}, good[:len(good)-hintTrailerSize]...)
+	miscounted = binary.BigEndian.AppendUint32(miscounted, 3)
+	miscounted = binary.BigEndian.AppendUint32(miscounted, crc32.ChecksumIEEE(miscounted))
+
+	flipped := append([]byte{}, good...)
+	flipped[2] ^= 0xff
+
+	damaged := map[string][]byte{
+		"truncated":  good[:len(good)-3],
+		"flipped":    flipped,
+		"miscounted": miscounted,
+		"tiny":       good[:2],
+	}
+	for name, raw := range damaged {
+		t.Run(name, func(t *testing.T) {
+			os.WriteFile(name+".hint", raw, 0644)
+			if _, err := readHint(name + ".hint"); !errors.Is(err, ErrBadHint) {
+				t.Errorf("Expected ErrBadHint, got %v", err)
+			}
+		})
+	}
+}
+
+func TestBuildKeyDirRebuildsBadHint(t *testing.T) {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	tempDir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(tempDir)
+	defer os.Chdir(oldDir)
+
+	entries := []testEntry{
+		{flag: byte(types.FlagNormal), key: "a", value: []byte("1")},
+		{flag: byte(types.FlagNormal), key: "b", value: []byte("2")},
+		{flag: byte(types.FlagNormal), key: "a", value: []byte("3")},
+		{flag: byte(types.FlagTombstone), key: "b"},
+		{flag: byte(types.FlagNormal), key: "c", value: []byte("4")},
+	}
+	if err := createLogFileForTest("data_000001.log", entries); err != nil {
+		t.Fatalf("Failed to create log file: %v", err)
+	}
+	// bogus offsets, cut short.
+	if err := createHintFileForTest("data_000001.hint", map[string]int64{"a": 999, "b": 999}); err != nil {
+		t.Fatalf("Failed to create hint file: %v", err)
+	}
+	raw, _ := os.ReadFile("data_000001.hint")
+	os.WriteFile("data_000001.hint", raw[:len(raw)-1], 0644)
+	if err := createManifestForTest("data_000001.hint"); err != nil {
+		t.Fatalf("Failed to create manifest: %v", err)
+	}
+
+	keyDir, err := BuildKeyDir()
+	if err != nil {
+		t.Fatalf("BuildKeyDir failed: %v", err)
+	}
+
+	size := recordSize([]byte("a"), []byte("1"))
+	expected := map[string]int64{"a": 2 * size, "c": 3*size + recordSize([]byte("b"), nil)}
+	if len(keyDir) != len(expected) {
+		t.Errorf("Expected %d keys, got %v", len(expected), keyDir)
+	}
+	for key, offset := range expected {
+		if keyDir[key] != (types.FileOffset{FileID: "data_000001.log", Offset: offset}) {
+			t.Errorf("Key %q: expected offset %d, got %+v", key, offset, keyDir[key])
+		}
+	}
+
+	rewritten, err := readHintFile("data_000001.hint")
+	if err != nil {
+		t.Fatalf("Expected the hint to be rewritten, got %v", err)
+	}
+	for key, offset := range expected {
+		if rewritten[key] != offset {
+			t.Errorf("Rewritten hint %q: expected %d, got %d", key, offset, rewritten[key])
+		}
+	}
+}
+
+func TestBuildKeyDirRebuildsMissingHint(t *testing.T) {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	tempDir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(tempDir)
+	defer os.Chdir(oldDir)
+
+	entries := []testEntry{
+		{flag: byte(types.FlagNormal), key: "a", value: []byte("1")},
+		{flag: byte(types.FlagNormal), key: "b", value: []byte("2")},
+	}
+	if err := createLogFileForTest("data_000001.log", entries); err != nil {
+		t.Fatalf("Failed to create log file: %v", err)
+	}
+	// listed in the MANIFEST, never written.
+	if err := createManifestForTest("data_000001.hint"); err != nil {
+		t.Fatalf("Failed to create manifest: %v", err)
+	}
+
+	keyDir, err := BuildKeyDir()
+	if err != nil {
+		t.Fatalf("BuildKeyDir failed: %v", err)
+	}
+	size := recordSize([]byte("a"), []byte("1"))
+	expected := map[string]int64{"a": 0, "b": size}
+	if len(keyDir) != len(expected) {
+		t.Errorf("Expected %d keys, got %v", len(expected), keyDir)
+	}
+	for key, offset := range expected {
+		if keyDir[key] != (types.FileOffset{FileID: "data_000001.log", Offset: offset}) {
+			t.Errorf("Key %q: expected offset %d, got %+v", key, offset, keyDir[key])
+		}
+	}
+	if _, err := readHintFile("data_000001.hint"); err != nil {
+		t.Errorf("Expected the hint to be written, got %v", err)
+	}
+}
+
+func TestHintTombstonesAndExpiry(t *testing.T) {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	tempDir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(tempDir)
+	defer os.Chdir(oldDir)
+
+	// older file: plain values.
+	if err := createLogFileForTest("data_000001.log", []testEntry{
+		{flag: byte(types.FlagNormal), key: "deleted", value: []byte("old")},
+		{flag: byte(types.FlagNormal), key: "expired", value: []byte("old")},
+		{flag: byte(types.FlagNormal), key: "kept", value: []byte("old")},
+	}); err != nil {
+		t.Fatalf("Failed to create log file: %v", err)
+	}
+
+	// newer file: a delete, a value past its expiry & one still live.
+	past := time.Now().Add(-time.Minute).UnixNano()
+	future := time.Now().Add(time.Hour).UnixNano()
+	file, _ := os.Create("data_000002.log")
+	writer := bufio.NewWriter(file)
+	WriterTombstone(writer, []byte("deleted"))
+	WriterExpiring(writer, []byte("expired"), []byte("new"), past)
+	WriterExpiring(writer, []byte("kept"), []byte("new"), future)
+	writer.Flush()
+	file.Close()
+
+	for _, data := range []string{"data_000001.log", "data_000002.log"} {
+		if _, err := rebuildHint(FileMeta{Data: data, Hint: hintName(data)}); err != nil {
+			t.Fatalf("rebuildHint failed: %v", err)
+		}
+	}
+	if err := createManifestForTest("data_000001.hint", "data_000002.hint"); err != nil {
+		t.Fatalf("Failed to create manifest: %v", err)
+	}
+
+	entries, err := readHint("data_000002.hint")
+	if err != nil {
+		t.Fatalf("readHint failed: %v", err)
+	}
+	byKey := make(map[string]hintEntry)
+	for _, entry := range entries {
+		byKey[string(entry.key)] = entry
+	}
+	if e := byKey["deleted"]; e.flag != types.FlagTombstone || e.valSize != 0 || e.ts == 0 {
+		t.Errorf("Expected a timestamped tombstone entry, got %+v", e)
+	}
+	if e := byKey["kept"]; e.flag != types.FlagNormal || e.valSize != 3 || e.expiry != future {
+		t.Errorf("Expected value entry with size 3 & expiry %d, got %+v", future, e)
+	}
+
+	keyDir, err := BuildKeyDir()
+	if err != nil {
+		t.Fatalf("BuildKeyDir failed: %v", err)
+	}
+	if len(keyDir) != 1 || keyDir["kept"].FileID != "data_000002.log" {
+		t.Errorf("Expected only kept from the newer file, got %v", keyDir)
+	}
+
+	// a full merge drops both dead keys for good.
+	merged, err := Merger(context.Background(), logMetas("data_000001.log", "data_000002.log"), nil, nil)
+	if err != nil {
+		t.Fatalf("Merger failed: %v", err)
+	}
+	values, err := readCompactedFile(merged.Data)
+	if err != nil {
+		t.Fatalf("Failed to read merged data: %v", err)
+	}
+	if len(values) != 1 || string(values["kept"]) != "new" {
+		t.Errorf("Expected only kept=new after the merge, got %v", values)
+	}
+}
@@ -1,52 +1,84 @@
 package bitcask
 
 import (
-	"bufio"
-	"encoding/binary"
-	"io"
-	"os"
-	"strings"
+	"errors"
+	"io/fs"
+	"time"
 
 	"github.com/pro0o/deslocado/types"
+	"github.com/rs/zerolog/log"
 )
 
+// BuildKeyDir loads the default family's keyDir.
 func BuildKeyDir() (map[string]types.FileOffset, error) {
+	return Family{}.BuildKeyDir()
+}
+
+// oldest -> newest per the MANIFEST, so newer hints overwrite older ones.
+// every sealed file has a hint, an entry without one is skipped.
+func (f Family) BuildKeyDir() (map[string]types.FileOffset, error) {
 	keyDir := make(map[string]types.FileOffset)
-	hints, err := sorted("data_*.hint")
+	manifest, err := f.LoadManifest()
 	if err != nil {
 		return nil, err
 	}
-	for _, hint := range hints {
-
-		// compact.hint -> compact.log
-		log := strings.TrimSuffix(hint, ".hint") + ".log"
-		file, err := os.Open(hint)
-		if err != nil {
+	for _, meta := range manifest.Files {
+		if meta.Hint == "" {
+			log.Warn().Str("file", meta.Data).Msg("No hint file, keys skipped!!")
+			continue
+		}
+		if err := loadHint(meta, keyDir); err != nil {
 			return nil, err
 		}
-		reader := bufio.NewReader(file)
-		for {
-			var keyLen uint32
-			if err := binary.Read(reader, binary.BigEndian, &keyLen); err == io.EOF {
-				break
-			} else if err != nil {
-				return nil, err
-			}
-			keyBuffer := make([]byte, (keyLen))
-			if _, err := io.ReadFull(reader, keyBuffer); err != nil {
-				return nil, err
-			}
+	}
+	return keyDir, nil
+}
 
-			var offset uint64
-			if err := binary.Read(reader, binary.BigEndian, &offset); err != nil {
-				return nil, err
-			}
-			keyDir[string(keyBuffer)] = types.FileOffset{
-				FileID: log,
-				Offset: int64(offset),
+// a hint that fails its checks or is missing is rebuilt from the data log,
+// a crash between sealing a file & writing its hint leaves none.
+func loadHint(meta FileMeta, keyDir map[string]types.FileOffset) error {
+	entries, err := readHint(meta.Hint)
+	switch {
+	case errors.Is(err, ErrBadHint):
+		log.Warn().Err(err).Str("file", meta.Data).Msg("Bad hint file, rebuilding from the data log!!")
+		entries, err = rebuildHint(meta)
+	case errors.Is(err, fs.ErrNotExist):
+		log.Warn().Str("file", meta.Data).Msg("Missing hint file, rebuilding from the data log!!")
+		entries, err = rebuildHint(meta)
+	}
+	if err != nil {
+		return err
+	}
+
+	// a drop clears what older files hold of its bucket, this file only
+	// has entries written after it.
+	for _, entry := range entries {
+		if entry.flag != types.FlagDropBucket {
+			continue
+		}
+		for key := range keyDir {
+			if bucket, _ := SplitBucketKey(key); bucket == entry.bucket {
+				delete(keyDir, key)
 			}
 		}
-		file.Close()
 	}
-	return keyDir, nil
+
+	// a newer tombstone or an expiry that has passed hides older values.
+	now := time.Now().UnixNano()
+	for _, entry := range entries {
+		if entry.flag == types.FlagDropBucket {
+			continue
+		}
+		key := BucketKey(entry.bucket, entry.key)
+		if entry.flag == types.FlagTombstone || entry.expired(now) {
+			delete(keyDir, key)
+			continue
+		}
+		keyDir[key] = types.FileOffset{
+			FileID: meta.Data,
+			Offset: entry.offset,
+			Expiry: entry.expiry,
+		}
+	}
+	return nil
 }
@@ -5,6 +5,8 @@ import (
 	"encoding/binary"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
 
 	"github.com/pro0o/deslocado/types"
@@ -22,19 +24,25 @@ func createHintFileForTest(hintPath string, entries map[string]int64) error {
 	writer := bufio.NewWriter(file)
 	defer writer.Flush()
 
+	hw := newHintWriter(writer)
 	for key, offset := range entries {
-		if err := binary.Write(writer, binary.BigEndian, uint32(len(key))); err != nil {
-			return err
-		}
-		if _, err := writer.Write([]byte(key)); err != nil {
-			return err
-		}
-		if err := binary.Write(writer, binary.BigEndian, uint64(offset)); err != nil {
+		if err := hw.add(hintEntry{key: []byte(key), offset: offset}); err != nil {
 			return err
 		}
 	}
 
-	return nil
+	return hw.finish()
+}
+
+// registers each hint & its x.hint -> x.log data file in a MANIFEST,
+// oldest -> newest in argument order.
+func createManifestForTest(hints ...string) error {
+	manifest := &Manifest{NextID: 1}
+	for _, hint := range hints {
+		data := strings.TrimSuffix(hint, ".hint") + ".log"
+		manifest.Files = append(manifest.Files, FileMeta{ID: manifest.allocID(), Data: data, Hint: hint})
+	}
+	return manifest.save()
 }
 
 func createLogFileForTest(logPath string, entries []testEntry) error {
@@ -131,10 +139,16 @@ func TestBuildKeyDir(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
+			var hints []string
 			for hintFile, entries := range tc.hintFiles {
 				if err := createHintFileForTest(hintFile, entries); err != nil {
 					t.Fatalf("Failed to create hint file %s: %v", hintFile, err)
 				}
+				hints = append(hints, hintFile)
+			}
+			sort.Strings(hints)
+			if err := createManifestForTest(hints...); err != nil {
+				t.Fatalf("Failed to create manifest: %v", err)
 			}
 
 			keyDir, err := BuildKeyDir()
@@ -192,6 +206,10 @@ func TestBuildKeyDirFileOperations(t *testing.T) {
 		writer.Flush()
 		file.Close()
 
+		if err := createManifestForTest("data_corrupted.hint"); err != nil {
+			t.Fatalf("Failed to create manifest: %v", err)
+		}
+
 		_, err = BuildKeyDir()
 		if err == nil {
 			t.Error("Expected error when reading corrupted hint file")
@@ -208,6 +226,9 @@ func TestBuildKeyDirFileOperations(t *testing.T) {
 		if err := createHintFileForTest("data_test.hint", hintEntries); err != nil {
 			t.Fatalf("Failed to create hint file: %v", err)
 		}
+		if err := createManifestForTest("data_test.hint"); err != nil {
+			t.Fatalf("Failed to create manifest: %v", err)
+		}
 
 		if err := os.Chmod("data_test.hint", 0000); err == nil {
 			_, err := BuildKeyDir()
@@ -248,6 +269,9 @@ func TestBuildKeyDirWithRealData(t *testing.T) {
 	if err := createHintFileForTest("data_compacted_real.hint", hintEntries); err != nil {
 		t.Fatalf("Failed to create hint file: %v", err)
 	}
+	if err := createManifestForTest("data_compacted_real.hint"); err != nil {
+		t.Fatalf("Failed to create manifest: %v", err)
+	}
 
 	keyDir, err := BuildKeyDir()
 	if err != nil {
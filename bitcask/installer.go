@@ -0,0 +1,175 @@
+package bitcask
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/gofrs/flock"
+	"github.com/rs/zerolog/log"
+)
+
+const mergeTempPattern = "merge_*.tmp"
+
+// an install is the renames (temp -> final) & removals (merged inputs) that
+// finish a merge. the MANIFEST save between the two is the commit point.
+type install struct {
+	renames [][2]string
+	removes []string
+}
+
+func (in *install) rename(from, to string) {
+	in.renames = append(in.renames, [2]string{from, to})
+}
+
+func (in *install) remove(path string) {
+	in.removes = append(in.removes, path)
+}
+
+// temps -> final names -> MANIFEST -> drop inputs
+// a crash before the MANIFEST lands leaves only unreferenced files behind,
+// a crash after it leaves only stale inputs, Recover deletes both.
+func installMerge(m *Manifest, in *install) error {
+	for _, r := range in.renames {
+		if err := os.Rename(r[0], r[1]); err != nil {
+			return fmt.Errorf("install %s -> %s: %w", r[0], r[1], err)
+		}
+	}
+	if err := m.syncDir(); err != nil {
+		return err
+	}
+
+	if err := m.save(); err != nil {
+		return fmt.Errorf("commit manifest: %w", err)
+	}
+
+	for _, path := range in.removes {
+		if err := pins.remove(path); err != nil {
+			log.Warn().Err(err).Str("file", path).Msg("Failed to delete stale file")
+		}
+	}
+	return m.syncDir()
+}
+
+func removeFiles(paths []string) error {
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("remove %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// rotation commits the MANIFEST before renaming data.txt, so a missing
+// newest file means the rename never happened.
+func recoverRotation(m *Manifest) error {
+	for i, meta := range m.Files {
+		if _, err := os.Stat(meta.Data); err == nil {
+			continue
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("stat %s: %w", meta.Data, err)
+		}
+
+		if i != len(m.Files)-1 {
+			return fmt.Errorf("manifest references missing file %s", meta.Data)
+		}
+		active := filepath.Join(m.dir, activeFile)
+		if err := os.Rename(active, meta.Data); err != nil {
+			return fmt.Errorf("finish rotation of %s -> %s: %w", active, meta.Data, err)
+		}
+		log.Info().Str("file", meta.Data).Msg("Finished interrupted rotation!!")
+	}
+	return nil
+}
+
+// merge & hint temps -> always garbage
+// data & hints the MANIFEST doesn't know -> half installed merge output or
+// inputs of a committed one, garbage either way.
+func recoverMerge(f Family) error {
+	m, err := f.LoadManifest()
+	if err != nil {
+		return err
+	}
+
+	temps := []string{f.path(manifestFile + ".tmp")}
+	if f.Name == "" {
+		temps = append(temps, batchFile+".tmp")
+	}
+	for _, pattern := range []string{mergeTempPattern, hintTempPattern} {
+		matches, err := filepath.Glob(f.path(pattern))
+		if err != nil {
+			return fmt.Errorf("glob %s: %w", pattern, err)
+		}
+		temps = append(temps, matches...)
+	}
+	if err := removeFiles(temps); err != nil {
+		return err
+	}
+
+	// nothing is authoritative before the first MANIFEST is written.
+	if m.onDisk {
+		if err := recoverRotation(m); err != nil {
+			return err
+		}
+
+		refs := m.referenced()
+		var stale []string
+		for _, pattern := range []string{"data_*.log", "data_*.hint"} {
+			matches, err := filepath.Glob(f.path(pattern))
+			if err != nil {
+				return fmt.Errorf("glob %s: %w", pattern, err)
+			}
+			// a snapshot may still read a file the MANIFEST let go of.
+			for _, path := range matches {
+				if !refs[path] && !pins.held(path) {
+					stale = append(stale, path)
+				}
+			}
+		}
+		if len(stale) > 0 {
+			log.Info().Strs("files", stale).Msg("Dropping files left by an interrupted merge!!")
+		}
+		if err := removeFiles(stale); err != nil {
+			return err
+		}
+	}
+	return syncDir(f.dir())
+}
+
+// Recover cleans up the default family after a rotation or merge that
+// crashed half way. call it on startup before BuildKeyDir.
+func Recover() error {
+	return Family{}.Recover()
+}
+
+func (f Family) Recover() error {
+	if err := f.create(); err != nil {
+		return err
+	}
+	lock := flock.New(lockFile)
+	if err := lock.Lock(); err != nil {
+		return fmt.Errorf("lock file: %w", err)
+	}
+	defer lock.Unlock()
+
+	if f.Name == "" {
+		if err := recoverBatch(); err != nil {
+			return err
+		}
+	}
+	return recoverMerge(f)
+}
+
+// nothing is written before Recover, a batch still pending was cut short.
+func recoverBatch() error {
+	batches, err := loadBatchLog()
+	if err != nil || batches.pending == 0 {
+		return err
+	}
+	log.Warn().Uint64("batch", batches.pending).Msg("Aborting cross-family batch a crash cut short!!")
+	batches.aborted = append(batches.aborted, batches.pending)
+	batches.pending = 0
+	return batches.save()
+}
@@ -0,0 +1,234 @@
+package bitcask
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pro0o/deslocado/types"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func TestMergerLeavesNoFixedOutput(t *testing.T) {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	tempDir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(tempDir)
+	defer os.Chdir(oldDir)
+
+	entries := []testEntry{
+		{flag: byte(types.FlagNormal), key: "key1", value: []byte("value1")},
+	}
+	if err := createTestLogFile("data_1.log", entries); err != nil {
+		t.Fatalf("Failed to create test log file: %v", err)
+	}
+
+	// leftover from an old crashed merge must not get appended to.
+	if err := os.WriteFile("compacted_data.txt", []byte("garbage"), 0644); err != nil {
+		t.Fatalf("Failed to create leftover file: %v", err)
+	}
+
+	first, err := Merger(context.Background(), logMetas("data_1.log"), nil, nil)
+	if err != nil {
+		t.Fatalf("Merger failed: %v", err)
+	}
+	second, err := Merger(context.Background(), logMetas("data_1.log"), nil, nil)
+	if err != nil {
+		t.Fatalf("Merger failed: %v", err)
+	}
+	if first.Data == second.Data || first.Hint == second.Hint {
+		t.Fatalf("Expected unique temp files, got %+v twice", first)
+	}
+
+	for _, path := range []string{first.Data, second.Data} {
+		actual, err := readCompactedFile(path)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", path, err)
+		}
+		if len(actual) != 1 || string(actual["key1"]) != "value1" {
+			t.Errorf("Unexpected content in %s: %v", path, actual)
+		}
+	}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// one sealed log with its hint, registered in a fresh MANIFEST.
+func setupManifestStore(t *testing.T) *Manifest {
+	entries := []testEntry{
+		{flag: byte(types.FlagNormal), key: "key1", value: []byte("value1")},
+	}
+	manifest := &Manifest{NextID: 1}
+	id := manifest.allocID()
+	if err := createTestLogFile(sealedName(id), entries); err != nil {
+		t.Fatalf("Failed to create test log file: %v", err)
+	}
+	if err := createHintFileForTest(hintName(sealedName(id)), map[string]int64{"key1": 0}); err != nil {
+		t.Fatalf("Failed to create hint file: %v", err)
+	}
+	manifest.Files = append(manifest.Files, FileMeta{ID: id, Data: sealedName(id), Hint: hintName(sealedName(id))})
+	if err := manifest.save(); err != nil {
+		t.Fatalf("Failed to save manifest: %v", err)
+	}
+	return manifest
+}
+
+// merge output renamed into place & the MANIFEST swapped in memory, but
+// nothing committed yet.
+func stageMerge(t *testing.T, manifest *Manifest) (*install, FileMeta) {
+	logs := manifest.logs()
+	merged, err := Merger(context.Background(), manifest.Files, nil, nil)
+	if err != nil {
+		t.Fatalf("Merger failed: %v", err)
+	}
+
+	outID := manifest.allocID()
+	out := FileMeta{ID: outID, Data: compactedName(outID), Hint: hintName(compactedName(outID))}
+	in, err := compactionInstall(manifest, logs, merged, out)
+	if err != nil {
+		t.Fatalf("compactionInstall failed: %v", err)
+	}
+	for _, r := range in.renames {
+		if err := os.Rename(r[0], r[1]); err != nil {
+			t.Fatalf("rename failed: %v", err)
+		}
+	}
+	return in, out
+}
+
+func TestRecover(t *testing.T) {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	tempDir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(tempDir)
+	defer os.Chdir(oldDir)
+
+	cleanup := func() {
+		files, _ := filepath.Glob("*")
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}
+
+	t.Run("uncommitted_merge_temp_is_dropped", func(t *testing.T) {
+		defer cleanup()
+		manifest := setupManifestStore(t)
+		merged, err := Merger(context.Background(), manifest.Files, nil, nil)
+		if err != nil {
+			t.Fatalf("Merger failed: %v", err)
+		}
+
+		if err := Recover(); err != nil {
+			t.Fatalf("Recover failed: %v", err)
+		}
+
+		for _, path := range []string{merged.Data, merged.Hint} {
+			if fileExists(path) {
+				t.Errorf("Expected %s to be removed", path)
+			}
+		}
+		if !fileExists(manifest.Files[0].Data) {
+			t.Error("Expected input log to survive")
+		}
+	})
+
+	t.Run("crash_before_manifest_commit", func(t *testing.T) {
+		defer cleanup()
+		manifest := setupManifestStore(t)
+		input := manifest.Files[0]
+		_, out := stageMerge(t, manifest)
+
+		if err := Recover(); err != nil {
+			t.Fatalf("Recover failed: %v", err)
+		}
+
+		for _, path := range []string{out.Data, out.Hint} {
+			if fileExists(path) {
+				t.Errorf("Expected uncommitted %s to be removed", path)
+			}
+		}
+		for _, path := range []string{input.Data, input.Hint} {
+			if !fileExists(path) {
+				t.Errorf("Expected input %s to survive", path)
+			}
+		}
+
+		keyDir, err := BuildKeyDir()
+		if err != nil {
+			t.Fatalf("BuildKeyDir failed: %v", err)
+		}
+		if keyDir["key1"].FileID != input.Data {
+			t.Errorf("Expected key1 in %s, got %+v", input.Data, keyDir["key1"])
+		}
+	})
+
+	t.Run("crash_after_manifest_commit", func(t *testing.T) {
+		defer cleanup()
+		manifest := setupManifestStore(t)
+		input := manifest.Files[0]
+		_, out := stageMerge(t, manifest)
+		if err := manifest.save(); err != nil {
+			t.Fatalf("save manifest failed: %v", err)
+		}
+
+		if err := Recover(); err != nil {
+			t.Fatalf("Recover failed: %v", err)
+		}
+
+		for _, path := range []string{out.Data, out.Hint} {
+			if !fileExists(path) {
+				t.Errorf("Expected installed %s to survive", path)
+			}
+		}
+		for _, path := range []string{input.Data, input.Hint} {
+			if fileExists(path) {
+				t.Errorf("Expected stale input %s to be removed", path)
+			}
+		}
+
+		keyDir, err := BuildKeyDir()
+		if err != nil {
+			t.Fatalf("BuildKeyDir failed: %v", err)
+		}
+		if keyDir["key1"].FileID != out.Data {
+			t.Errorf("Expected key1 in %s, got %+v", out.Data, keyDir["key1"])
+		}
+
+		// recovering twice is a no-op.
+		if err := Recover(); err != nil {
+			t.Fatalf("second Recover failed: %v", err)
+		}
+		if !fileExists(out.Data) {
+			t.Error("Expected compacted log to survive a second recovery")
+		}
+	})
+
+	t.Run("crash_before_rotation_rename", func(t *testing.T) {
+		defer cleanup()
+		manifest := setupManifestStore(t)
+		if err := createTestLogFile("data.txt", nil); err != nil {
+			t.Fatalf("Failed to create data.txt: %v", err)
+		}
+		id := manifest.allocID()
+		manifest.Files = append(manifest.Files, FileMeta{ID: id, Data: sealedName(id)})
+		if err := manifest.save(); err != nil {
+			t.Fatalf("save manifest failed: %v", err)
+		}
+
+		if err := Recover(); err != nil {
+			t.Fatalf("Recover failed: %v", err)
+		}
+
+		if !fileExists(sealedName(id)) {
+			t.Errorf("Expected data.txt to be sealed as %s", sealedName(id))
+		}
+		if fileExists("data.txt") {
+			t.Error("Expected data.txt to be renamed")
+		}
+	})
+}
@@ -0,0 +1,278 @@
+package bitcask
+
+import (
+	"errors"
+	"maps"
+	"strings"
+	"sync"
+
+	"github.com/pro0o/deslocado/types"
+)
+
+var ErrNotOrdered = errors.New("keyDir has no ordered index")
+
+// KeyDir maps every live key to its latest record. writers & background
+// merges share it, a merge only moves a key with CompareAndSwap so a write
+// that lands while the merge runs always wins.
+// an ordered keyDir also keeps its keys in a skiplist for range scans.
+type KeyDir struct {
+	mu      sync.RWMutex
+	entries map[string]types.FileOffset
+	counts  map[string]int
+	ordered *skiplist
+}
+
+// NewKeyDir takes ownership of entries, nil starts empty.
+func NewKeyDir(entries map[string]types.FileOffset) *KeyDir {
+	if entries == nil {
+		entries = make(map[string]types.FileOffset)
+	}
+	k := &KeyDir{entries: entries, counts: make(map[string]int)}
+	for key := range entries {
+		bucket, _ := SplitBucketKey(key)
+		k.counts[bucket]++
+	}
+	return k
+}
+
+// BucketKey is how the keyDir, hints & merges tell buckets apart: the
+// default bucket's keys stand for themselves, a named bucket's key is
+// \x00 bucket \x00 key. default keys can't start with \x00 & bucket names
+// can't hold one.
+func BucketKey(bucket string, key []byte) string {
+	if bucket == "" {
+		return string(key)
+	}
+	return "\x00" + bucket + "\x00" + string(key)
+}
+
+func SplitBucketKey(k string) (string, string) {
+	if len(k) == 0 || k[0] != 0 {
+		return "", k
+	}
+	bucket, key, _ := strings.Cut(k[1:], "\x00")
+	return bucket, key
+}
+
+// NewOrderedKeyDir is NewKeyDir plus the index Range needs.
+func NewOrderedKeyDir(entries map[string]types.FileOffset) *KeyDir {
+	k := NewKeyDir(entries)
+	k.ordered = newSkiplist()
+	for key := range k.entries {
+		k.ordered.insert(key)
+	}
+	return k
+}
+
+func (k *KeyDir) Ordered() bool {
+	return k.ordered != nil
+}
+
+// map & index change together, mu held.
+func (k *KeyDir) set(key string, loc types.FileOffset) {
+	if _, ok := k.entries[key]; !ok {
+		bucket, _ := SplitBucketKey(key)
+		k.counts[bucket]++
+		if k.ordered != nil {
+			k.ordered.insert(key)
+		}
+	}
+	k.entries[key] = loc
+}
+
+func (k *KeyDir) drop(key string) {
+	if _, ok := k.entries[key]; !ok {
+		return
+	}
+	bucket, _ := SplitBucketKey(key)
+	if k.counts[bucket]--; k.counts[bucket] == 0 {
+		delete(k.counts, bucket)
+	}
+	delete(k.entries, key)
+	if k.ordered != nil {
+		k.ordered.remove(key)
+	}
+}
+
+func (k *KeyDir) Get(key string) (types.FileOffset, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	loc, ok := k.entries[key]
+	return loc, ok
+}
+
+func (k *KeyDir) Put(key string, loc types.FileOffset) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.set(key, loc)
+}
+
+func (k *KeyDir) Delete(key string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.drop(key)
+}
+
+func (k *KeyDir) Len() int {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return len(k.entries)
+}
+
+// Count is how many keys bucket holds, expired ones not yet merged away
+// included.
+func (k *KeyDir) Count(bucket string) int {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.counts[bucket]
+}
+
+// DropBucket forgets every key of bucket, returns how many there were.
+func (k *KeyDir) DropBucket(bucket string) int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	n := k.counts[bucket]
+	for key := range k.entries {
+		if b, _ := SplitBucketKey(key); b == bucket {
+			k.drop(key)
+		}
+	}
+	return n
+}
+
+// CompareAndSwap points key at new only if it still points at old.
+func (k *KeyDir) CompareAndSwap(key string, old, new types.FileOffset) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if cur, ok := k.entries[key]; !ok || cur != old {
+		return false
+	}
+	k.entries[key] = new
+	return true
+}
+
+// CompareAndDelete drops key only if it still points at old.
+func (k *KeyDir) CompareAndDelete(key string, old types.FileOffset) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if cur, ok := k.entries[key]; !ok || cur != old {
+		return false
+	}
+	k.drop(key)
+	return true
+}
+
+// Snapshot copies the current entries, later changes don't show up in it.
+func (k *KeyDir) Snapshot() map[string]types.FileOffset {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return maps.Clone(k.entries)
+}
+
+// a key some merge or rotation moved. dropped keys (expired in the merge)
+// have no new location.
+type relocation struct {
+	key     string
+	from    types.FileOffset
+	to      int64
+	dropped bool
+}
+
+// moves keys still at their old location into file, a key written or deleted
+// since keeps what it has. returns how many moved & how many were skipped.
+func (k *KeyDir) reconcile(file string, moves []relocation) (int, int) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	var moved, skipped int
+	for _, m := range moves {
+		if cur, ok := k.entries[m.key]; !ok || cur != m.from {
+			skipped++
+			continue
+		}
+		if m.dropped {
+			k.drop(m.key)
+		} else {
+			k.entries[m.key] = types.FileOffset{FileID: file, Offset: m.to, Expiry: m.from.Expiry}
+		}
+		moved++
+	}
+	return moved, skipped
+}
+
+// KeyRange bounds an ordered scan to Start <= key < End, nil leaves a side
+// open. Cursor is the last key of the previous page, the scan resumes right
+// past it in the scan's direction. Limit 0 means no limit.
+type KeyRange struct {
+	Start   []byte
+	End     []byte
+	Reverse bool
+	Limit   int
+	Cursor  []byte
+}
+
+// PrefixRange covers every key starting with prefix.
+func PrefixRange(prefix []byte) KeyRange {
+	return KeyRange{Start: prefix, End: prefixEnd(prefix)}
+}
+
+// the first key past every key with prefix, nil if there is none.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// RangeEntry is a key & its location as a range scan found them.
+type RangeEntry struct {
+	Key string
+	Loc types.FileOffset
+}
+
+// Range returns one page of r & the cursor for the next one, nil once the
+// range is exhausted.
+func (k *KeyDir) Range(r KeyRange) ([]RangeEntry, []byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if k.ordered == nil {
+		return nil, nil, ErrNotOrdered
+	}
+
+	var node *skipNode
+	switch {
+	case r.Reverse && r.Cursor != nil:
+		node = k.ordered.seekLT(r.Cursor)
+	case r.Reverse:
+		node = k.ordered.seekLT(r.End)
+	case r.Cursor != nil:
+		// just past the cursor.
+		node = k.ordered.seekGE(string(r.Cursor) + "\x00")
+	default:
+		node = k.ordered.seekGE(string(r.Start))
+	}
+
+	var page []RangeEntry
+	for node != nil {
+		if r.Reverse && r.Start != nil && node.key < string(r.Start) {
+			break
+		}
+		if !r.Reverse && r.End != nil && node.key >= string(r.End) {
+			break
+		}
+		if r.Limit > 0 && len(page) == r.Limit {
+			return page, []byte(page[len(page)-1].Key), nil
+		}
+		page = append(page, RangeEntry{Key: node.key, Loc: k.entries[node.key]})
+		if r.Reverse {
+			node = node.prev
+		} else {
+			node = node.next[0]
+		}
+	}
+	return page, nil, nil
+}
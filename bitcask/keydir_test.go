@@ -0,0 +1,205 @@
+package bitcask
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/pro0o/deslocado/types"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func TestKeyDirCompareAndSwap(t *testing.T) {
+	old := types.FileOffset{FileID: "data_000001.log", Offset: 10}
+	merged := types.FileOffset{FileID: "data_compacted_000002.log", Offset: 0}
+	newer := types.FileOffset{FileID: "data.txt", Offset: 40}
+
+	keyDir := NewKeyDir(map[string]types.FileOffset{"a": old, "b": newer})
+	if !keyDir.CompareAndSwap("a", old, merged) {
+		t.Error("Expected a to move to the merged location")
+	}
+	if keyDir.CompareAndSwap("b", old, merged) {
+		t.Error("Expected b to keep its newer location")
+	}
+	if keyDir.CompareAndSwap("missing", old, merged) {
+		t.Error("Expected a deleted key to stay deleted")
+	}
+	if keyDir.CompareAndDelete("b", old) {
+		t.Error("Expected b to survive a delete of a stale location")
+	}
+
+	if loc, _ := keyDir.Get("a"); loc != merged {
+		t.Errorf("Expected a at %+v, got %+v", merged, loc)
+	}
+	if loc, _ := keyDir.Get("b"); loc != newer {
+		t.Errorf("Expected b at %+v, got %+v", newer, loc)
+	}
+	if _, ok := keyDir.Get("missing"); ok || keyDir.Len() != 2 {
+		t.Errorf("Expected only a & b, got %v", keyDir.Snapshot())
+	}
+}
+
+func TestRotatorKeepsWritesDuringMerge(t *testing.T) {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	tempDir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(tempDir)
+	defer os.Chdir(oldDir)
+
+	active, err := OpenActive()
+	if err != nil {
+		t.Fatalf("OpenActive failed: %v", err)
+	}
+	keyDir := NewKeyDir(nil)
+	put := func(key string) {
+		at, err := active.Put([]byte(key), []byte("value_"+key))
+		if err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		keyDir.Put(key, at)
+	}
+
+	// two rotations below the threshold, the third one merges.
+	for _, keys := range [][]string{{"a", "b", "c"}, {"d"}} {
+		for _, key := range keys {
+			put(key)
+		}
+		if active, err = Rotator(context.Background(), active, keyDir, nil); err != nil {
+			t.Fatalf("Rotator failed: %v", err)
+		}
+	}
+	put("e")
+
+	// a write & a delete that land while the merge runs.
+	written := types.FileOffset{FileID: activeFile, Offset: 999}
+	raced := false
+	active, err = Rotator(context.Background(), active, keyDir, func(MergeProgress) {
+		if !raced {
+			keyDir.Put("a", written)
+			keyDir.Delete("b")
+			raced = true
+		}
+	})
+	if err != nil {
+		t.Fatalf("Rotator failed: %v", err)
+	}
+	defer active.Close()
+
+	if loc, _ := keyDir.Get("a"); loc != written {
+		t.Errorf("Expected the write during the merge to win, got %+v", loc)
+	}
+	if _, ok := keyDir.Get("b"); ok {
+		t.Error("Expected the delete during the merge to stick")
+	}
+
+	cold, err := BuildKeyDir()
+	if err != nil {
+		t.Fatalf("BuildKeyDir failed: %v", err)
+	}
+	for _, key := range []string{"c", "d", "e"} {
+		loc, _ := keyDir.Get(key)
+		if loc != cold[key] {
+			t.Errorf("Key %q: expected %+v like a cold start, got %+v", key, cold[key], loc)
+		}
+	}
+	if loc, _ := keyDir.Get("c"); loc.FileID != compactedName(4) {
+		t.Errorf("Expected c in %s, got %+v", compactedName(4), loc)
+	}
+}
+
+func TestKeyDirRange(t *testing.T) {
+	keyDir := NewOrderedKeyDir(map[string]types.FileOffset{"b": {}, "d": {}})
+	reference := map[string]bool{"b": true, "d": true}
+	for i := range 500 {
+		key := fmt.Sprintf("k%03d", (i*37)%200)
+		if i%3 == 0 {
+			keyDir.Delete(key)
+			delete(reference, key)
+		} else {
+			keyDir.Put(key, types.FileOffset{Offset: int64(i)})
+			reference[key] = true
+		}
+	}
+	var sorted []string
+	for key := range reference {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	collect := func(r KeyRange) []string {
+		var keys []string
+		for {
+			page, next, err := keyDir.Range(r)
+			if err != nil {
+				t.Fatalf("Range failed: %v", err)
+			}
+			if r.Limit > 0 && len(page) > r.Limit {
+				t.Fatalf("Page of %d over limit %d", len(page), r.Limit)
+			}
+			for _, entry := range page {
+				keys = append(keys, entry.Key)
+			}
+			if next == nil {
+				return keys
+			}
+			r.Cursor = next
+		}
+	}
+
+	if got := collect(KeyRange{Limit: 7}); !slices.Equal(got, sorted) {
+		t.Errorf("Forward pages: expected %v, got %v", sorted, got)
+	}
+	reversed := slices.Clone(sorted)
+	slices.Reverse(reversed)
+	if got := collect(KeyRange{Reverse: true, Limit: 7}); !slices.Equal(got, reversed) {
+		t.Errorf("Reverse pages: expected %v, got %v", reversed, got)
+	}
+
+	var bounded []string
+	for _, key := range sorted {
+		if key >= "k050" && key < "k100" {
+			bounded = append(bounded, key)
+		}
+	}
+	if got := collect(KeyRange{Start: []byte("k050"), End: []byte("k100"), Limit: 4}); !slices.Equal(got, bounded) {
+		t.Errorf("Bounded: expected %v, got %v", bounded, got)
+	}
+	slices.Reverse(bounded)
+	if got := collect(KeyRange{Start: []byte("k050"), End: []byte("k100"), Reverse: true, Limit: 4}); !slices.Equal(got, bounded) {
+		t.Errorf("Bounded reverse: expected %v, got %v", bounded, got)
+	}
+
+	var prefixed []string
+	for _, key := range sorted {
+		if strings.HasPrefix(key, "k1") {
+			prefixed = append(prefixed, key)
+		}
+	}
+	if got := collect(PrefixRange([]byte("k1"))); !slices.Equal(got, prefixed) {
+		t.Errorf("Prefix: expected %v, got %v", prefixed, got)
+	}
+
+	if _, _, err := NewKeyDir(nil).Range(KeyRange{}); !errors.Is(err, ErrNotOrdered) {
+		t.Errorf("Expected ErrNotOrdered, got %v", err)
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	cases := map[string][]byte{
+		"user:": []byte("user;"),
+		"a\xff": []byte("b"),
+		"\xff":  nil,
+	}
+	for prefix, want := range cases {
+		if got := prefixEnd([]byte(prefix)); !bytes.Equal(got, want) {
+			t.Errorf("prefixEnd(%q): expected %q, got %q", prefix, want, got)
+		}
+	}
+}
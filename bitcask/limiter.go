@@ -0,0 +1,127 @@
+package bitcask
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket over bytes, refilled at rate bytes/sec with
+// at most a second worth of burst. a rate <= 0 means unlimited.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(bytesPerSec int64) *RateLimiter {
+	return &RateLimiter{rate: bytesPerSec, last: time.Now()}
+}
+
+// SetRate takes effect right away, even for callers already waiting.
+func (l *RateLimiter) SetRate(bytesPerSec int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	l.rate = bytesPerSec
+	if l.rate > 0 {
+		l.tokens = min(l.tokens, float64(l.rate))
+	}
+}
+
+func (l *RateLimiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+func (l *RateLimiter) refill(now time.Time) {
+	if l.rate > 0 {
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+		l.tokens = min(l.tokens, float64(l.rate))
+	}
+	l.last = now
+}
+
+// max time spent asleep before looking at the rate again.
+const limiterRecheck = 50 * time.Millisecond
+
+// blocks until n bytes fit in the budget or ctx is done.
+func (l *RateLimiter) wait(ctx context.Context, n int) error {
+	remaining := float64(n)
+	for remaining > 0 {
+		l.mu.Lock()
+		if l.rate <= 0 {
+			l.mu.Unlock()
+			return nil
+		}
+		l.refill(time.Now())
+
+		// never ask for more than a full bucket at once.
+		take := min(remaining, float64(l.rate))
+		if l.tokens >= take {
+			l.tokens -= take
+			remaining -= take
+			l.mu.Unlock()
+			continue
+		}
+		need := time.Duration((take - l.tokens) / float64(l.rate) * float64(time.Second))
+		l.mu.Unlock()
+
+		timer := time.NewTimer(min(need, limiterRecheck))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return nil
+}
+
+// merge reads & writes share one budget.
+var mergeLimiter = NewRateLimiter(0)
+
+// SetMergeRate caps merge I/O (reads + writes) at bytesPerSec.
+// <= 0 lifts the cap. safe to call while a merge is running.
+func SetMergeRate(bytesPerSec int64) {
+	mergeLimiter.SetRate(bytesPerSec)
+}
+
+func MergeRate() int64 {
+	return mergeLimiter.Rate()
+}
+
+type throttledReader struct {
+	ctx   context.Context
+	r     io.Reader
+	l     *RateLimiter
+	count *int64
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	*t.count += int64(n)
+	if werr := t.l.wait(t.ctx, n); werr != nil {
+		return n, werr
+	}
+	return n, err
+}
+
+type throttledWriter struct {
+	ctx   context.Context
+	w     io.Writer
+	l     *RateLimiter
+	count *int64
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	if err := t.l.wait(t.ctx, len(p)); err != nil {
+		return 0, err
+	}
+	n, err := t.w.Write(p)
+	*t.count += int64(n)
+	return n, err
+}
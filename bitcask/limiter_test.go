@@ -0,0 +1,90 @@
+package bitcask
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	limiter := NewRateLimiter(0)
+	start := time.Now()
+	limiter.wait(context.Background(), 1<<30)
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("Expected unlimited wait to return at once, took %v", elapsed)
+	}
+}
+
+func TestRateLimiterThrottles(t *testing.T) {
+	limiter := NewRateLimiter(20000)
+	start := time.Now()
+	limiter.wait(context.Background(), 10000)
+	elapsed := time.Since(start)
+	if elapsed < 400*time.Millisecond {
+		t.Errorf("Expected ~500ms for 10000 bytes at 20000 B/s, took %v", elapsed)
+	}
+	if elapsed > 2*time.Second {
+		t.Errorf("Throttled far more than expected, took %v", elapsed)
+	}
+}
+
+func TestRateLimiterSetRateWhileWaiting(t *testing.T) {
+	limiter := NewRateLimiter(1)
+	done := make(chan struct{})
+	go func() {
+		limiter.wait(context.Background(), 1<<20)
+		close(done)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	limiter.SetRate(0)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected lifting the rate to release the waiter")
+	}
+}
+
+func TestMergeThrottled(t *testing.T) {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	tempDir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(tempDir)
+	defer os.Chdir(oldDir)
+	defer SetMergeRate(0)
+
+	entries := make([]testEntry, 0, 100)
+	for i := range 100 {
+		entries = append(entries, testEntry{key: string(rune('a'+i%26)) + string(rune('0'+i/26)), value: make([]byte, 90)})
+	}
+	logPath := "data_1.log"
+	if err := createTestLogFile(logPath, entries); err != nil {
+		t.Fatalf("Failed to create test log file: %v", err)
+	}
+
+	// ~10KB read + ~10KB written at 40KB/s.
+	SetMergeRate(40000)
+
+	start := time.Now()
+	if _, err := Merger(context.Background(), logMetas(logPath), nil, nil); err != nil {
+		t.Fatalf("Merger failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("Expected throttled merge to take ~500ms, took %v", elapsed)
+	}
+}
+
+func TestRateLimiterCancelled(t *testing.T) {
+	limiter := NewRateLimiter(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if err := limiter.wait(ctx, 1<<20); err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+}
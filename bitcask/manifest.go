@@ -0,0 +1,323 @@
+package bitcask
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	manifestFile  = "MANIFEST"
+	manifestMagic = uint32(0x44534d34) // "DSM4"
+)
+
+// older MANIFESTs come with data files in an older format & there's no
+// migration: DSMF stores have no seqs in their records & hints, DSM2 ones
+// don't reserve the id data.txt's records name & DSM3 merge output has no
+// footer checksum.
+var oldManifestMagics = map[uint32]string{
+	0x44534d46: "DSMF",
+	0x44534d32: "DSM2",
+	0x44534d33: "DSM3",
+}
+
+// ErrIncompatibleStore is a store written in an on-disk format this
+// version can't read. there's no migration, its data has to be exported &
+// written again.
+var ErrIncompatibleStore = errors.New("incompatible store format")
+
+// FileMeta is a single live immutable tracked by the MANIFEST.
+// Generation is 0 for a file sealed off the active file and grows by one
+// each time the file is rewritten by a merge.
+type FileMeta struct {
+	ID         uint64
+	Generation uint32
+	Data       string
+	Hint       string
+}
+
+// Manifest lists every live immutable oldest -> newest. It's the only
+// source of truth for file ordering, names don't mean anything.
+type Manifest struct {
+	NextID uint64
+	Files  []FileMeta
+	// LastSeq is the newest record sealed so far, data.txt carries on
+	// from it. CompactedSeq is the newest record a merge took in, records
+	// up to it may be gone.
+	LastSeq      uint64
+	CompactedSeq uint64
+	// ActiveID is the id data.txt gets sealed under, its records name that
+	// file from the start. 0 until the first rotation, then NextID is it.
+	ActiveID uint64
+
+	// false when there's no MANIFEST on disk yet, a fresh store.
+	onDisk bool
+	// the family's dir, names in Files already include it. "" is the
+	// store dir.
+	dir string
+}
+
+func (m *Manifest) syncDir() error {
+	if m.dir == "" {
+		return syncDir(".")
+	}
+	return syncDir(m.dir)
+}
+
+func sealedName(id uint64) string {
+	return fmt.Sprintf("data_%06d.log", id)
+}
+
+func compactedName(id uint64) string {
+	return fmt.Sprintf("data_compacted_%06d.log", id)
+}
+
+// data_000007.log -> data_000007.hint
+func hintName(data string) string {
+	return strings.TrimSuffix(data, ".log") + ".hint"
+}
+
+func (m *Manifest) allocID() uint64 {
+	id := m.NextID
+	m.NextID++
+	return id
+}
+
+func (m *Manifest) activeID() uint64 {
+	if m.ActiveID != 0 {
+		return m.ActiveID
+	}
+	return m.NextID
+}
+
+// data paths oldest -> newest, the order Merger expects.
+func (m *Manifest) logs() []string {
+	logs := make([]string, 0, len(m.Files))
+	for _, meta := range m.Files {
+		logs = append(logs, meta.Data)
+	}
+	return logs
+}
+
+func (m *Manifest) referenced() map[string]bool {
+	refs := make(map[string]bool, 2*len(m.Files))
+	for _, meta := range m.Files {
+		refs[meta.Data] = true
+		if meta.Hint != "" {
+			refs[meta.Hint] = true
+		}
+	}
+	return refs
+}
+
+// swap a contiguous run of merged inputs for their output, which takes the
+// run's place in the ordering.
+func (m *Manifest) replace(inputs []string, out FileMeta) error {
+	if len(inputs) == 0 {
+		return fmt.Errorf("replace: no inputs")
+	}
+	start := -1
+	for i, meta := range m.Files {
+		if meta.Data == inputs[0] {
+			start = i
+			break
+		}
+	}
+	if start < 0 || start+len(inputs) > len(m.Files) {
+		return fmt.Errorf("replace: %s is not a live file", inputs[0])
+	}
+	for i, input := range inputs {
+		meta := m.Files[start+i]
+		if meta.Data != input {
+			return fmt.Errorf("replace: inputs are not a contiguous run at %s", input)
+		}
+		out.Generation = max(out.Generation, meta.Generation+1)
+	}
+
+	files := make([]FileMeta, 0, len(m.Files)-len(inputs)+1)
+	files = append(files, m.Files[:start]...)
+	files = append(files, out)
+	files = append(files, m.Files[start+len(inputs):]...)
+	m.Files = files
+	return nil
+}
+
+// magic | nextID | lastSeq | compactedSeq | activeID | count | entries... | crc32
+// entry: id | generation | dataLen | data | hintLen | hint
+func (m *Manifest) encode() ([]byte, error) {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, manifestMagic)
+	binary.Write(&buf, binary.BigEndian, m.NextID)
+	binary.Write(&buf, binary.BigEndian, m.LastSeq)
+	binary.Write(&buf, binary.BigEndian, m.CompactedSeq)
+	binary.Write(&buf, binary.BigEndian, m.ActiveID)
+	binary.Write(&buf, binary.BigEndian, uint32(len(m.Files)))
+	for _, meta := range m.Files {
+		if len(meta.Data) > 0xffff || len(meta.Hint) > 0xffff {
+			return nil, fmt.Errorf("file name too long in manifest entry %d", meta.ID)
+		}
+		binary.Write(&buf, binary.BigEndian, meta.ID)
+		binary.Write(&buf, binary.BigEndian, meta.Generation)
+		binary.Write(&buf, binary.BigEndian, uint16(len(meta.Data)))
+		buf.WriteString(meta.Data)
+		binary.Write(&buf, binary.BigEndian, uint16(len(meta.Hint)))
+		buf.WriteString(meta.Hint)
+	}
+	binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(buf.Bytes()))
+	return buf.Bytes(), nil
+}
+
+func decodeManifest(raw []byte) (*Manifest, error) {
+	if len(raw) < 4 {
+		return nil, fmt.Errorf("manifest truncated")
+	}
+	body, sum := raw[:len(raw)-4], binary.BigEndian.Uint32(raw[len(raw)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return nil, fmt.Errorf("manifest checksum mismatch")
+	}
+
+	reader := bytes.NewReader(body)
+	var magic, count uint32
+	m := &Manifest{onDisk: true}
+	if err := binary.Read(reader, binary.BigEndian, &magic); err != nil {
+		return nil, fmt.Errorf("read manifest magic: %w", err)
+	}
+	if name, ok := oldManifestMagics[magic]; ok {
+		return nil, fmt.Errorf("%s manifest: %w", name, ErrIncompatibleStore)
+	}
+	if magic != manifestMagic {
+		return nil, fmt.Errorf("bad manifest magic %#x", magic)
+	}
+	if err := binary.Read(reader, binary.BigEndian, &m.NextID); err != nil {
+		return nil, fmt.Errorf("read manifest next id: %w", err)
+	}
+	if err := binary.Read(reader, binary.BigEndian, &m.LastSeq); err != nil {
+		return nil, fmt.Errorf("read manifest last seq: %w", err)
+	}
+	if err := binary.Read(reader, binary.BigEndian, &m.CompactedSeq); err != nil {
+		return nil, fmt.Errorf("read manifest compacted seq: %w", err)
+	}
+	if err := binary.Read(reader, binary.BigEndian, &m.ActiveID); err != nil {
+		return nil, fmt.Errorf("read manifest active id: %w", err)
+	}
+	if err := binary.Read(reader, binary.BigEndian, &count); err != nil {
+		return nil, fmt.Errorf("read manifest count: %w", err)
+	}
+
+	readName := func() (string, error) {
+		var n uint16
+		if err := binary.Read(reader, binary.BigEndian, &n); err != nil {
+			return "", err
+		}
+		name := make([]byte, n)
+		if _, err := io.ReadFull(reader, name); err != nil {
+			return "", err
+		}
+		return string(name), nil
+	}
+
+	for range count {
+		var meta FileMeta
+		var err error
+		if err = binary.Read(reader, binary.BigEndian, &meta.ID); err != nil {
+			return nil, fmt.Errorf("read manifest entry: %w", err)
+		}
+		if err = binary.Read(reader, binary.BigEndian, &meta.Generation); err != nil {
+			return nil, fmt.Errorf("read manifest entry %d: %w", meta.ID, err)
+		}
+		if meta.Data, err = readName(); err != nil {
+			return nil, fmt.Errorf("read manifest entry %d: %w", meta.ID, err)
+		}
+		if meta.Hint, err = readName(); err != nil {
+			return nil, fmt.Errorf("read manifest entry %d: %w", meta.ID, err)
+		}
+		m.Files = append(m.Files, meta)
+	}
+	return m, nil
+}
+
+// MANIFEST.tmp -> fsync -> MANIFEST -> fsync dir
+func (m *Manifest) save() error {
+	raw, err := m.encode()
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(m.dir, manifestFile+".tmp")
+	file, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("create manifest: %w", err)
+	}
+	if _, err := file.Write(raw); err != nil {
+		file.Close()
+		return fmt.Errorf("write manifest: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("sync manifest: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("close manifest: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(m.dir, manifestFile)); err != nil {
+		return fmt.Errorf("install manifest: %w", err)
+	}
+	if err := m.syncDir(); err != nil {
+		return err
+	}
+	m.onDisk = true
+	return nil
+}
+
+// LoadManifest reads the default family's MANIFEST.
+func LoadManifest() (*Manifest, error) {
+	return Family{}.LoadManifest()
+}
+
+// LoadManifest reads the MANIFEST. a fresh store has none until OpenActive
+// writes it, data files without one are from before the MANIFEST & their
+// records can't be read: ErrIncompatibleStore.
+func (f Family) LoadManifest() (*Manifest, error) {
+	raw, err := os.ReadFile(f.path(manifestFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		if err := f.checkFresh(); err != nil {
+			return nil, err
+		}
+		return &Manifest{NextID: 1, dir: f.dir()}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read manifest: %w", err)
+	}
+	m, err := decodeManifest(raw)
+	if err != nil {
+		return nil, err
+	}
+	m.dir = f.dir()
+	return m, nil
+}
+
+// a store without a MANIFEST has to be empty, sealed logs or records in
+// data.txt mean it was written by a version before it.
+func (f Family) checkFresh() error {
+	logs, err := filepath.Glob(f.path("data_*.log"))
+	if err != nil {
+		return fmt.Errorf("glob logs: %w", err)
+	}
+	if len(logs) > 0 {
+		return fmt.Errorf("%s without a MANIFEST: %w", logs[0], ErrIncompatibleStore)
+	}
+	info, err := os.Stat(f.path(activeFile))
+	if err == nil && info.Size() > 0 {
+		return fmt.Errorf("%s without a MANIFEST: %w", f.path(activeFile), ErrIncompatibleStore)
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package bitcask
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"testing"
+
+	"github.com/pro0o/deslocado/types"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func TestManifestRoundTrip(t *testing.T) {
+	tempDir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(tempDir)
+	defer os.Chdir(oldDir)
+
+	manifest := &Manifest{NextID: 1, LastSeq: 42, CompactedSeq: 17}
+	for range 3 {
+		id := manifest.allocID()
+		manifest.Files = append(manifest.Files, FileMeta{ID: id, Data: sealedName(id), Hint: hintName(sealedName(id))})
+	}
+	manifest.Files[1].Generation = 2
+	if err := manifest.save(); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+
+	loaded, err := LoadManifest()
+	if err != nil {
+		t.Fatalf("LoadManifest failed: %v", err)
+	}
+	if loaded.NextID != manifest.NextID {
+		t.Errorf("Expected NextID %d, got %d", manifest.NextID, loaded.NextID)
+	}
+	if loaded.LastSeq != 42 || loaded.CompactedSeq != 17 {
+		t.Errorf("Expected seqs 42 & 17, got %d & %d", loaded.LastSeq, loaded.CompactedSeq)
+	}
+	if len(loaded.Files) != len(manifest.Files) {
+		t.Fatalf("Expected %d files, got %d", len(manifest.Files), len(loaded.Files))
+	}
+	for i, meta := range manifest.Files {
+		if loaded.Files[i] != meta {
+			t.Errorf("File %d: expected %+v, got %+v", i, meta, loaded.Files[i])
+		}
+	}
+
+	raw, _ := os.ReadFile(manifestFile)
+	raw[len(raw)/2] ^= 0xff
+	os.WriteFile(manifestFile, raw, 0644)
+	if _, err := LoadManifest(); err == nil {
+		t.Error("Expected error for corrupted manifest")
+	}
+}
+
+func TestPreManifestStoreRefused(t *testing.T) {
+	tempDir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(tempDir)
+	defer os.Chdir(oldDir)
+
+	// a fresh store gets its MANIFEST on the first open.
+	active, err := OpenActive()
+	if err != nil {
+		t.Fatalf("OpenActive failed: %v", err)
+	}
+	active.Close()
+	if !fileExists(manifestFile) {
+		t.Fatal("Expected OpenActive to write the MANIFEST")
+	}
+
+	// records in data.txt or sealed logs with no MANIFEST are older than it.
+	for _, path := range []string{activeFile, "data_1700000000.log"} {
+		os.Remove(manifestFile)
+		os.Remove(activeFile)
+		os.WriteFile(path, []byte{0, 0, 0, 0, 1, 0, 0, 0, 1, 'k', 'v'}, 0644)
+		if _, err := OpenActive(); !errors.Is(err, ErrIncompatibleStore) {
+			t.Errorf("%s without a MANIFEST: expected ErrIncompatibleStore, got %v", path, err)
+		}
+		os.Remove(path)
+	}
+}
+
+func TestOldManifestRefused(t *testing.T) {
+	tempDir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(tempDir)
+	defer os.Chdir(oldDir)
+
+	for magic := range oldManifestMagics {
+		// magic | nextID | count, checksummed.
+		raw := binary.BigEndian.AppendUint32(nil, magic)
+		raw = binary.BigEndian.AppendUint64(raw, 1)
+		raw = binary.BigEndian.AppendUint32(raw, 0)
+		raw = binary.BigEndian.AppendUint32(raw, crc32.ChecksumIEEE(raw))
+		os.WriteFile(manifestFile, raw, 0644)
+		if _, err := LoadManifest(); !errors.Is(err, ErrIncompatibleStore) {
+			t.Errorf("Magic %#x: expected ErrIncompatibleStore, got %v", magic, err)
+		}
+	}
+}
+
+func TestManifestReplace(t *testing.T) {
+	manifest := &Manifest{NextID: 1}
+	for range 4 {
+		id := manifest.allocID()
+		manifest.Files = append(manifest.Files, FileMeta{ID: id, Data: sealedName(id)})
+	}
+	manifest.Files[2].Generation = 1
+
+	out := FileMeta{ID: manifest.allocID(), Data: "out.log"}
+	if err := manifest.replace([]string{sealedName(2), sealedName(3)}, out); err != nil {
+		t.Fatalf("replace failed: %v", err)
+	}
+
+	expected := []string{sealedName(1), "out.log", sealedName(4)}
+	logs := manifest.logs()
+	if len(logs) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, logs)
+	}
+	for i := range expected {
+		if logs[i] != expected[i] {
+			t.Errorf("Position %d: expected %s, got %s", i, expected[i], logs[i])
+		}
+	}
+	if manifest.Files[1].Generation != 2 {
+		t.Errorf("Expected generation 2, got %d", manifest.Files[1].Generation)
+	}
+
+	if err := manifest.replace([]string{sealedName(1), sealedName(4)}, out); err == nil {
+		t.Error("Expected error for non contiguous inputs")
+	}
+}
+
+func rotateWith(t *testing.T, entries []testEntry) {
+	if err := createDataFile("data.txt", entries); err != nil {
+		t.Fatalf("Failed to create data.txt: %v", err)
+	}
+	active, err := OpenActive()
+	if err != nil {
+		t.Fatalf("Failed to open data.txt: %v", err)
+	}
+	if _, err := Rotator(context.Background(), active, createMockKeyDir(entries), nil); err != nil {
+		t.Fatalf("Rotator failed: %v", err)
+	}
+}
+
+func TestRotationsInSameSecond(t *testing.T) {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	tempDir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(tempDir)
+	defer os.Chdir(oldDir)
+
+	for i := range MAX_IMMUTABLES - 1 {
+		rotateWith(t, []testEntry{
+			{flag: byte(types.FlagNormal), key: "key", value: []byte{byte('a' + i)}},
+		})
+	}
+
+	manifest, err := LoadManifest()
+	if err != nil {
+		t.Fatalf("LoadManifest failed: %v", err)
+	}
+	if len(manifest.Files) != MAX_IMMUTABLES-1 {
+		t.Fatalf("Expected %d immutables, got %d", MAX_IMMUTABLES-1, len(manifest.Files))
+	}
+	for _, meta := range manifest.Files {
+		if !fileExists(meta.Data) {
+			t.Errorf("Expected %s to exist", meta.Data)
+		}
+	}
+}
+
+func TestMergeKeepsNewestByManifestOrder(t *testing.T) {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	tempDir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(tempDir)
+	defer os.Chdir(oldDir)
+
+	for i := range MAX_IMMUTABLES {
+		rotateWith(t, []testEntry{
+			{flag: byte(types.FlagNormal), key: "key", value: []byte{byte('a' + i)}},
+		})
+	}
+
+	keyDir, err := BuildKeyDir()
+	if err != nil {
+		t.Fatalf("BuildKeyDir failed: %v", err)
+	}
+	actual, err := readCompactedFile(keyDir["key"].FileID)
+	if err != nil {
+		t.Fatalf("Failed to read compacted file: %v", err)
+	}
+	expected := string(rune('a' + MAX_IMMUTABLES - 1))
+	if string(actual["key"]) != expected {
+		t.Errorf("Expected newest value %q, got %q", expected, actual["key"])
+	}
+}
@@ -2,113 +2,461 @@ package bitcask
 
 import (
 	"bufio"
-	"encoding/binary"
+	"context"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"sort"
+	"time"
 
 	"github.com/pro0o/deslocado/types"
 	"github.com/rs/zerolog/log"
 )
 
-func processImmutable(logPath string, fresh map[string]types.KeyState) (map[string]types.KeyState, error) {
+// MergeProgress is a snapshot of a running merge. KeysKept counts values &
+// retained tombstones, KeysDropped the stale versions & tombstones that won't
+// make it into the compacted file.
+type MergeProgress struct {
+	FilesDone    int
+	FilesTotal   int
+	BytesRead    int64
+	BytesWritten int64
+	KeysKept     int
+	KeysDropped  int
+	BytesPerSec  float64
+}
+
+// ProgressFunc gets called after each merged file & once the merge is done.
+type ProgressFunc func(MergeProgress)
+
+type mergeStats struct {
+	start        time.Time
+	filesDone    int
+	filesTotal   int
+	bytesRead    int64
+	bytesWritten int64
+	records      int
+	tombstones   int
+	retained     int
+	// the newest record any input holds, batch headers & drops included.
+	maxSeq   uint64
+	progress ProgressFunc
+}
+
+// effective merge I/O in bytes/sec, throttling included.
+func (s *mergeStats) throughput() float64 {
+	elapsed := time.Since(s.start).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(s.bytesRead+s.bytesWritten) / elapsed
+}
+
+func (s *mergeStats) report(fresh map[string]types.KeyState) MergeProgress {
+	kept := len(fresh) - s.tombstones + s.retained
+	p := MergeProgress{
+		FilesDone:    s.filesDone,
+		FilesTotal:   s.filesTotal,
+		BytesRead:    s.bytesRead,
+		BytesWritten: s.bytesWritten,
+		KeysKept:     kept,
+		KeysDropped:  s.records - kept,
+		BytesPerSec:  s.throughput(),
+	}
+	if s.progress != nil {
+		s.progress(p)
+	}
+	return p
+}
+
+// how many records go by between cancellation checks.
+const cancelCheckEvery = 1024
+
+// from remembers where each key's winning record sits, so the keyDir can
+// tell whether a key moved on while the merge ran. dropped holds the newest
+// drop record of every bucket, records older than it are gone.
+// fresh & from are keyed by BucketKey.
+func processImmutable(ctx context.Context, meta FileMeta, fresh map[string]types.KeyState, from map[string]types.FileOffset, dropped map[string]recordHeader, stats *mergeStats) (map[string]types.KeyState, error) {
+	logPath := meta.Data
 	file, err := os.Open(logPath)
 	if err != nil {
 		return fresh, fmt.Errorf("opening log file %s: %w", logPath, err)
 	}
 	defer file.Close()
 
-	reader := bufio.NewReader(file)
+	records, err := recordReader(file, meta.Generation > 0)
+	if err != nil {
+		return fresh, err
+	}
+	batches, err := loadBatchLog()
+	if err != nil {
+		return fresh, err
+	}
+	reader := bufio.NewReader(&throttledReader{ctx: ctx, r: records, l: mergeLimiter, count: &stats.bytesRead})
+	inFile := make(map[string]bool)
+	now := time.Now().UnixNano()
+	var offset int64
+	// records left of a batch part that never committed.
+	var skip uint32
 
 	for {
-		flag, err := reader.ReadByte()
+		if stats.records%cancelCheckEvery == 0 {
+			if err := ctx.Err(); err != nil {
+				return fresh, err
+			}
+		}
+
+		h, err := readRecordHeader(reader)
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			return fresh, fmt.Errorf("reading flag from %s: %w", logPath, err)
+			return fresh, fmt.Errorf("reading record header from %s: %w", logPath, err)
 		}
 
-		var keyLen, valLen uint32
-		if err := binary.Read(reader, binary.BigEndian, &keyLen); err != nil {
-			return fresh, fmt.Errorf("reading keyLen from %s: %w", logPath, err)
+		keyBuffer := make([]byte, h.keyLen)
+		if _, err := io.ReadFull(reader, keyBuffer); err != nil {
+			return fresh, fmt.Errorf("reading key bytes from %s: %w", logPath, err)
 		}
+		at := offset
+		offset += h.size()
+		stats.maxSeq = max(stats.maxSeq, h.seq)
 
-		if err := binary.Read(reader, binary.BigEndian, &valLen); err != nil {
-			return fresh, fmt.Errorf("reading valLen from %s: %w", logPath, err)
+		// batch headers only matter to data.txt recovery & to parts that
+		// never committed, those are dropped.
+		if h.flag == types.FlagBatch {
+			if !batches.isCommitted(familyBatchID(keyBuffer)) {
+				skip = batchCount(keyBuffer)
+			}
+			if _, err := reader.Discard(int(h.valLen)); err != nil {
+				return fresh, fmt.Errorf("skipping batch header in %s: %w", logPath, err)
+			}
+			continue
 		}
+		if skip > 0 {
+			skip--
+			if _, err := reader.Discard(int(h.valLen)); err != nil {
+				return fresh, fmt.Errorf("skipping uncommitted batch in %s: %w", logPath, err)
+			}
+			continue
+		}
+		if h.flag == types.FlagDropBucket {
+			if h.seq > dropped[h.bucket].seq {
+				dropped[h.bucket] = h
+				purgeBucket(fresh, from, h.bucket, h.seq, stats)
+			}
+			continue
+		}
+		stats.records++
 
-		keyBuffer := make([]byte, keyLen)
-		if _, err := io.ReadFull(reader, keyBuffer); err != nil {
-			return fresh, fmt.Errorf("reading key bytes from %s: %w", logPath, err)
+		// written before its bucket was dropped.
+		if h.seq < dropped[h.bucket].seq {
+			if _, err := reader.Discard(int(h.valLen)); err != nil {
+				return fresh, fmt.Errorf("discarding dropped value in %s: %w", logPath, err)
+			}
+			continue
 		}
 
 		// key -> latest
-		key := string(keyBuffer)
-		if _, seen := fresh[key]; seen {
-			if flag == byte(types.FlagNormal) && valLen > 0 {
-				if _, err := reader.Discard(int(valLen)); err != nil {
-					return fresh, fmt.Errorf("discarding stale value for key %q in %s: %w", key, logPath, err)
-				}
+		// the higher seq wins. records without one fall back on file order:
+		// a newer file already decided the key, within this file the last
+		// record wins.
+		key := BucketKey(h.bucket, keyBuffer)
+		prev, seen := fresh[key]
+		if seen && (prev.Seq > h.seq || prev.Seq == h.seq && !inFile[key]) {
+			if _, err := reader.Discard(int(h.valLen)); err != nil {
+				return fresh, fmt.Errorf("discarding stale value for key %q in %s: %w", key, logPath, err)
 			}
 			continue
 		}
+		inFile[key] = true
+		from[key] = types.FileOffset{FileID: logPath, Offset: at, Expiry: h.expiry}
+		if seen && prev.FlagTombstone {
+			stats.tombstones--
+		}
 
 		// key -> latest -> val
-		if flag == byte(types.FlagTombstone) {
-			fresh[key] = types.KeyState{Val: nil, FlagTombstone: true}
+		// an expired value is as dead as a deleted one, it merges as a
+		// tombstone so older values of the key stay hidden.
+		if h.flag == types.FlagTombstone || h.expired(now) {
+			if _, err := reader.Discard(int(h.valLen)); err != nil {
+				return fresh, fmt.Errorf("discarding expired value for key %q in %s: %w", key, logPath, err)
+			}
+			// Expiry marks a value that expired rather than a delete.
+			fresh[key] = types.KeyState{Val: nil, FlagTombstone: true, Timestamp: h.ts, Seq: h.seq, Expiry: h.expiry}
+			stats.tombstones++
 		} else {
-			valBuffer := make([]byte, valLen)
+			valBuffer := make([]byte, h.valLen)
 			if _, err := io.ReadFull(reader, valBuffer); err != nil {
 				return fresh, fmt.Errorf("reading value bytes for key %q from %s: %w", key, logPath, err)
 			}
-			fresh[key] = types.KeyState{Val: valBuffer, FlagTombstone: false}
+			fresh[key] = types.KeyState{Val: valBuffer, FlagTombstone: false, Timestamp: h.ts, Seq: h.seq, Expiry: h.expiry}
 		}
 	}
 	return fresh, nil
 }
 
-// take immutables
+// forgets what bucket held before the drop at seq, the keyDir already did.
+func purgeBucket(fresh map[string]types.KeyState, from map[string]types.FileOffset, bucket string, seq uint64, stats *mergeStats) {
+	for key, keyState := range fresh {
+		if b, _ := SplitBucketKey(key); b != bucket || keyState.Seq >= seq {
+			continue
+		}
+		if keyState.FlagTombstone {
+			stats.tombstones--
+		}
+		delete(fresh, key)
+		delete(from, key)
+	}
+}
+
+// a tombstone can only be dropped once no older live file holds its key,
+// otherwise the older value comes back to life after the merge.
+// older files are only scanned for the keys of pending tombstones.
+func retainTombstones(ctx context.Context, older []FileMeta, fresh map[string]types.KeyState, stats *mergeStats) (map[string]bool, error) {
+	pending := make(map[string]bool)
+	for key, keyState := range fresh {
+		if keyState.FlagTombstone {
+			pending[key] = true
+		}
+	}
+	retained := make(map[string]bool)
+
+	for _, meta := range older {
+		if len(pending) == 0 {
+			break
+		}
+		if err := scanKeys(ctx, meta, stats, func(key string) {
+			if pending[key] {
+				delete(pending, key)
+				retained[key] = true
+			}
+		}); err != nil {
+			return nil, fmt.Errorf("scanning older log file %s: %w", meta.Data, err)
+		}
+	}
+	stats.retained = len(retained)
+	return retained, nil
+}
+
+func scanKeys(ctx context.Context, meta FileMeta, stats *mergeStats, fn func(key string)) error {
+	file, err := os.Open(meta.Data)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	records, err := recordReader(file, meta.Generation > 0)
+	if err != nil {
+		return err
+	}
+	batches, err := loadBatchLog()
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(&throttledReader{ctx: ctx, r: records, l: mergeLimiter, count: &stats.bytesRead})
+	var skip uint32
+	_, err = scanRecords(reader, func(_ int64, h recordHeader, key []byte) error {
+		switch {
+		case h.flag == types.FlagBatch:
+			if !batches.isCommitted(familyBatchID(key)) {
+				skip = batchCount(key)
+			}
+		case skip > 0:
+			skip--
+		case h.flag != types.FlagDropBucket:
+			fn(BucketKey(h.bucket, key))
+		}
+		return nil
+	})
+	return err
+}
+
+// MergeResult is what a merge leaves behind: the compacted data & its hint,
+// both fsynced temp files waiting to be installed, plus where every key
+// moved from so the keyDir can follow once they are.
+type MergeResult struct {
+	Data  string
+	Hint  string
+	moves []relocation
+	// every record up to it is in the inputs, some of them are gone now.
+	maxSeq uint64
+}
+
+// take immutables, oldest -> newest, as the MANIFEST lists them: only a
+// file with Generation > 0 is read as a sorted run.
 // process each immuatble and create a fresh immutable file.
-// append this fresh -> compacted_data.txt
-func Merger(sorted []string) error {
+// older are the live files older than sorted, they decide which tombstones
+// have to be carried over. a merge of every file passes none.
+// fresh -> merge_*.tmp data + hint in one pass (unique, fsynced), the caller
+// installs them. a cancelled ctx stops the merge & removes the temp files.
+func Merger(ctx context.Context, sorted, older []FileMeta, progress ProgressFunc) (*MergeResult, error) {
 	log.Info().Msg("Merging started!!")
 	fresh := make(map[string]types.KeyState)
+	from := make(map[string]types.FileOffset)
+	dropped := make(map[string]recordHeader)
+	stats := &mergeStats{start: time.Now(), filesTotal: len(sorted), progress: progress}
 	var err error
 
 	log.Info().Msg("Processing the Immutables!!")
 	for i := len(sorted) - 1; i >= 0; i-- {
-		logPath := sorted[i]
-		fresh, err = processImmutable(logPath, fresh)
+		logPath := sorted[i].Data
+		fresh, err = processImmutable(ctx, sorted[i], fresh, from, dropped, stats)
 		if err != nil {
-			return fmt.Errorf("merging log file %s: %w", logPath, err)
+			return nil, fmt.Errorf("merging log file %s: %w", logPath, err)
 		}
+		stats.filesDone++
+		p := stats.report(fresh)
+		log.Info().
+			Str("file", logPath).
+			Int64("bytes_read", p.BytesRead).
+			Float64("bytes_per_sec", p.BytesPerSec).
+			Msg("Immutable processed!!")
 	}
 
-	log.Info().Msg("Compacting the Immutables!!")
-	compact, err := os.OpenFile("compacted_data.txt", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	retained, err := retainTombstones(ctx, older, fresh, stats)
 	if err != nil {
-		return fmt.Errorf("opening compacted_data.txt: %w", err)
+		return nil, err
+	}
+	if len(retained) > 0 {
+		log.Info().Int("tombstones", len(retained)).Msg("Retaining tombstones shadowing older files!!")
 	}
 
-	writer := bufio.NewWriter(compact)
+	log.Info().Msg("Compacting the Immutables!!")
+	// temps go next to the inputs, in their family's dir.
+	dir := "."
+	if len(sorted) > 0 {
+		dir = filepath.Dir(sorted[0].Data)
+	}
+	compact, err := os.CreateTemp(dir, mergeTempPattern)
+	if err != nil {
+		return nil, fmt.Errorf("creating merge temp file: %w", err)
+	}
+	hint, err := os.CreateTemp(dir, mergeTempPattern)
+	if err != nil {
+		compact.Close()
+		os.Remove(compact.Name())
+		return nil, fmt.Errorf("creating merge hint temp file: %w", err)
+	}
+	// a failed merge never leaves its temp files behind.
 	defer func() {
-		if err := writer.Flush(); err != nil {
-			fmt.Fprintf(os.Stderr, "flush error: %v\n", err)
-		}
-		if err := compact.Close(); err != nil {
-			fmt.Fprintf(os.Stderr, "close error: %v\n", err)
+		if err != nil {
+			for _, file := range []*os.File{compact, hint} {
+				file.Close()
+				os.Remove(file.Name())
+			}
 		}
 	}()
 
-	log.Info().Msg("Appending fresh data in Compact!!")
+	writer := bufio.NewWriter(&throttledWriter{ctx: ctx, w: compact, l: mergeLimiter, count: &stats.bytesWritten})
+	hintBuffer := bufio.NewWriter(&throttledWriter{ctx: ctx, w: hint, l: mergeLimiter, count: &stats.bytesWritten})
+	hintWriter := newHintWriter(hintBuffer)
+
+	// sorted keys -> deterministic output & a sorted run with sparse index.
+	keys := make([]string, 0, len(fresh))
+	var moves []relocation
 	for key, keyState := range fresh {
-		if keyState.FlagTombstone {
+		// an expired value may still be in the keyDir, it has to go.
+		if keyState.FlagTombstone && keyState.Expiry != 0 {
+			moves = append(moves, relocation{key: key, from: from[key], dropped: true})
+		}
+		if keyState.FlagTombstone && !retained[key] {
 			continue
 		}
-		if err := Writer(writer, []byte(key), keyState.Val); err != nil {
-			return fmt.Errorf("writing key %q: %w", key, err)
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	log.Info().Msg("Appending fresh data & hints in Compact!!")
+	var (
+		offset int64
+		index  []indexEntry
+	)
+
+	// older files may still hold a dropped bucket's keys, its drop has to
+	// outlive this merge. drops go first, ahead of the sorted run.
+	if len(older) > 0 {
+		buckets := make([]string, 0, len(dropped))
+		for bucket := range dropped {
+			buckets = append(buckets, bucket)
+		}
+		sort.Strings(buckets)
+		for _, bucket := range buckets {
+			h := dropped[bucket]
+			if err = writeRecord(writer, h, nil, nil); err == nil {
+				err = hintWriter.add(hintFromRecord(h, nil, offset))
+			}
+			if err != nil {
+				return nil, fmt.Errorf("writing drop of bucket %q: %w", bucket, err)
+			}
+			offset += h.size()
+		}
+	}
+	for i, key := range keys {
+		if i%cancelCheckEvery == 0 {
+			if err = ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		if i%sparseEvery == 0 {
+			index = append(index, indexEntry{key: []byte(key), offset: offset})
+		}
+
+		// records keep their original ts, seq & expiry, the hint carries
+		// retained tombstones too.
+		keyState := fresh[key]
+		bucket, name := SplitBucketKey(key)
+		h := recordHeader{flag: types.FlagNormal, ts: keyState.Timestamp, seq: keyState.Seq, expiry: keyState.Expiry, bucket: bucket, keyLen: uint32(len(name)), valLen: uint32(len(keyState.Val))}
+		if keyState.FlagTombstone {
+			h.flag, h.expiry = types.FlagTombstone, 0
+		}
+		if err = writeRecord(writer, h, []byte(name), keyState.Val); err == nil {
+			err = hintWriter.add(hintFromRecord(h, []byte(name), offset))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("writing key %q: %w", key, err)
+		}
+		if !keyState.FlagTombstone {
+			moves = append(moves, relocation{key: key, from: from[key], to: offset})
 		}
+		offset += h.size()
+	}
+
+	if err = writeSparseIndex(writer, index, offset); err != nil {
+		return nil, fmt.Errorf("writing sparse index: %w", err)
+	}
+
+	if err = flushSyncClose(writer, compact); err != nil {
+		return nil, err
+	}
+	if err = hintWriter.finish(); err != nil {
+		return nil, fmt.Errorf("writing hint trailer: %w", err)
+	}
+	if err = flushSyncClose(hintBuffer, hint); err != nil {
+		return nil, err
+	}
+
+	p := stats.report(fresh)
+	log.Info().
+		Int64("bytes_read", p.BytesRead).
+		Int64("bytes_written", p.BytesWritten).
+		Int("keys_kept", p.KeysKept).
+		Int("keys_dropped", p.KeysDropped).
+		Float64("bytes_per_sec", p.BytesPerSec).
+		Int64("rate_limit", MergeRate()).
+		Msg("Merging Complete!!")
+	return &MergeResult{Data: compact.Name(), Hint: hint.Name(), moves: moves, maxSeq: stats.maxSeq}, nil
+}
+
+func flushSyncClose(writer *bufio.Writer, file *os.File) error {
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("flush %s: %w", file.Name(), err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("sync %s: %w", file.Name(), err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("close %s: %w", file.Name(), err)
 	}
-	log.Info().Msg("Merging Complete!!")
 	return nil
 }
@@ -2,7 +2,9 @@ package bitcask
 
 import (
 	"bufio"
-	"encoding/binary"
+	"bytes"
+	"context"
+	"errors"
 	"io"
 	"os"
 	"path/filepath"
@@ -48,6 +50,16 @@ type testEntry struct {
 	value []byte
 }
 
+// sealed logs as the MANIFEST would list them, generation 0.
+func logMetas(paths ...string) []FileMeta {
+	metas := make([]FileMeta, 0, len(paths))
+	for _, path := range paths {
+		metas = append(metas, FileMeta{Data: path})
+	}
+	return metas
+}
+
+// records of a merge output, a sorted run.
 func readCompactedFile(path string) (map[string][]byte, error) {
 	file, err := os.Open(path)
 	if err != nil {
@@ -55,11 +67,15 @@ func readCompactedFile(path string) (map[string][]byte, error) {
 	}
 	defer file.Close()
 
-	reader := bufio.NewReader(file)
+	records, err := recordReader(file, true)
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(records)
 	result := make(map[string][]byte)
 
 	for {
-		flag, err := reader.ReadByte()
+		h, err := readRecordHeader(reader)
 		if err == io.EOF {
 			break
 		}
@@ -67,25 +83,17 @@ func readCompactedFile(path string) (map[string][]byte, error) {
 			return nil, err
 		}
 
-		var keyLen, valLen uint32
-		if err := binary.Read(reader, binary.BigEndian, &keyLen); err != nil {
-			return nil, err
-		}
-		if err := binary.Read(reader, binary.BigEndian, &valLen); err != nil {
-			return nil, err
-		}
-
-		keyBuffer := make([]byte, keyLen)
+		keyBuffer := make([]byte, h.keyLen)
 		if _, err := io.ReadFull(reader, keyBuffer); err != nil {
 			return nil, err
 		}
 
-		valBuffer := make([]byte, valLen)
+		valBuffer := make([]byte, h.valLen)
 		if _, err := io.ReadFull(reader, valBuffer); err != nil {
 			return nil, err
 		}
 
-		if flag != byte(types.FlagTombstone) {
+		if h.flag != types.FlagTombstone {
 			result[string(keyBuffer)] = valBuffer
 		}
 	}
@@ -167,6 +175,20 @@ func TestMerger(t *testing.T) {
 				"key3": []byte("value3"),
 			},
 		},
+		{
+			name: "overwrites_within_one_file",
+			logFiles: [][]testEntry{
+				{
+					{flag: byte(types.FlagNormal), key: "key1", value: []byte("old_value")},
+					{flag: byte(types.FlagNormal), key: "key1", value: []byte("new_value")},
+					{flag: byte(types.FlagNormal), key: "key2", value: []byte("value2")},
+					{flag: byte(types.FlagTombstone), key: "key2"},
+				},
+			},
+			expected: map[string][]byte{
+				"key1": []byte("new_value"),
+			},
+		},
 		{
 			name: "empty_logs",
 			logFiles: [][]testEntry{
@@ -226,12 +248,12 @@ func TestMerger(t *testing.T) {
 				t.Fatalf("Failed to get sorted logs: %v", err)
 			}
 
-			if err := Merger(logPaths); err != nil {
+			merged, err := Merger(context.Background(), logMetas(logPaths...), nil, nil)
+			if err != nil {
 				t.Fatalf("Merger failed: %v", err)
 			}
 
-			compactedPath := "compacted_data.txt"
-			actual, err := readCompactedFile(compactedPath)
+			actual, err := readCompactedFile(merged.Data)
 			if err != nil {
 				t.Fatalf("Failed to read compacted file: %v", err)
 			}
@@ -257,10 +279,282 @@ func TestMerger(t *testing.T) {
 				}
 			}
 
-			os.Remove(compactedPath)
+			os.Remove(merged.Data)
+			os.Remove(merged.Hint)
 			for i := range tc.logFiles {
 				os.Remove("data_" + string(rune('0'+i)) + ".log")
 			}
 		})
 	}
 }
+
+func TestMergerProgress(t *testing.T) {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	tempDir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(tempDir)
+	defer os.Chdir(oldDir)
+
+	logFiles := [][]testEntry{
+		{
+			{flag: byte(types.FlagNormal), key: "a", value: []byte("1")},
+			{flag: byte(types.FlagNormal), key: "b", value: []byte("2")},
+		},
+		{
+			{flag: byte(types.FlagNormal), key: "a", value: []byte("3")},
+			{flag: byte(types.FlagTombstone), key: "b"},
+			{flag: byte(types.FlagNormal), key: "c", value: []byte("4")},
+		},
+	}
+	var logPaths []string
+	for i, entries := range logFiles {
+		logPath := "data_" + string(rune('0'+i)) + ".log"
+		if err := createTestLogFile(logPath, entries); err != nil {
+			t.Fatalf("Failed to create test log file: %v", err)
+		}
+		logPaths = append(logPaths, logPath)
+	}
+
+	var reports []MergeProgress
+	if _, err := Merger(context.Background(), logMetas(logPaths...), nil, func(p MergeProgress) {
+		reports = append(reports, p)
+	}); err != nil {
+		t.Fatalf("Merger failed: %v", err)
+	}
+
+	// one per file + the final one.
+	if len(reports) != len(logFiles)+1 {
+		t.Fatalf("Expected %d progress reports, got %d", len(logFiles)+1, len(reports))
+	}
+	final := reports[len(reports)-1]
+	if final.FilesDone != 2 || final.FilesTotal != 2 {
+		t.Errorf("Expected 2/2 files done, got %d/%d", final.FilesDone, final.FilesTotal)
+	}
+	if final.KeysKept != 2 {
+		t.Errorf("Expected 2 keys kept, got %d", final.KeysKept)
+	}
+	if final.KeysDropped != 3 {
+		t.Errorf("Expected 3 keys dropped, got %d", final.KeysDropped)
+	}
+	if final.BytesRead == 0 || final.BytesWritten == 0 {
+		t.Errorf("Expected bytes read & written, got %d & %d", final.BytesRead, final.BytesWritten)
+	}
+}
+
+func TestMergerCancelled(t *testing.T) {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	tempDir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(tempDir)
+	defer os.Chdir(oldDir)
+
+	entries := []testEntry{
+		{flag: byte(types.FlagNormal), key: "a", value: []byte("1")},
+	}
+	for _, logPath := range []string{"data_0.log", "data_1.log"} {
+		if err := createTestLogFile(logPath, entries); err != nil {
+			t.Fatalf("Failed to create test log file: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err := Merger(ctx, logMetas("data_0.log", "data_1.log"), nil, func(MergeProgress) {
+		cancel()
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+
+	if temps, _ := filepath.Glob(mergeTempPattern); len(temps) != 0 {
+		t.Errorf("Expected no merge temps left, got %v", temps)
+	}
+}
+
+// A(k=v) <- B(del k) <- C
+// merging only B+C must carry the tombstone, or a later merge of A with the
+// output brings k back.
+func TestMergerPartialKeepsTombstones(t *testing.T) {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	tempDir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(tempDir)
+	defer os.Chdir(oldDir)
+
+	files := map[string][]testEntry{
+		"data_a.log": {
+			{flag: byte(types.FlagNormal), key: "k", value: []byte("v")},
+			{flag: byte(types.FlagNormal), key: "other", value: []byte("1")},
+		},
+		"data_b.log": {
+			{flag: byte(types.FlagTombstone), key: "k"},
+			{flag: byte(types.FlagTombstone), key: "never_written"},
+		},
+		"data_c.log": {
+			{flag: byte(types.FlagNormal), key: "c", value: []byte("3")},
+		},
+	}
+	for path, entries := range files {
+		if err := createTestLogFile(path, entries); err != nil {
+			t.Fatalf("Failed to create test log file: %v", err)
+		}
+	}
+
+	partial, err := Merger(context.Background(), logMetas("data_b.log", "data_c.log"), logMetas("data_a.log"), nil)
+	if err != nil {
+		t.Fatalf("partial Merger failed: %v", err)
+	}
+
+	tombstones, err := readTombstones(partial.Data)
+	if err != nil {
+		t.Fatalf("Failed to read partial output: %v", err)
+	}
+	if !tombstones["k"] {
+		t.Error("Expected tombstone for k to be retained, A still holds k")
+	}
+	if tombstones["never_written"] {
+		t.Error("Expected tombstone for never_written to be dropped, no older file holds it")
+	}
+
+	full, err := Merger(context.Background(), append(logMetas("data_a.log"), FileMeta{Data: partial.Data, Generation: 1}), nil, nil)
+	if err != nil {
+		t.Fatalf("full Merger failed: %v", err)
+	}
+
+	actual, err := readCompactedFile(full.Data)
+	if err != nil {
+		t.Fatalf("Failed to read full output: %v", err)
+	}
+	if val, resurrected := actual["k"]; resurrected {
+		t.Errorf("Deleted key k came back with value %q", val)
+	}
+	if string(actual["other"]) != "1" || string(actual["c"]) != "3" {
+		t.Errorf("Expected other=1 & c=3, got %v", actual)
+	}
+
+	tombstones, err = readTombstones(full.Data)
+	if err != nil {
+		t.Fatalf("Failed to read full output: %v", err)
+	}
+	if len(tombstones) != 0 {
+		t.Errorf("Expected a full merge to drop every tombstone, got %v", tombstones)
+	}
+}
+
+func readTombstones(path string) (map[string]bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	records, err := recordReader(file, true)
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(records)
+	tombstones := make(map[string]bool)
+	for {
+		h, err := readRecordHeader(reader)
+		if err == io.EOF {
+			return tombstones, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		keyBuffer := make([]byte, h.keyLen)
+		if _, err := io.ReadFull(reader, keyBuffer); err != nil {
+			return nil, err
+		}
+		if _, err := reader.Discard(int(h.valLen)); err != nil {
+			return nil, err
+		}
+		if h.flag == types.FlagTombstone {
+			tombstones[string(keyBuffer)] = true
+		}
+	}
+}
+
+func TestMergerHintMatchesData(t *testing.T) {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	tempDir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(tempDir)
+	defer os.Chdir(oldDir)
+
+	var entries []testEntry
+	for i := range 40 {
+		entries = append(entries, testEntry{
+			flag:  byte(types.FlagNormal),
+			key:   "key_" + string(rune('a'+i%26)) + string(rune('a'+i/26)),
+			value: bytes.Repeat([]byte{'v'}, i),
+		})
+	}
+	if err := createTestLogFile("data_0.log", entries); err != nil {
+		t.Fatalf("Failed to create test log file: %v", err)
+	}
+
+	merged, err := Merger(context.Background(), logMetas("data_0.log"), nil, nil)
+	if err != nil {
+		t.Fatalf("Merger failed: %v", err)
+	}
+	hints, err := readHintFile(merged.Hint)
+	if err != nil {
+		t.Fatalf("Failed to read hint file: %v", err)
+	}
+	if len(hints) != len(entries) {
+		t.Fatalf("Expected %d hint entries, got %d", len(entries), len(hints))
+	}
+
+	file, err := os.Open(merged.Data)
+	if err != nil {
+		t.Fatalf("Failed to open merged data: %v", err)
+	}
+	defer file.Close()
+	for key, offset := range hints {
+		header := make([]byte, recordHeaderSize+len(key))
+		if _, err := file.ReadAt(header, offset); err != nil {
+			t.Fatalf("Failed to read record of %q at %d: %v", key, offset, err)
+		}
+		if string(header[recordHeaderSize:]) != key {
+			t.Errorf("Hint for %q points at a record for %q", key, header[recordHeaderSize:])
+		}
+	}
+}
+
+func TestMergerNewestSeqWins(t *testing.T) {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	tempDir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(tempDir)
+	defer os.Chdir(oldDir)
+
+	// the older file holds the newer write, seq outranks file order.
+	write := func(path string, seq uint64, val string) {
+		file, _ := os.Create(path)
+		writer := bufio.NewWriter(file)
+		h := recordHeader{flag: types.FlagNormal, ts: int64(seq), seq: seq}
+		if err := writeRecord(writer, h, []byte("k"), []byte(val)); err != nil {
+			t.Fatalf("writeRecord failed: %v", err)
+		}
+		writer.Flush()
+		file.Close()
+	}
+	write("data_0.log", 9, "newer")
+	write("data_1.log", 4, "older")
+
+	merged, err := Merger(context.Background(), logMetas("data_0.log", "data_1.log"), nil, nil)
+	if err != nil {
+		t.Fatalf("Merger failed: %v", err)
+	}
+	result, err := readCompactedFile(merged.Data)
+	if err != nil {
+		t.Fatalf("Failed to read compacted file: %v", err)
+	}
+	if string(result["k"]) != "newer" {
+		t.Errorf("Expected the seq 9 value, got %q", result["k"])
+	}
+	if merged.maxSeq != 9 {
+		t.Errorf("Expected maxSeq 9, got %d", merged.maxSeq)
+	}
+}
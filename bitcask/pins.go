@@ -0,0 +1,106 @@
+package bitcask
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// a Pin keeps the data files a reader still needs on disk. a merge that drops
+// a pinned file only marks it, releasing the last pin on it removes it.
+type Pin struct {
+	paths []string
+}
+
+type filePins struct {
+	mu     sync.Mutex
+	live   map[*Pin]bool
+	doomed map[string]bool
+}
+
+var pins = &filePins{live: make(map[*Pin]bool), doomed: make(map[string]bool)}
+
+func PinFiles(paths []string) *Pin {
+	pins.mu.Lock()
+	defer pins.mu.Unlock()
+	p := &Pin{paths: append([]string(nil), paths...)}
+	pins.live[p] = true
+	return p
+}
+
+// where the i-th pinned file is now, sealing may have renamed it.
+func (p *Pin) path(i int) string {
+	pins.mu.Lock()
+	defer pins.mu.Unlock()
+	return p.paths[i]
+}
+
+func (p *Pin) Release() {
+	pins.mu.Lock()
+	defer pins.mu.Unlock()
+	if !pins.live[p] {
+		return
+	}
+	delete(pins.live, p)
+	for _, path := range p.paths {
+		if !pins.doomed[path] || pins.refs(path) > 0 {
+			continue
+		}
+		delete(pins.doomed, path)
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Warn().Err(err).Str("file", path).Msg("Failed to delete unpinned file")
+		}
+	}
+}
+
+// how many live pins hold path, mu held.
+func (f *filePins) refs(path string) int {
+	n := 0
+	for p := range f.live {
+		for _, pinned := range p.paths {
+			if pinned == path {
+				n++
+				break
+			}
+		}
+	}
+	return n
+}
+
+// removes path unless it is pinned, then it goes with the last release.
+func (f *filePins) remove(path string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.refs(path) > 0 {
+		f.doomed[path] = true
+		log.Info().Str("file", path).Msg("File pinned by a snapshot, deleting it on release!!")
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// still on disk only for a pin, the MANIFEST dropped it already.
+func (f *filePins) held(path string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.refs(path) > 0
+}
+
+// sealing renames data.txt, pins on it follow the file.
+func (f *filePins) rename(from, to string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for p := range f.live {
+		for i, pinned := range p.paths {
+			if pinned == from {
+				p.paths[i] = to
+			}
+		}
+	}
+}
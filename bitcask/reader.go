@@ -1 +1,310 @@
 package bitcask
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/pro0o/deslocado/types"
+)
+
+// compacted files are sorted runs:
+// records (sorted by key) | sparse index | footer
+// index entry: keyLen u32 | key | offset u64, one every sparseEvery records
+// footer: indexOffset u64 | indexCount u32 | crc u32 | magic u64
+// crc covers the index & the footer up to it. only files the MANIFEST lists
+// as merge output (Generation > 0) have one, a sealed log is never probed.
+const (
+	footerMagic = uint64(0x6465736c6f636164) // "deslocad"
+	footerSize  = 8 + 4 + 4 + 8
+	sparseEvery = 16
+)
+
+var ErrNotSortedRun = errors.New("not a sorted run")
+
+type indexEntry struct {
+	key    []byte
+	offset int64
+}
+
+type footer struct {
+	indexOffset int64
+	indexCount  uint32
+}
+
+// a missing magic, an offset out of range or a crc mismatch are all
+// ErrNotSortedRun.
+func readFooter(file *os.File) (footer, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return footer{}, err
+	}
+	size := info.Size()
+	if size < footerSize {
+		return footer{}, fmt.Errorf("%d bytes, too short for a footer: %w", size, ErrNotSortedRun)
+	}
+
+	raw := make([]byte, footerSize)
+	if _, err := file.ReadAt(raw, size-footerSize); err != nil {
+		return footer{}, err
+	}
+	if binary.BigEndian.Uint64(raw[16:]) != footerMagic {
+		return footer{}, fmt.Errorf("no footer magic: %w", ErrNotSortedRun)
+	}
+	f := footer{
+		indexOffset: int64(binary.BigEndian.Uint64(raw[:8])),
+		indexCount:  binary.BigEndian.Uint32(raw[8:12]),
+	}
+	if f.indexOffset < 0 || f.indexOffset > size-footerSize {
+		return footer{}, fmt.Errorf("footer index offset %d out of range: %w", f.indexOffset, ErrNotSortedRun)
+	}
+
+	crc := crc32.NewIEEE()
+	if _, err := io.Copy(crc, io.NewSectionReader(file, f.indexOffset, size-footerSize-f.indexOffset)); err != nil {
+		return footer{}, err
+	}
+	crc.Write(raw[:12])
+	if crc.Sum32() != binary.BigEndian.Uint32(raw[12:16]) {
+		return footer{}, fmt.Errorf("footer checksum mismatch: %w", ErrNotSortedRun)
+	}
+	return f, nil
+}
+
+// records only: a sorted run stops at its index, anything else runs to EOF.
+// sorted comes from the MANIFEST, never from the file's own bytes.
+func recordReader(file *os.File, sorted bool) (io.Reader, error) {
+	if sorted {
+		f, err := readFooter(file)
+		if err != nil {
+			return nil, fmt.Errorf("read footer of %s: %w", file.Name(), err)
+		}
+		return io.NewSectionReader(file, 0, f.indexOffset), nil
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return io.NewSectionReader(file, 0, info.Size()), nil
+}
+
+// SortedRun reads a compacted file in key order without the keyDir.
+type SortedRun struct {
+	file  *os.File
+	end   int64
+	index []indexEntry
+}
+
+func OpenSortedRun(path string) (*SortedRun, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := readFooter(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("read footer of %s: %w", path, err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(io.NewSectionReader(file, f.indexOffset, info.Size()-footerSize-f.indexOffset))
+	index := make([]indexEntry, 0, f.indexCount)
+	for range f.indexCount {
+		var keyLen uint32
+		if err := binary.Read(reader, binary.BigEndian, &keyLen); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("read index of %s: %w", path, err)
+		}
+		key := make([]byte, keyLen)
+		if _, err := io.ReadFull(reader, key); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("read index of %s: %w", path, err)
+		}
+		var offset uint64
+		if err := binary.Read(reader, binary.BigEndian, &offset); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("read index of %s: %w", path, err)
+		}
+		index = append(index, indexEntry{key: key, offset: int64(offset)})
+	}
+
+	return &SortedRun{file: file, end: f.indexOffset, index: index}, nil
+}
+
+func (r *SortedRun) Close() error {
+	return r.file.Close()
+}
+
+// offset of the last indexed record <= key, where a scan for key starts.
+func (r *SortedRun) seekOffset(key []byte) int64 {
+	i := sort.Search(len(r.index), func(i int) bool {
+		return bytes.Compare(r.index[i].key, key) > 0
+	})
+	if i == 0 {
+		return 0
+	}
+	return r.index[i-1].offset
+}
+
+// Scan walks records in key order from the first key >= start (nil for the
+// beginning) until fn returns false or the run ends. keys are BucketKeys,
+// bucket drops are skipped.
+func (r *SortedRun) Scan(start []byte, fn func(key, val []byte, flag types.RecordFlag) bool) error {
+	offset := int64(0)
+	if start != nil {
+		offset = r.seekOffset(start)
+	}
+	reader := bufio.NewReader(io.NewSectionReader(r.file, offset, r.end-offset))
+
+	for {
+		h, err := readRecordHeader(reader)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		key := make([]byte, h.keyLen)
+		if _, err := io.ReadFull(reader, key); err != nil {
+			return err
+		}
+		key = []byte(BucketKey(h.bucket, key))
+
+		if h.flag == types.FlagDropBucket || start != nil && bytes.Compare(key, start) < 0 {
+			if _, err := reader.Discard(int(h.valLen)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		val := make([]byte, h.valLen)
+		if _, err := io.ReadFull(reader, val); err != nil {
+			return err
+		}
+		if !fn(key, val, h.flag) {
+			return nil
+		}
+	}
+}
+
+// Get looks key up through the sparse index. a tombstone is found with a
+// nil value & FlagTombstone.
+func (r *SortedRun) Get(key []byte) ([]byte, types.RecordFlag, bool, error) {
+	var (
+		val   []byte
+		flag  types.RecordFlag
+		found bool
+	)
+	err := r.Scan(key, func(k, v []byte, f types.RecordFlag) bool {
+		if bytes.Equal(k, key) {
+			val, flag, found = v, f, true
+		}
+		return false
+	})
+	if flag == types.FlagTombstone {
+		val = nil
+	}
+	return val, flag, found, err
+}
+
+// reads up to the key, bucket included. a clean end comes back as io.EOF,
+// half a header as io.ErrUnexpectedEOF.
+func readRecordHeader(reader io.Reader) (recordHeader, error) {
+	raw := make([]byte, recordHeaderSize)
+	if _, err := io.ReadFull(reader, raw); err != nil {
+		return recordHeader{}, err
+	}
+	h := recordHeader{
+		flag:   types.RecordFlag(raw[0]),
+		ts:     int64(binary.BigEndian.Uint64(raw[1:9])),
+		seq:    binary.BigEndian.Uint64(raw[9:17]),
+		expiry: int64(binary.BigEndian.Uint64(raw[17:25])),
+		keyLen: binary.BigEndian.Uint32(raw[27:31]),
+		valLen: binary.BigEndian.Uint32(raw[31:35]),
+	}
+	if bucketLen := binary.BigEndian.Uint16(raw[25:27]); bucketLen > 0 {
+		bucket := make([]byte, bucketLen)
+		if _, err := io.ReadFull(reader, bucket); err != nil {
+			return recordHeader{}, torn(err)
+		}
+		h.bucket = string(bucket)
+	}
+	return h, nil
+}
+
+// walks records, values are skipped. returns where the last complete record
+// ends, a torn record at the tail comes back as io.ErrUnexpectedEOF.
+func scanRecords(reader *bufio.Reader, fn func(offset int64, h recordHeader, key []byte) error) (int64, error) {
+	var offset int64
+	for {
+		h, err := readRecordHeader(reader)
+		if err == io.EOF {
+			return offset, nil
+		} else if err != nil {
+			return offset, err
+		}
+
+		key := make([]byte, h.keyLen)
+		if _, err := io.ReadFull(reader, key); err != nil {
+			return offset, torn(err)
+		}
+		if _, err := reader.Discard(int(h.valLen)); err != nil {
+			return offset, torn(err)
+		}
+
+		if err := fn(offset, h, key); err != nil {
+			return offset, err
+		}
+		offset += h.size()
+	}
+}
+
+// EOF half way through a record is a torn write, not a clean end.
+func torn(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Record is one record read back from a data file. Timestamp & Expiry are
+// unix nanos, Expiry 0 never expires.
+type Record struct {
+	Flag      types.RecordFlag
+	Timestamp int64
+	Seq       uint64
+	Expiry    int64
+	Bucket    string
+	Key       []byte
+	Val       []byte
+}
+
+func (r Record) Expired(now int64) bool {
+	return r.Expiry != 0 && r.Expiry <= now
+}
+
+// ReadRecordAt reads the whole record starting at offset.
+func ReadRecordAt(r io.ReaderAt, offset int64) (Record, error) {
+	reader := io.NewSectionReader(r, offset, 1<<62)
+	h, err := readRecordHeader(reader)
+	if err != nil {
+		return Record{}, fmt.Errorf("read record header at %d: %w", offset, torn(err))
+	}
+	rec := Record{Flag: h.flag, Timestamp: h.ts, Seq: h.seq, Expiry: h.expiry, Bucket: h.bucket, Key: make([]byte, h.keyLen), Val: make([]byte, h.valLen)}
+	if _, err := io.ReadFull(reader, rec.Key); err != nil {
+		return Record{}, fmt.Errorf("read key at %d: %w", offset, torn(err))
+	}
+	if _, err := io.ReadFull(reader, rec.Val); err != nil {
+		return Record{}, fmt.Errorf("read value at %d: %w", offset, torn(err))
+	}
+	return rec, nil
+}
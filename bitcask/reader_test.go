@@ -0,0 +1,186 @@
+package bitcask
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/pro0o/deslocado/types"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func mergeSortedRunForTest(t *testing.T, count int) string {
+	var entries []testEntry
+	// written newest key first so nothing is sorted by accident.
+	for i := count - 1; i >= 0; i-- {
+		entries = append(entries, testEntry{
+			flag:  byte(types.FlagNormal),
+			key:   fmt.Sprintf("key_%04d", i),
+			value: []byte(fmt.Sprintf("value_%d", i)),
+		})
+	}
+	entries = append(entries, testEntry{flag: byte(types.FlagTombstone), key: "key_0003"})
+	if err := createTestLogFile("data_1.log", entries); err != nil {
+		t.Fatalf("Failed to create test log file: %v", err)
+	}
+	if err := createTestLogFile("data_0.log", []testEntry{
+		{flag: byte(types.FlagNormal), key: "key_0003", value: []byte("old")},
+	}); err != nil {
+		t.Fatalf("Failed to create test log file: %v", err)
+	}
+
+	// key_0003's tombstone shadows data_0.log, so it stays in the run.
+	merged, err := Merger(context.Background(), logMetas("data_1.log"), logMetas("data_0.log"), nil)
+	if err != nil {
+		t.Fatalf("Merger failed: %v", err)
+	}
+	return merged.Data
+}
+
+func TestSortedRun(t *testing.T) {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	tempDir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(tempDir)
+	defer os.Chdir(oldDir)
+
+	const count = 100
+	run, err := OpenSortedRun(mergeSortedRunForTest(t, count))
+	if err != nil {
+		t.Fatalf("OpenSortedRun failed: %v", err)
+	}
+	defer run.Close()
+
+	if len(run.index) != (count+sparseEvery-1)/sparseEvery {
+		t.Errorf("Expected %d index entries, got %d", (count+sparseEvery-1)/sparseEvery, len(run.index))
+	}
+
+	t.Run("ordered_scan", func(t *testing.T) {
+		var prev []byte
+		seen := 0
+		err := run.Scan(nil, func(key, val []byte, flag types.RecordFlag) bool {
+			if prev != nil && bytes.Compare(prev, key) >= 0 {
+				t.Errorf("Keys out of order: %q before %q", prev, key)
+			}
+			prev = key
+			seen++
+			return true
+		})
+		if err != nil {
+			t.Fatalf("Scan failed: %v", err)
+		}
+		if seen != count {
+			t.Errorf("Expected %d records, got %d", count, seen)
+		}
+	})
+
+	t.Run("scan_from_key", func(t *testing.T) {
+		var keys []string
+		err := run.Scan([]byte("key_0050"), func(key, val []byte, flag types.RecordFlag) bool {
+			keys = append(keys, string(key))
+			return len(keys) < 3
+		})
+		if err != nil {
+			t.Fatalf("Scan failed: %v", err)
+		}
+		expected := []string{"key_0050", "key_0051", "key_0052"}
+		if fmt.Sprint(keys) != fmt.Sprint(expected) {
+			t.Errorf("Expected %v, got %v", expected, keys)
+		}
+	})
+
+	t.Run("point_lookups", func(t *testing.T) {
+		for i := range count {
+			key := fmt.Sprintf("key_%04d", i)
+			val, flag, found, err := run.Get([]byte(key))
+			if err != nil {
+				t.Fatalf("Get %s failed: %v", key, err)
+			}
+			if !found {
+				t.Errorf("Expected %s to be found", key)
+				continue
+			}
+			if i == 3 {
+				if flag != types.FlagTombstone || val != nil {
+					t.Errorf("Expected %s to be a tombstone, got %q", key, val)
+				}
+				continue
+			}
+			if string(val) != fmt.Sprintf("value_%d", i) {
+				t.Errorf("Key %s: expected value_%d, got %q", key, i, val)
+			}
+		}
+
+		for _, key := range []string{"a", "key_00505", "zzz"} {
+			if _, _, found, err := run.Get([]byte(key)); err != nil || found {
+				t.Errorf("Expected %s to be missing, found=%v err=%v", key, found, err)
+			}
+		}
+	})
+}
+
+func TestMergerDeterministic(t *testing.T) {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	tempDir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(tempDir)
+	defer os.Chdir(oldDir)
+
+	first, err := os.ReadFile(mergeSortedRunForTest(t, 50))
+	if err != nil {
+		t.Fatalf("Failed to read first merge: %v", err)
+	}
+	// same input files, records keep their timestamps.
+	again, err := Merger(context.Background(), logMetas("data_1.log"), logMetas("data_0.log"), nil)
+	if err != nil {
+		t.Fatalf("Merger failed: %v", err)
+	}
+	second, err := os.ReadFile(again.Data)
+	if err != nil {
+		t.Fatalf("Failed to read second merge: %v", err)
+	}
+	if !bytes.Equal(first, second) {
+		t.Error("Expected merging the same input twice to produce identical files")
+	}
+}
+
+func TestOpenSortedRunRejectsPlainLog(t *testing.T) {
+	tempDir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(tempDir)
+	defer os.Chdir(oldDir)
+
+	if err := createTestLogFile("data_1.log", []testEntry{
+		{flag: byte(types.FlagNormal), key: "key", value: []byte("value")},
+	}); err != nil {
+		t.Fatalf("Failed to create test log file: %v", err)
+	}
+	if _, err := OpenSortedRun("data_1.log"); !errors.Is(err, ErrNotSortedRun) {
+		t.Errorf("Expected ErrNotSortedRun, got %v", err)
+	}
+}
+
+func TestOpenSortedRunChecksIndex(t *testing.T) {
+	tempDir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(tempDir)
+	defer os.Chdir(oldDir)
+
+	path := mergeSortedRunForTest(t, 40)
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read run: %v", err)
+	}
+	// the last index entry's offset, just ahead of the footer.
+	raw[len(raw)-footerSize-1] ^= 0xff
+	if err := os.WriteFile(path, raw, 0644); err != nil {
+		t.Fatalf("Failed to write run: %v", err)
+	}
+	if _, err := OpenSortedRun(path); !errors.Is(err, ErrNotSortedRun) {
+		t.Errorf("Expected a corrupt index to be ErrNotSortedRun, got %v", err)
+	}
+}
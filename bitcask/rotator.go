@@ -1,180 +1,239 @@
 package bitcask
 
 import (
-	"bufio"
-	"encoding/binary"
+	"context"
 	"fmt"
-	"io"
-	"maps"
 	"os"
-	"path/filepath"
-	"time"
+	"slices"
 
 	"github.com/gofrs/flock"
-	"github.com/pro0o/deslocado/types"
 	"github.com/rs/zerolog/log"
 )
 
 const MAX_IMMUTABLES = 3
 
-func createHintFile(compactedLog string) error {
-	compact, err := os.Open(compactedLog)
-	if err != nil {
-		return fmt.Errorf("open compacted log: %w", err)
-	}
-	defer compact.Close()
-
-	offsets := make(map[string]int64)
-
-	for {
-		off, err := compact.Seek(0, io.SeekCurrent)
-		if err != nil {
-			return err
-		}
-
-		var flag byte
-		if err := binary.Read(compact, binary.BigEndian, &flag); err == io.EOF {
-			break
-		} else if err != nil {
-			return err
-		}
-
-		if flag != byte(types.FlagNormal) {
-			return fmt.Errorf("unexpected tombstone in compacted file at offset %d", off)
-		}
+// merged temp + its hint are installed under their final names, the
+// MANIFEST swaps the inputs for them & only then are the inputs removed.
+func compactionInstall(m *Manifest, logs []string, merged *MergeResult, out FileMeta) (*install, error) {
+	in := &install{}
+	in.rename(merged.Data, out.Data)
+	in.rename(merged.Hint, out.Hint)
 
-		var keyLen, valLen uint32
-		if err := binary.Read(compact, binary.BigEndian, &keyLen); err != nil {
-			return err
-		}
-		if err := binary.Read(compact, binary.BigEndian, &valLen); err != nil {
-			return err
-		}
-
-		keyBuffer := make([]byte, keyLen)
-		if _, err := io.ReadFull(compact, keyBuffer); err != nil {
-			return err
+	stale := make(map[string]bool, len(logs))
+	for _, oldLog := range logs {
+		stale[oldLog] = true
+	}
+	for _, meta := range m.Files {
+		if stale[meta.Data] {
+			in.remove(meta.Data)
+			if meta.Hint != "" {
+				in.remove(meta.Hint)
+			}
 		}
+	}
 
-		key := string(keyBuffer)
-		offsets[key] = off
-
-		// skip over to next kv via val.
-		if _, err := compact.Seek(int64(valLen), io.SeekCurrent); err != nil {
-			return err
-		}
+	if err := m.replace(logs, out); err != nil {
+		return nil, err
 	}
+	m.CompactedSeq = max(m.CompactedSeq, merged.maxSeq)
+	return in, nil
+}
 
-	hint := fmt.Sprintf("%s.hint", compactedLog)
-	hintFile, err := os.Create(hint)
+// rotate -> seal active + its hint -> MANIFEST
+// if immutables threshold -> merging
+// immutables.log -> merge.tmp data + hint, one pass
+// compacted.log + compacted.hint -> MANIFEST -> drop immutables
+// cancelling ctx stops the merge, nothing past the rotation gets installed.
+// keyDir follows every move per key, a key written or deleted meanwhile
+// keeps its newer state. files & threshold are those of active's family.
+// all phases in one go, see Rotation to run the merge outside a lock.
+func Rotator(ctx context.Context, active *Active, keyDir *KeyDir, progress ProgressFunc) (*Active, error) {
+	r, err := Seal(ctx, active)
 	if err != nil {
-		return fmt.Errorf("create hint file: %w", err)
+		return active, err
 	}
-
-	for key, offset := range offsets {
-		if err := binary.Write(hintFile, binary.BigEndian, uint32(len(key))); err != nil {
-			return fmt.Errorf("write key length to hint: %w", err)
-		}
-		if _, err := hintFile.Write([]byte(key)); err != nil {
-			return fmt.Errorf("write key to hint: %w", err)
-		}
-		if err := binary.Write(hintFile, binary.BigEndian, uint64(offset)); err != nil {
-			return fmt.Errorf("write offset to hint: %w", err)
-		}
+	defer r.Close()
+	if err := r.Merge(ctx, progress); err != nil {
+		return r.Active, err
+	}
+	if err := r.Install(ctx, keyDir); err != nil {
+		return r.Active, err
 	}
+	return r.Active, nil
+}
 
-	hintFile.Close()
-	return nil
+// Rotation is a rotation split in phases, so the caller's lock only has to
+// cover the ones touching data.txt & the keyDir:
+// Seal (locked) -> Merge (unlocked) -> Install (locked) -> Close.
+// the store's lock file is held from Seal to Close, no other rotation or
+// merge gets in between.
+type Rotation struct {
+	// Active is the fresh data.txt, writes go there once Seal returns.
+	Active *Active
+
+	family   Family
+	lock     *flock.Flock
+	manifest *Manifest
+	inputs   []FileMeta
+	logs     []string
+	outID    uint64
+	merging  bool
+	merged   *MergeResult
 }
 
-func cleanupOldFiles(logs []string, compactedLog string) error {
-	for _, oldLog := range logs {
-		if oldLog != compactedLog {
-			if err := os.Remove(oldLog); err != nil {
-				log.Warn().Err(err).Str("file", oldLog).Msg("Failed to delete old log")
-			}
-		}
+// Seal syncs & seals active under the next id & opens a fresh data.txt.
+// active is closed once it returns without an error, nil otherwise & active
+// is still the one to write to.
+func Seal(ctx context.Context, active *Active) (*Rotation, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
-
-	hints, _ := filepath.Glob("data*.hint")
-	currentHint := fmt.Sprintf("%s.hint", compactedLog)
-	for _, oldHint := range hints {
-		if oldHint != currentHint {
-			os.Remove(oldHint)
-		}
+	if err := active.Sync(); err != nil {
+		return nil, fmt.Errorf("sync active file: %w", err)
 	}
 
-	return nil
+	lock := flock.New(lockFile)
+	if err := lock.Lock(); err != nil {
+		return nil, fmt.Errorf("lock file: %w", err)
+	}
+	r, err := seal(active, lock)
+	if err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+	return r, nil
 }
 
-// rotate -> gen immutables
-// if immutables threshold -> merging
-// immutables.log -> compacted.txt
-// compacted.txt -> compacted.log
-// compacted.log -> compacted.hint
-func Rotator(oldWriter *bufio.Writer, keyDir map[string]types.FileOffset) (*bufio.Writer, error) {
-	if err := oldWriter.Flush(); err != nil {
-		return oldWriter, fmt.Errorf("flush old writer: %w", err)
+func seal(active *Active, lock *flock.Flock) (*Rotation, error) {
+	family := active.family
+	if err := recoverMerge(family); err != nil {
+		return nil, fmt.Errorf("recover: %w", err)
 	}
 
-	lock := flock.New("data.txt.lock")
-	if err := lock.Lock(); err != nil {
-		return oldWriter, fmt.Errorf("lock file: %w", err)
+	manifest, err := family.LoadManifest()
+	if err != nil {
+		return nil, fmt.Errorf("load manifest: %w", err)
 	}
-	defer lock.Unlock()
 
 	log.Info().Msg("Rotation started!!")
 
-	newLog := fmt.Sprintf("data_%d.log", time.Now().Unix())
-	if err := os.Rename("data.txt", newLog); err != nil {
-		return oldWriter, fmt.Errorf("rename file: %w", err)
+	// data.txt goes under the id its records already carry.
+	id := manifest.ActiveID
+	if id == 0 {
+		id = manifest.allocID()
 	}
-	log.Info().Msg("Immutable created!!")
-
-	freshFile, err := os.OpenFile("data.txt", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
-	if err != nil {
-		return oldWriter, fmt.Errorf("open new data.txt: %w", err)
+	newLog := active.fileID
+	if _, err := os.Stat(newLog); err == nil {
+		return nil, fmt.Errorf("sealed log %s already exists", newLog)
 	}
-	newWriter := bufio.NewWriter(freshFile)
 
-	logs, err := sorted("data_*.log")
-	if err != nil {
-		return newWriter, fmt.Errorf("failed to sort: %w", err)
+	// the hint is unreferenced until the MANIFEST lands, Recover drops it if
+	// we crash before that.
+	hint := hintName(newLog)
+	if err := active.writeHint(hint); err != nil {
+		os.Remove(hint)
+		return nil, fmt.Errorf("write hint for %s: %w", newLog, err)
 	}
 
-	if len(logs) >= MAX_IMMUTABLES {
+	// the merge's id comes before the next data.txt's, so ids stay in
+	// file order.
+	manifest.Files = append(manifest.Files, FileMeta{ID: id, Data: newLog, Hint: hint})
+	r := &Rotation{
+		family:   family,
+		lock:     lock,
+		manifest: manifest,
+		inputs:   slices.Clone(manifest.Files),
+		logs:     manifest.logs(),
+	}
+	r.merging = len(r.logs) >= family.maxImmutables()
+	if r.merging {
+		r.outID = manifest.allocID()
+	}
 
-		if err := Merger(logs); err != nil {
-			return newWriter, fmt.Errorf("merging logs: %w", err)
-		}
+	// the MANIFEST goes first, Recover finishes the rename if we crash.
+	manifest.LastSeq = max(manifest.LastSeq, active.LastSeq())
+	manifest.ActiveID = manifest.allocID()
+	if err := manifest.save(); err != nil {
+		return nil, fmt.Errorf("save manifest: %w", err)
+	}
 
-		compactedLog := fmt.Sprintf("data_compacted_%d.log", time.Now().Unix())
-		if err := os.Rename("compacted_data.txt", compactedLog); err != nil {
-			return newWriter, fmt.Errorf("rename compacted data: %w", err)
-		}
+	if err := active.Close(); err != nil {
+		return nil, fmt.Errorf("close active file: %w", err)
+	}
+	if err := os.Rename(active.path, newLog); err != nil {
+		return nil, fmt.Errorf("rename file: %w", err)
+	}
+	pins.rename(active.path, newLog)
+	if err := syncDir(family.dir()); err != nil {
+		return nil, err
+	}
+	log.Info().Msg("Immutable created!!")
 
-		if err := createHintFile(compactedLog); err != nil {
-			return newWriter, fmt.Errorf("create hint file: %w", err)
-		}
-		log.Info().Msg("Hint Files Generated!!")
+	// the keyDir already points at newLog, nothing to move.
+	r.Active, err = family.OpenActive()
+	if err != nil {
+		return nil, fmt.Errorf("open new data.txt: %w", err)
+	}
+	r.Active.ShareSeq(active)
+	return r, nil
+}
 
-		log.Info().Msg("Cleaning up the stale hints & logs!!")
-		if err := cleanupOldFiles(logs, compactedLog); err != nil {
-			log.Warn().Err(err).Msg("Failed to cleanup old files")
-		}
+// Merge merges every immutable once the threshold is reached, nothing gets
+// installed yet. it only reads sealed files, writes to Active can go on.
+func (r *Rotation) Merge(ctx context.Context, progress ProgressFunc) error {
+	if !r.merging {
+		log.Info().Msgf("No merge needed. Current log count: %d, threshold: %d", len(r.logs), r.family.maxImmutables())
+		return nil
+	}
+	// every immutable is merged, nothing older can hide behind a tombstone.
+	merged, err := Merger(ctx, r.inputs, nil, progress)
+	if err != nil {
+		return fmt.Errorf("merging logs: %w", err)
+	}
+	r.merged = merged
+	log.Info().Msg("Hint Files Generated!!")
+	return nil
+}
 
-		freshKeyDir, err := BuildKeyDir()
-		if err != nil {
-			return newWriter, nil
-		}
+// Install swaps the merge in for its inputs & moves keyDir over to it. a
+// key written or deleted since Seal keeps its newer state.
+func (r *Rotation) Install(ctx context.Context, keyDir *KeyDir) error {
+	if r.merged == nil {
+		log.Info().Msg("Rotation Complete!!")
+		return nil
+	}
+	compactedLog := r.family.path(compactedName(r.outID))
+	out := FileMeta{ID: r.outID, Data: compactedLog, Hint: hintName(compactedLog)}
+	in, err := compactionInstall(r.manifest, r.logs, r.merged, out)
+	if err != nil {
+		return err
+	}
 
-		clear(keyDir)
-		maps.Copy(keyDir, freshKeyDir)
+	// last chance to back out, the MANIFEST commit can't be undone.
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("merging logs: %w", err)
+	}
 
-	} else {
-		log.Info().Msgf("No merge needed. Current log count: %d, threshold: %d", len(logs), MAX_IMMUTABLES)
+	log.Info().Msg("Installing compacted log & cleaning up the stale hints & logs!!")
+	merged := r.merged
+	// past here the temps are renamed or Recover's to roll forward.
+	r.merged = nil
+	if err := installMerge(r.manifest, in); err != nil {
+		return fmt.Errorf("install merge: %w", err)
 	}
 
+	moved, skipped := keyDir.reconcile(compactedLog, merged.moves)
+	log.Info().Int("moved", moved).Int("skipped", skipped).Msg("KeyDir reconciled with the compacted log!!")
 	log.Info().Msg("Rotation Complete!!")
-	return newWriter, nil
+	return nil
+}
+
+// Close drops a merge that never got installed & releases the lock file.
+func (r *Rotation) Close() error {
+	if r.merged != nil {
+		os.Remove(r.merged.Data)
+		os.Remove(r.merged.Hint)
+		r.merged = nil
+	}
+	return r.lock.Unlock()
 }
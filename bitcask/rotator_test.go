@@ -2,8 +2,8 @@ package bitcask
 
 import (
 	"bufio"
-	"encoding/binary"
-	"io"
+	"context"
+	"errors"
 	"os"
 	"path/filepath"
 	"strings"
@@ -14,7 +14,13 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
+// data.txt gets the MANIFEST a store writes when it's first opened.
 func createDataFile(path string, entries []testEntry) error {
+	if path == activeFile && !fileExists(manifestFile) {
+		if err := (&Manifest{NextID: 1}).save(); err != nil {
+			return err
+		}
+	}
 	file, err := os.Create(path)
 	if err != nil {
 		return err
@@ -41,47 +47,32 @@ func createDataFile(path string, entries []testEntry) error {
 	return nil
 }
 
+// sealed logs without hints, listed oldest -> newest in a new MANIFEST.
 func createExistingLogs(tempDir string, count int) error {
+	manifest := &Manifest{NextID: 1}
 	for i := range count {
-		logPath := filepath.Join(tempDir, "data_"+string(rune('0'+i))+".log")
+		name := "data_" + string(rune('0'+i)) + ".log"
 		entries := []testEntry{
 			{flag: byte(types.FlagNormal), key: "old_key_" + string(rune('0'+i)), value: []byte("old_value_" + string(rune('0'+i)))},
 		}
-		if err := createDataFile(logPath, entries); err != nil {
+		if err := createDataFile(filepath.Join(tempDir, name), entries); err != nil {
 			return err
 		}
+		// the store dir is the working dir, names are relative to it.
+		manifest.Files = append(manifest.Files, FileMeta{ID: manifest.allocID(), Data: name})
 	}
-	return nil
+	return manifest.save()
 }
 
 func readHintFile(path string) (map[string]int64, error) {
-	file, err := os.Open(path)
+	entries, err := readHint(path)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
 
 	hints := make(map[string]int64)
-
-	for {
-		var keyLen uint32
-		if err := binary.Read(file, binary.BigEndian, &keyLen); err == io.EOF {
-			break
-		} else if err != nil {
-			return nil, err
-		}
-
-		keyBuffer := make([]byte, keyLen)
-		if _, err := io.ReadFull(file, keyBuffer); err != nil {
-			return nil, err
-		}
-
-		var offset uint64
-		if err := binary.Read(file, binary.BigEndian, &offset); err != nil {
-			return nil, err
-		}
-
-		hints[string(keyBuffer)] = int64(offset)
+	for _, entry := range entries {
+		hints[string(entry.key)] = entry.offset
 	}
 
 	return hints, nil
@@ -92,7 +83,7 @@ func countFiles(pattern string) int {
 	return len(matches)
 }
 
-func createMockKeyDir(entries []testEntry) map[string]types.FileOffset {
+func createMockKeyDir(entries []testEntry) *KeyDir {
 	keyDir := make(map[string]types.FileOffset)
 	offset := int64(0)
 
@@ -102,11 +93,11 @@ func createMockKeyDir(entries []testEntry) map[string]types.FileOffset {
 				FileID: "data.txt",
 				Offset: offset,
 			}
-			offset += int64(1 + 4 + 4 + len(entry.key) + len(entry.value))
+			offset += recordSize([]byte(entry.key), entry.value)
 		}
 	}
 
-	return keyDir
+	return NewKeyDir(keyDir)
 }
 
 func TestRotator(t *testing.T) {
@@ -155,16 +146,15 @@ func TestRotator(t *testing.T) {
 				t.Fatalf("Failed to create existing logs: %v", err)
 			}
 
-			file, err := os.OpenFile("data.txt", os.O_RDWR|os.O_APPEND, 0644)
+			active, err := OpenActive()
 			if err != nil {
 				t.Fatalf("Failed to open data.txt: %v", err)
 			}
-			oldWriter := bufio.NewWriter(file)
 
 			// Create mock keyDir for the test
 			keyDir := createMockKeyDir(tc.initialData)
 
-			newWriter, err := Rotator(oldWriter, keyDir)
+			newWriter, err := Rotator(context.Background(), active, keyDir, nil)
 			if err != nil {
 				t.Fatalf("Rotator failed: %v", err)
 			}
@@ -236,15 +226,14 @@ func TestRotatorFileOperations(t *testing.T) {
 		t.Fatalf("Failed to create data.txt: %v", err)
 	}
 
-	file, err := os.OpenFile("data.txt", os.O_RDWR|os.O_APPEND, 0644)
+	active, err := OpenActive()
 	if err != nil {
 		t.Fatalf("Failed to open data.txt: %v", err)
 	}
-	oldWriter := bufio.NewWriter(file)
 
 	keyDir := createMockKeyDir(initialData)
 
-	_, err = Rotator(oldWriter, keyDir)
+	_, err = Rotator(context.Background(), active, keyDir, nil)
 	if err != nil {
 		t.Fatalf("Rotator failed: %v", err)
 	}
@@ -286,15 +275,14 @@ func TestRotatorHintFileGeneration(t *testing.T) {
 		t.Fatalf("Failed to create existing logs: %v", err)
 	}
 
-	file, err := os.OpenFile("data.txt", os.O_RDWR|os.O_APPEND, 0644)
+	active, err := OpenActive()
 	if err != nil {
 		t.Fatalf("Failed to open data.txt: %v", err)
 	}
-	oldWriter := bufio.NewWriter(file)
 
 	keyDir := createMockKeyDir(initialData)
 
-	_, err = Rotator(oldWriter, keyDir)
+	_, err = Rotator(context.Background(), active, keyDir, nil)
 	if err != nil {
 		t.Fatalf("Rotator failed: %v", err)
 	}
@@ -318,3 +306,54 @@ func TestRotatorHintFileGeneration(t *testing.T) {
 		}
 	}
 }
+
+func TestRotatorCancelledMerge(t *testing.T) {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	tempDir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(tempDir)
+	defer os.Chdir(oldDir)
+
+	initialData := []testEntry{
+		{flag: byte(types.FlagNormal), key: "key", value: []byte("value")},
+	}
+	if err := createDataFile("data.txt", initialData); err != nil {
+		t.Fatalf("Failed to create data.txt: %v", err)
+	}
+	if err := createExistingLogs(tempDir, MAX_IMMUTABLES); err != nil {
+		t.Fatalf("Failed to create existing logs: %v", err)
+	}
+
+	active, err := OpenActive()
+	if err != nil {
+		t.Fatalf("Failed to open data.txt: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err = Rotator(ctx, active, createMockKeyDir(initialData), func(MergeProgress) {
+		cancel()
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+
+	if count := countFiles("data_compacted_*.log"); count != 0 {
+		t.Errorf("Expected no compacted log installed, got %d", count)
+	}
+	if temps, _ := filepath.Glob(mergeTempPattern); len(temps) != 0 {
+		t.Errorf("Expected no merge temps left, got %v", temps)
+	}
+
+	manifest, err := LoadManifest()
+	if err != nil {
+		t.Fatalf("LoadManifest failed: %v", err)
+	}
+	if len(manifest.Files) != MAX_IMMUTABLES+1 {
+		t.Errorf("Expected %d immutables after rotation, got %d", MAX_IMMUTABLES+1, len(manifest.Files))
+	}
+	for _, meta := range manifest.Files {
+		if _, err := os.Stat(meta.Data); err != nil {
+			t.Errorf("Expected %s to survive the cancelled merge: %v", meta.Data, err)
+		}
+	}
+}
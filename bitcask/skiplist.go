@@ -0,0 +1,110 @@
+package bitcask
+
+import "math/rand/v2"
+
+// keys only, the keyDir map still holds the locations. level 0 is doubly
+// linked for reverse scans. not safe on its own, the keyDir lock covers it.
+const (
+	skipMaxLevel = 24
+	skipP        = 0.25
+)
+
+type skipNode struct {
+	key  string
+	next []*skipNode
+	prev *skipNode
+}
+
+type skiplist struct {
+	head  *skipNode
+	tail  *skipNode
+	level int
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{head: &skipNode{next: make([]*skipNode, skipMaxLevel)}, level: 1}
+}
+
+func randomLevel() int {
+	level := 1
+	for level < skipMaxLevel && rand.Float64() < skipP {
+		level++
+	}
+	return level
+}
+
+// the last node < key on every level.
+func (s *skiplist) preds(key string) [skipMaxLevel]*skipNode {
+	var update [skipMaxLevel]*skipNode
+	node := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].key < key {
+			node = node.next[i]
+		}
+		update[i] = node
+	}
+	return update
+}
+
+func (s *skiplist) insert(key string) {
+	update := s.preds(key)
+	if n := update[0].next[0]; n != nil && n.key == key {
+		return
+	}
+
+	level := randomLevel()
+	for i := s.level; i < level; i++ {
+		update[i] = s.head
+	}
+	s.level = max(s.level, level)
+
+	node := &skipNode{key: key, next: make([]*skipNode, level)}
+	for i := range level {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+	if update[0] != s.head {
+		node.prev = update[0]
+	}
+	if node.next[0] != nil {
+		node.next[0].prev = node
+	} else {
+		s.tail = node
+	}
+}
+
+func (s *skiplist) remove(key string) {
+	update := s.preds(key)
+	node := update[0].next[0]
+	if node == nil || node.key != key {
+		return
+	}
+	for i := range len(node.next) {
+		update[i].next[i] = node.next[i]
+	}
+	if node.next[0] != nil {
+		node.next[0].prev = node.prev
+	} else {
+		s.tail = node.prev
+	}
+	for s.level > 1 && s.head.next[s.level-1] == nil {
+		s.level--
+	}
+}
+
+// first node >= key.
+func (s *skiplist) seekGE(key string) *skipNode {
+	return s.preds(key)[0].next[0]
+}
+
+// last node < key, nil key means the last node.
+func (s *skiplist) seekLT(key []byte) *skipNode {
+	if key == nil {
+		return s.tail
+	}
+	pred := s.preds(string(key))[0]
+	if pred == s.head {
+		return nil
+	}
+	return pred
+}
@@ -3,18 +3,49 @@ package bitcask
 import (
 	"bufio"
 	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"time"
 
 	"github.com/pro0o/deslocado/types"
 )
 
-func Writer(writer *bufio.Writer, key, val []byte) error {
-	if err := writer.WriteByte(byte(types.FlagNormal)); err != nil {
-		return err
-	}
-	if err := binary.Write(writer, binary.BigEndian, uint32(len(key))); err != nil {
-		return err
-	}
-	if err := binary.Write(writer, binary.BigEndian, uint32(len(val))); err != nil {
+// flag | ts u64 | seq u64 | expiry u64 | bucketLen u16 | keyLen u32 | valLen u32 | bucket
+// ts & expiry are unix nanos, expiry 0 never expires. seq counts every
+// record of the store from 1, in write order. the default bucket is the
+// empty one.
+const recordHeaderSize = 1 + 8 + 8 + 8 + 2 + 4 + 4
+
+type recordHeader struct {
+	flag   types.RecordFlag
+	ts     int64
+	seq    uint64
+	expiry int64
+	bucket string
+	keyLen uint32
+	valLen uint32
+}
+
+// the whole record, header to value.
+func (h recordHeader) size() int64 {
+	return int64(recordHeaderSize+len(h.bucket)) + int64(h.keyLen) + int64(h.valLen)
+}
+
+func (h recordHeader) expired(now int64) bool {
+	return h.expiry != 0 && h.expiry <= now
+}
+
+func writeRecord(writer *bufio.Writer, h recordHeader, key, val []byte) error {
+	raw := make([]byte, 0, recordHeaderSize)
+	raw = append(raw, byte(h.flag))
+	raw = binary.BigEndian.AppendUint64(raw, uint64(h.ts))
+	raw = binary.BigEndian.AppendUint64(raw, h.seq)
+	raw = binary.BigEndian.AppendUint64(raw, uint64(h.expiry))
+	raw = binary.BigEndian.AppendUint16(raw, uint16(len(h.bucket)))
+	raw = binary.BigEndian.AppendUint32(raw, uint32(len(key)))
+	raw = binary.BigEndian.AppendUint32(raw, uint32(len(val)))
+	raw = append(raw, h.bucket...)
+	if _, err := writer.Write(raw); err != nil {
 		return err
 	}
 	if _, err := writer.Write(key); err != nil {
@@ -23,22 +54,51 @@ func Writer(writer *bufio.Writer, key, val []byte) error {
 	if _, err := writer.Write(val); err != nil {
 		return err
 	}
-
 	return nil
 }
 
+func Writer(writer *bufio.Writer, key, val []byte) error {
+	return WriterExpiring(writer, key, val, 0)
+}
+
+// expiry in unix nanos, 0 never expires.
+func WriterExpiring(writer *bufio.Writer, key, val []byte, expiry int64) error {
+	return writeRecord(writer, recordHeader{flag: types.FlagNormal, ts: time.Now().UnixNano(), expiry: expiry}, key, val)
+}
+
 func WriterTombstone(writer *bufio.Writer, key []byte) error {
-	if err := writer.WriteByte(byte(types.FlagTombstone)); err != nil {
-		return err
+	return writeRecord(writer, recordHeader{flag: types.FlagTombstone, ts: time.Now().UnixNano()}, key, nil)
+}
+
+// header | key | val, default bucket.
+func recordSize(key, val []byte) int64 {
+	return int64(recordHeaderSize + len(key) + len(val))
+}
+
+// index entries -> footer, indexOffset is where the records stopped.
+func writeSparseIndex(writer *bufio.Writer, index []indexEntry, indexOffset int64) error {
+	crc := crc32.NewIEEE()
+	summed := io.MultiWriter(writer, crc)
+	for _, entry := range index {
+		if err := binary.Write(summed, binary.BigEndian, uint32(len(entry.key))); err != nil {
+			return err
+		}
+		if _, err := summed.Write(entry.key); err != nil {
+			return err
+		}
+		if err := binary.Write(summed, binary.BigEndian, uint64(entry.offset)); err != nil {
+			return err
+		}
 	}
-	if err := binary.Write(writer, binary.BigEndian, uint32(len(key))); err != nil {
+
+	if err := binary.Write(summed, binary.BigEndian, uint64(indexOffset)); err != nil {
 		return err
 	}
-	if err := binary.Write(writer, binary.BigEndian, uint32(0)); err != nil {
+	if err := binary.Write(summed, binary.BigEndian, uint32(len(index))); err != nil {
 		return err
 	}
-	if _, err := writer.Write(key); err != nil {
+	if err := binary.Write(writer, binary.BigEndian, crc.Sum32()); err != nil {
 		return err
 	}
-	return nil
+	return binary.Write(writer, binary.BigEndian, footerMagic)
 }
@@ -1,7 +1,122 @@
 package main
 
-import "fmt"
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pro0o/deslocado/engine"
+	"github.com/pro0o/deslocado/resp"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const usage = `usage: deslocado serve [--resp addr] [--rotate-size bytes] [--rotate-every duration]
+
+serve    serves the store in the working dir over the redis protocol
+`
+
+// how often serve checks data.txt for a rotation.
+const rotateCheck = 10 * time.Second
 
 func main() {
-	fmt.Printf("hola madristas!!")
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	switch os.Args[1] {
+	case "serve":
+		if err := serve(os.Args[2:]); err != nil {
+			log.Fatal().Err(err).Msg("Serve failed!!")
+		}
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+// serves until SIGINT or SIGTERM, the store is closed after the server.
+func serve(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("resp", ":6380", "address the RESP server listens on")
+	size := fs.Int64("rotate-size", 64<<20, "rotate once data.txt holds this many bytes, 0 never")
+	every := fs.Duration("rotate-every", 0, "rotate a non-empty data.txt this often, 0 never")
+	fs.Parse(args)
+
+	// SCAN needs the keys in order.
+	db, err := engine.Open(engine.WithOrderedIndex())
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+	defer db.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// a rotation cut short by the shutdown is done before the db closes.
+	var rotating sync.WaitGroup
+	defer rotating.Wait()
+	rotateCtx, stopRotating := context.WithCancel(ctx)
+	defer stopRotating()
+	rotating.Add(1)
+	go func() {
+		defer rotating.Done()
+		rotate(rotateCtx, db, *size, *every)
+	}()
+
+	server := resp.NewServer(db)
+	done := make(chan error, 1)
+	go func() { done <- server.ListenAndServe(*addr) }()
+	log.Info().Str("addr", *addr).Msg("RESP server listening!!")
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+	log.Info().Msg("Shutting down!!")
+	server.Close()
+	if err := <-done; !errors.Is(err, resp.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// seals & merges data.txt once it grows past size or every so often, until
+// ctx is done. nothing else rotates a served store.
+func rotate(ctx context.Context, db *engine.DB, size int64, every time.Duration) {
+	if size <= 0 && every <= 0 {
+		return
+	}
+	ticker := time.NewTicker(rotateCheck)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		written := db.ActiveSize()
+		due := size > 0 && written >= size ||
+			every > 0 && written > 0 && time.Since(last) >= every
+		if !due {
+			continue
+		}
+		log.Info().Int64("size", written).Msg("Rotating data.txt!!")
+		if err := db.Rotate(ctx, nil); err != nil {
+			if ctx.Err() == nil {
+				log.Error().Err(err).Msg("Rotation failed!!")
+			}
+			continue
+		}
+		last = time.Now()
+	}
 }
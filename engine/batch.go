@@ -0,0 +1,67 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/pro0o/deslocado/bitcask"
+)
+
+// Batch collects writes across column families, DB.Write applies all of
+// them or none.
+type Batch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	family string
+	op     bitcask.BatchOp
+}
+
+// Put writes key in family, "" is the default family.
+func (b *Batch) Put(family string, key, val []byte) {
+	b.ops = append(b.ops, batchOp{family: family, op: bitcask.BatchOp{Key: key, Val: val}})
+}
+
+func (b *Batch) Delete(family string, key []byte) {
+	b.ops = append(b.ops, batchOp{family: family, op: bitcask.BatchOp{Key: key, Delete: true}})
+}
+
+// Write applies b atomically, a crash half way leaves no family with part
+// of it. a later op on the same key wins. returns the seq of the batch's
+// last write, 0 for an empty batch.
+func (db *DB) Write(b *Batch) (uint64, error) {
+	if len(b.ops) == 0 {
+		return 0, nil
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	fams := make([]*family, 0, len(b.ops))
+	ops := make([]bitcask.FamilyOp, 0, len(b.ops))
+	for _, bo := range b.ops {
+		f, err := db.lookup(bo.family)
+		if err != nil {
+			return 0, err
+		}
+		if err := checkKey("", bo.op.Key); err != nil {
+			return 0, err
+		}
+		fams = append(fams, f)
+		ops = append(ops, bitcask.FamilyOp{Family: f.active, BatchOp: bo.op})
+	}
+
+	locs, seqs, err := bitcask.WriteFamilyBatch(ops)
+	if err != nil {
+		return 0, fmt.Errorf("write batch: %w", err)
+	}
+	for i, op := range ops {
+		key := string(op.Key)
+		if op.Delete {
+			fams[i].keyDir.Delete(key)
+		} else {
+			fams[i].keyDir.Put(key, locs[i])
+		}
+		fams[i].changed("", op.Key, op.Val, 0, op.Delete, seqs[i])
+	}
+	return db.active.LastSeq(), nil
+}
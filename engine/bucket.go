@@ -0,0 +1,88 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var ErrInvalidBucket = errors.New("invalid bucket name")
+
+// Bucket is a named key space sharing the store's files & merges. the
+// bucket's name goes into every record it writes, keys of different
+// buckets never collide.
+type Bucket struct {
+	db   *DB
+	name string
+}
+
+// Bucket needs no setup, a bucket exists once something is written to it.
+// names are non-empty, at most 64KiB & hold no \x00.
+func (db *DB) Bucket(name string) (*Bucket, error) {
+	if name == "" || len(name) > 0xffff || strings.Contains(name, "\x00") {
+		return nil, fmt.Errorf("bucket %q: %w", name, ErrInvalidBucket)
+	}
+	return &Bucket{db: db, name: name}, nil
+}
+
+func (b *Bucket) Name() string {
+	return b.name
+}
+
+func (b *Bucket) Get(key []byte) ([]byte, error) {
+	b.db.mu.RLock()
+	defer b.db.mu.RUnlock()
+	return b.db.getIn(b.name, key)
+}
+
+func (b *Bucket) Put(key, val []byte) (uint64, error) {
+	b.db.mu.Lock()
+	defer b.db.mu.Unlock()
+	return b.db.putIn(b.name, key, val, 0)
+}
+
+func (b *Bucket) PutExpiring(key, val []byte, expiry time.Time) (uint64, error) {
+	b.db.mu.Lock()
+	defer b.db.mu.Unlock()
+	return b.db.putIn(b.name, key, val, expiry.UnixNano())
+}
+
+func (b *Bucket) Delete(key []byte) (uint64, error) {
+	b.db.mu.Lock()
+	defer b.db.mu.Unlock()
+	return b.db.deleteIn(b.name, key)
+}
+
+// Keys is DB.Keys for this bucket.
+func (b *Bucket) Keys() [][]byte {
+	return b.db.keysIn(b.name)
+}
+
+// Fold is DB.Fold for this bucket.
+func (b *Bucket) Fold(fn func(key, val []byte) error) error {
+	return b.db.foldIn(b.name, fn)
+}
+
+// Len is how many keys the bucket holds, expired ones a merge hasn't
+// dropped yet included.
+func (b *Bucket) Len() int {
+	return b.db.keyDir.Count(b.name)
+}
+
+// DropBucket deletes every key of bucket with one record, returns how many
+// keys it held & the record's seq, like every other write. the bucket can
+// be written to again right after.
+func (db *DB) DropBucket(name string) (int, uint64, error) {
+	if _, err := db.Bucket(name); err != nil {
+		return 0, 0, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.active.DropBucket(name); err != nil {
+		return 0, 0, fmt.Errorf("drop bucket %q: %w", name, err)
+	}
+	db.indexDropBucket(name)
+	return db.keyDir.DropBucket(name), db.active.LastSeq(), nil
+}
@@ -0,0 +1,110 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestBuckets(t *testing.T) {
+	db := openTestDB(t)
+	users, err := db.Bucket("users")
+	if err != nil {
+		t.Fatalf("Bucket failed: %v", err)
+	}
+	flags, err := db.Bucket("flags")
+	if err != nil {
+		t.Fatalf("Bucket failed: %v", err)
+	}
+	for _, name := range []string{"", "a\x00b"} {
+		if _, err := db.Bucket(name); !errors.Is(err, ErrInvalidBucket) {
+			t.Errorf("Bucket %q: expected ErrInvalidBucket, got %v", name, err)
+		}
+	}
+	if _, err := db.Put([]byte("\x00users\x00a"), []byte("x")); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Expected ErrInvalidKey, got %v", err)
+	}
+
+	// the same key in three key spaces.
+	mustPut(t, db, "a", "default")
+	for bucket, val := range map[*Bucket]string{users: "user", flags: "flag"} {
+		if _, err := bucket.Put([]byte("a"), []byte(val)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if _, err := users.Put([]byte("b"), []byte("2")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, err := flags.Delete([]byte("a")); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := db.Rotate(context.Background(), nil); err != nil {
+		t.Fatalf("Rotate failed: %v", err)
+	}
+
+	if val, err := db.Get([]byte("a")); err != nil || string(val) != "default" {
+		t.Errorf("Expected a=default, got %q (%v)", val, err)
+	}
+	if val, err := users.Get([]byte("a")); err != nil || string(val) != "user" {
+		t.Errorf("Expected users a=user, got %q (%v)", val, err)
+	}
+	if _, err := flags.Get([]byte("a")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected flags a deleted, got %v", err)
+	}
+	if users.Len() != 2 || flags.Len() != 0 {
+		t.Errorf("Expected 2 users & 0 flags, got %d & %d", users.Len(), flags.Len())
+	}
+	if keys := db.Keys(); len(keys) != 1 || string(keys[0]) != "a" {
+		t.Errorf("Expected the default bucket to hold only a, got %q", keys)
+	}
+	var folded []string
+	if err := users.Fold(func(key, val []byte) error {
+		folded = append(folded, string(key)+"="+string(val))
+		return nil
+	}); err != nil {
+		t.Fatalf("Fold failed: %v", err)
+	}
+	if strings.Join(folded, ",") != "a=user,b=2" {
+		t.Errorf("Expected a=user,b=2, got %v", folded)
+	}
+
+	before := db.LastSeq()
+	if n, seq, err := db.DropBucket("users"); err != nil || n != 2 || seq != before+1 {
+		t.Fatalf("Expected 2 keys dropped at seq %d, got %d at %d (%v)", before+1, n, seq, err)
+	}
+	if _, err := users.Put([]byte("c"), []byte("3")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	// the drop survives a reopen & the merge of every file.
+	check := func(when string) {
+		t.Helper()
+		users, _ := db.Bucket("users")
+		if _, err := users.Get([]byte("a")); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: expected users a dropped, got %v", when, err)
+		}
+		if val, err := users.Get([]byte("c")); err != nil || string(val) != "3" {
+			t.Errorf("%s: expected users c=3, got %q (%v)", when, val, err)
+		}
+		if val, err := db.Get([]byte("a")); err != nil || string(val) != "default" {
+			t.Errorf("%s: expected a=default, got %q (%v)", when, val, err)
+		}
+		if users.Len() != 1 {
+			t.Errorf("%s: expected 1 user, got %d", when, users.Len())
+		}
+	}
+	check("before reopen")
+	db.Close()
+	if db, err = Open(); err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer db.Close()
+	check("after reopen")
+	for range 2 {
+		if err := db.Rotate(context.Background(), nil); err != nil {
+			t.Fatalf("Rotate failed: %v", err)
+		}
+	}
+	check("after merge")
+}
@@ -0,0 +1,97 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/pro0o/deslocado/bitcask"
+	"github.com/pro0o/deslocado/types"
+)
+
+var (
+	// ErrCompacted means a merge already took the position in, the consumer
+	// has to start over from a fresh copy.
+	ErrCompacted = bitcask.ErrCompacted
+	ErrClosed    = errors.New("db is closed")
+)
+
+// Change is one committed write, read back from the data files. Seq is the
+// one the write returned, other families' writes leave gaps. Op is OpPut,
+// OpDelete or OpDropBucket, a drop has no key.
+type Change struct {
+	Seq    uint64
+	Op     Op
+	Bucket string
+	Key    []byte
+	Val    []byte
+	Expiry int64
+}
+
+// ChangeReader replays a family's writes in commit order. unlike Watch it
+// survives restarts: a consumer keeps the last Seq it handled & resumes
+// past it.
+type ChangeReader struct {
+	db *DB
+	f  *family
+	r  *bitcask.ChangeReader
+}
+
+// Changes replays the default family from seq from on, 0 being the start.
+// immutables no merge took in yet are read too, a from older than the last
+// merge is ErrCompacted.
+func (db *DB) Changes(from uint64) (*ChangeReader, error) {
+	return db.changes(bitcask.Family{}, from)
+}
+
+// Changes is DB.Changes on this family.
+func (c *Family) Changes(from uint64) (*ChangeReader, error) {
+	return c.db.changes(bitcask.Family{Name: c.name}, from)
+}
+
+func (db *DB) changes(spec bitcask.Family, from uint64) (*ChangeReader, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+	f, err := db.lookup(spec.Name)
+	if err != nil {
+		return nil, err
+	}
+	r, err := spec.Changes(from)
+	if err != nil {
+		return nil, err
+	}
+	return &ChangeReader{db: db, f: f, r: r}, nil
+}
+
+// Next returns the next change, io.EOF once it caught up. call it again
+// later for whatever was written since.
+func (r *ChangeReader) Next() (Change, error) {
+	// the lock keeps rotations out while the reader moves between files &
+	// writes out data.txt's buffer, the reader sees the file only.
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	if r.db.closed {
+		return Change{}, ErrClosed
+	}
+	if err := r.f.active.Flush(); err != nil {
+		return Change{}, fmt.Errorf("flush %s: %w", r.f.active.Path(), err)
+	}
+	c, err := r.r.Next()
+	if err != nil {
+		return Change{}, err
+	}
+	change := Change{Seq: c.Seq, Op: OpPut, Bucket: c.Bucket, Key: c.Key, Val: c.Val, Expiry: c.Expiry}
+	switch c.Flag {
+	case types.FlagTombstone:
+		change.Op, change.Val = OpDelete, nil
+	case types.FlagDropBucket:
+		change.Op, change.Key, change.Val = OpDropBucket, nil, nil
+	}
+	return change, nil
+}
+
+func (r *ChangeReader) Close() error {
+	return r.r.Close()
+}
@@ -0,0 +1,129 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+)
+
+// every change up to io.EOF.
+func drain(t *testing.T, r *ChangeReader) []Change {
+	t.Helper()
+	var changes []Change
+	for {
+		c, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return changes
+		} else if err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		changes = append(changes, c)
+	}
+}
+
+func TestChanges(t *testing.T) {
+	db := openTestDB(t)
+	r, err := db.Changes(0)
+	if err != nil {
+		t.Fatalf("Changes failed: %v", err)
+	}
+	defer r.Close()
+
+	mustPut(t, db, "a", "1")
+	mustPut(t, db, "b", "2")
+	if _, err := db.Delete([]byte("a")); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	// the reader is in data.txt, it has to follow it into the immutable.
+	if got := drain(t, r); len(got) != 3 {
+		t.Fatalf("Got %d changes before the rotation, want 3", len(got))
+	}
+	if err := db.Rotate(context.Background(), nil); err != nil {
+		t.Fatalf("Rotate failed: %v", err)
+	}
+	tx := db.Begin()
+	tx.Put([]byte("c"), []byte("3"))
+	if _, err := tx.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	bucket, _ := db.Bucket("x")
+	if _, err := bucket.Put([]byte("k"), []byte("v")); err != nil {
+		t.Fatalf("Bucket Put failed: %v", err)
+	}
+	if _, _, err := db.DropBucket("x"); err != nil {
+		t.Fatalf("DropBucket failed: %v", err)
+	}
+
+	// the batch header takes seq 4 but isn't a change.
+	want := []struct {
+		seq    uint64
+		op     Op
+		bucket string
+		key    string
+	}{
+		{5, OpPut, "", "c"},
+		{6, OpPut, "x", "k"},
+		{7, OpDropBucket, "x", ""},
+	}
+	got := drain(t, r)
+	if len(got) != len(want) {
+		t.Fatalf("Got %d changes after the rotation, want %d: %+v", len(got), len(want), got)
+	}
+	for i, w := range want {
+		c := got[i]
+		if c.Seq != w.seq || c.Op != w.op || c.Bucket != w.bucket || string(c.Key) != w.key {
+			t.Errorf("Change %d = {%d %s %q %q}, want {%d %s %q %q}", i, c.Seq, c.Op, c.Bucket, c.Key, w.seq, w.op, w.bucket, w.key)
+		}
+	}
+
+	// resuming reads the immutable again from the middle.
+	resumed, err := db.Changes(3)
+	if err != nil {
+		t.Fatalf("Changes(3) failed: %v", err)
+	}
+	got = drain(t, resumed)
+	resumed.Close()
+	if len(got) != 4 || got[0].Seq != 3 || got[0].Op != OpDelete || string(got[0].Key) != "a" {
+		t.Errorf("Resumed at 3 got %+v", got)
+	}
+
+	// seqs carry on after a restart.
+	r.Close()
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	db, err = Open()
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	mustPut(t, db, "d", "4")
+	after, err := db.Changes(8)
+	if err != nil {
+		t.Fatalf("Changes(8) failed: %v", err)
+	}
+	if got := drain(t, after); len(got) != 1 || got[0].Seq != 8 || string(got[0].Key) != "d" {
+		t.Errorf("After reopen got %+v, want d at seq 8", got)
+	}
+	after.Close()
+
+	// the third immutable triggers a merge of all of them.
+	for range 2 {
+		if err := db.Rotate(context.Background(), nil); err != nil {
+			t.Fatalf("Rotate failed: %v", err)
+		}
+	}
+	if _, err := db.Changes(8); !errors.Is(err, ErrCompacted) {
+		t.Errorf("Changes(8) after the merge = %v, want ErrCompacted", err)
+	}
+	mustPut(t, db, "e", "5")
+	fresh, err := db.Changes(9)
+	if err != nil {
+		t.Fatalf("Changes(9) failed: %v", err)
+	}
+	defer fresh.Close()
+	if got := drain(t, fresh); len(got) != 1 || got[0].Seq != 9 || string(got[0].Key) != "e" {
+		t.Errorf("After the merge got %+v, want e at seq 9", got)
+	}
+}
@@ -0,0 +1,133 @@
+package engine
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// conditions are checked & applied under the write lock, nothing can slip in
+// between. each call reports whether its condition held.
+
+// GetVersion returns the value & its version, the seq of the record that
+// wrote it. seqs are store wide, so every write gets a new, higher one
+// across rotations & reopens whatever the clock does.
+func (db *DB) GetVersion(key []byte) ([]byte, int64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	val, version, found, err := db.current(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !found {
+		return nil, 0, ErrNotFound
+	}
+	return val, version, nil
+}
+
+func (db *DB) PutIfAbsent(key, val []byte) (bool, error) {
+	return db.putIf(key, val, 0, false)
+}
+
+// PutIfPresent writes val only if key currently holds a value.
+func (db *DB) PutIfPresent(key, val []byte) (bool, error) {
+	return db.putIf(key, val, 0, true)
+}
+
+// PutExpiringIfAbsent is PutIfAbsent for a value that reads as missing from
+// expiry on.
+func (db *DB) PutExpiringIfAbsent(key, val []byte, expiry time.Time) (bool, error) {
+	return db.putIf(key, val, expiry.UnixNano(), false)
+}
+
+// PutExpiringIfPresent is PutIfPresent for a value that reads as missing
+// from expiry on.
+func (db *DB) PutExpiringIfPresent(key, val []byte, expiry time.Time) (bool, error) {
+	return db.putIf(key, val, expiry.UnixNano(), true)
+}
+
+// writes val only if key's presence matches present.
+func (db *DB) putIf(key, val []byte, expiry int64, present bool) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	_, _, found, err := db.current(key)
+	if err != nil || found != present {
+		return false, err
+	}
+	_, err = db.putExpiring(key, val, expiry)
+	return true, err
+}
+
+// CompareAndSwap writes val only if key currently holds old.
+func (db *DB) CompareAndSwap(key, old, val []byte) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	cur, _, found, err := db.current(key)
+	if err != nil || !found || !bytes.Equal(cur, old) {
+		return false, err
+	}
+	_, err = db.put(key, val)
+	return true, err
+}
+
+// CompareVersionAndSwap writes val only if key is still at version.
+func (db *DB) CompareVersionAndSwap(key []byte, version int64, val []byte) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	_, cur, found, err := db.current(key)
+	if err != nil || !found || cur != version {
+		return false, err
+	}
+	_, err = db.put(key, val)
+	return true, err
+}
+
+// DeleteIfMatch deletes key only if it currently holds val.
+func (db *DB) DeleteIfMatch(key, val []byte) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	cur, _, found, err := db.current(key)
+	if err != nil || !found || !bytes.Equal(cur, val) {
+		return false, err
+	}
+	_, err = db.delete(key)
+	return true, err
+}
+
+// DeleteIfPresent deletes key only if it currently holds a value, a missing
+// key gets no tombstone.
+func (db *DB) DeleteIfPresent(key []byte) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	_, _, found, err := db.current(key)
+	if err != nil || !found {
+		return false, err
+	}
+	_, err = db.delete(key)
+	return true, err
+}
+
+// live value & version of key, lock held. an expired value is absent.
+func (db *DB) current(key []byte) ([]byte, int64, bool, error) {
+	if err := checkKey("", key); err != nil {
+		return nil, 0, false, err
+	}
+	loc, ok := db.keyDir.Get(string(key))
+	if !ok {
+		return nil, 0, false, nil
+	}
+	rec, err := db.read(loc)
+	if errors.Is(err, ErrNotFound) {
+		return nil, 0, false, nil
+	} else if err != nil {
+		return nil, 0, false, fmt.Errorf("read %q: %w", key, err)
+	}
+	return rec.Val, int64(rec.Seq), true, nil
+}
@@ -0,0 +1,89 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestConditionalWrites(t *testing.T) {
+	db := openTestDB(t)
+
+	if ok, err := db.PutIfAbsent([]byte("leader"), []byte("node-1")); err != nil || !ok {
+		t.Fatalf("Expected the first claim to win, got %v (%v)", ok, err)
+	}
+	if ok, _ := db.PutIfAbsent([]byte("leader"), []byte("node-2")); ok {
+		t.Error("Expected the second claim to lose")
+	}
+
+	if ok, _ := db.CompareAndSwap([]byte("leader"), []byte("node-2"), []byte("node-3")); ok {
+		t.Error("Expected a swap on the wrong value to fail")
+	}
+	if ok, err := db.CompareAndSwap([]byte("leader"), []byte("node-1"), []byte("node-3")); err != nil || !ok {
+		t.Fatalf("Expected a swap on the current value, got %v (%v)", ok, err)
+	}
+
+	val, version, err := db.GetVersion([]byte("leader"))
+	if err != nil || string(val) != "node-3" {
+		t.Fatalf("Expected leader=node-3, got %q (%v)", val, err)
+	}
+
+	// versions survive rotations & merges.
+	for range 3 {
+		if err := db.Rotate(context.Background(), nil); err != nil {
+			t.Fatalf("Rotate failed: %v", err)
+		}
+		mustPut(t, db, "filler", "x")
+	}
+	if _, moved, _ := db.GetVersion([]byte("leader")); moved != version {
+		t.Errorf("Expected version %d after a merge, got %d", version, moved)
+	}
+
+	if ok, err := db.CompareVersionAndSwap([]byte("leader"), version, []byte("node-4")); err != nil || !ok {
+		t.Fatalf("Expected a swap at the current version, got %v (%v)", ok, err)
+	}
+	if ok, _ := db.CompareVersionAndSwap([]byte("leader"), version, []byte("node-5")); ok {
+		t.Error("Expected a swap at a stale version to fail")
+	}
+	if _, newer, _ := db.GetVersion([]byte("leader")); newer <= version {
+		t.Errorf("Expected a higher version after a write, got %d <= %d", newer, version)
+	}
+	// the version is the write's seq.
+	seq, err := db.Put([]byte("other"), []byte("v"))
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, v, _ := db.GetVersion([]byte("other")); v != int64(seq) {
+		t.Errorf("Expected version %d, the put's seq, got %d", seq, v)
+	}
+
+	if ok, _ := db.DeleteIfMatch([]byte("leader"), []byte("node-3")); ok {
+		t.Error("Expected a delete on the wrong value to fail")
+	}
+	if ok, err := db.DeleteIfMatch([]byte("leader"), []byte("node-4")); err != nil || !ok {
+		t.Fatalf("Expected a delete on the current value, got %v (%v)", ok, err)
+	}
+	if ok, _ := db.PutIfAbsent([]byte("leader"), []byte("node-6")); !ok {
+		t.Error("Expected a claim after the delete to win")
+	}
+
+	if ok, _ := db.PutIfPresent([]byte("missing"), []byte("x")); ok {
+		t.Error("Expected a replace of a missing key to fail")
+	}
+	if ok, err := db.PutExpiringIfPresent([]byte("leader"), []byte("node-7"), time.Now().Add(time.Hour)); err != nil || !ok {
+		t.Fatalf("Expected a replace of the current value, got %v (%v)", ok, err)
+	}
+	if expiry, err := db.Expiry([]byte("leader")); err != nil || time.Until(expiry) <= 0 {
+		t.Errorf("Expected leader to expire in the future, got %v (%v)", expiry, err)
+	}
+	if ok, err := db.DeleteIfPresent([]byte("leader")); err != nil || !ok {
+		t.Fatalf("Expected a delete of the current value, got %v (%v)", ok, err)
+	}
+	if ok, _ := db.DeleteIfPresent([]byte("leader")); ok {
+		t.Error("Expected a second delete to find nothing")
+	}
+	if _, err := db.Expiry([]byte("leader")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected no expiry for a deleted key, got %v", err)
+	}
+}
@@ -0,0 +1,318 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pro0o/deslocado/bitcask"
+	"github.com/pro0o/deslocado/types"
+)
+
+var (
+	ErrNotFound = errors.New("key not found")
+	// ErrInvalidKey is a default bucket key starting with \x00, the keyDir
+	// keeps named buckets' keys there.
+	ErrInvalidKey = errors.New("invalid key")
+)
+
+// DB is the store in the working dir. writes & rotations take the lock,
+// reads share it, a merge runs without it. rotating keeps rotations one at
+// a time & is taken before mu. epoch counts seals & merge installs.
+// the embedded family is the default one, named families sit in families.
+type DB struct {
+	mu       sync.RWMutex
+	rotating sync.Mutex
+	family
+	epoch    uint64
+	families map[string]*family
+	hub      hub
+	closed   bool
+}
+
+// Option tunes Open.
+type Option func(*options)
+
+type options struct {
+	ordered  bool
+	families []bitcask.Family
+}
+
+// WithOrderedIndex keeps keys sorted as well, Scan needs it.
+func WithOrderedIndex() Option {
+	return func(o *options) { o.ordered = true }
+}
+
+// recover -> keyDir from the hints -> data.txt on top, for every family.
+func Open(opts ...Option) (*DB, error) {
+	o := options{families: []bitcask.Family{{}}}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	db := &DB{families: make(map[string]*family)}
+	for _, spec := range o.families {
+		f, err := openFamily(spec, o.ordered)
+		if err != nil {
+			db.closeFamilies()
+			return nil, err
+		}
+		if spec.Name == "" {
+			db.family = *f
+			db.family.hub = &db.hub
+		} else {
+			db.families[spec.Name] = f
+		}
+	}
+	// one seq across every family, past the newest any of them recovered.
+	for _, f := range db.families {
+		f.active.ShareSeq(db.active)
+	}
+	return db, nil
+}
+
+// LastSeq is the seq of the newest write committed to any family.
+func (db *DB) LastSeq() uint64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.active.LastSeq()
+}
+
+// ActiveSize is how many bytes data.txt holds since its last seal, what a
+// size based rotation goes by.
+func (db *DB) ActiveSize() int64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.active.Size()
+}
+
+func openFamily(spec bitcask.Family, ordered bool) (*family, error) {
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	if err := spec.Recover(); err != nil {
+		return nil, fmt.Errorf("recover: %w", err)
+	}
+	entries, err := spec.BuildKeyDir()
+	if err != nil {
+		return nil, fmt.Errorf("build keyDir: %w", err)
+	}
+	keyDir := bitcask.NewKeyDir(entries)
+	if ordered {
+		keyDir = bitcask.NewOrderedKeyDir(entries)
+	}
+
+	active, err := spec.OpenActive()
+	if err != nil {
+		return nil, err
+	}
+	active.LoadInto(keyDir)
+	return &family{active: active, keyDir: keyDir}, nil
+}
+
+// indexes are saved before data.txt closes, so they match the files.
+func (db *DB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.closed = true
+	db.hub.close()
+	err := db.saveIndexes()
+	if cerr := db.closeFamilies(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// first error wins, every family gets closed regardless.
+func (db *DB) closeFamilies() error {
+	var first error
+	for _, f := range db.all() {
+		if f.active == nil {
+			continue
+		}
+		if err := f.active.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Put returns the write's seq, like every other write. seqs grow across
+// every family & bucket, in commit order.
+func (db *DB) Put(key, val []byte) (uint64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.put(key, val)
+}
+
+// PutExpiring writes a value that reads as missing from expiry on.
+func (db *DB) PutExpiring(key, val []byte, expiry time.Time) (uint64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.putExpiring(key, val, expiry.UnixNano())
+}
+
+func (db *DB) Delete(key []byte) (uint64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.delete(key)
+}
+
+func (db *DB) put(key, val []byte) (uint64, error) {
+	return db.putExpiring(key, val, 0)
+}
+
+func (db *DB) putExpiring(key, val []byte, expiry int64) (uint64, error) {
+	return db.putIn("", key, val, expiry)
+}
+
+func (db *DB) delete(key []byte) (uint64, error) {
+	return db.deleteIn("", key)
+}
+
+func (db *DB) Get(key []byte) ([]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.getIn("", key)
+}
+
+// Expiry returns when key's value reads as missing, the zero time if it
+// never expires.
+func (db *DB) Expiry(key []byte) (time.Time, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if err := checkKey("", key); err != nil {
+		return time.Time{}, err
+	}
+	loc, ok := db.keyDir.Get(string(key))
+	if !ok {
+		return time.Time{}, ErrNotFound
+	}
+	rec, err := db.read(loc)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if rec.Expiry == 0 {
+		return time.Time{}, nil
+	}
+	return time.Unix(0, rec.Expiry), nil
+}
+
+// Len is how many keys the default bucket holds, expired ones a merge
+// hasn't dropped yet included.
+func (db *DB) Len() int {
+	return db.keyDir.Count("")
+}
+
+func checkKey(bucket string, key []byte) error {
+	if bucket == "" && len(key) > 0 && key[0] == 0 {
+		return fmt.Errorf("key %q: %w", key, ErrInvalidKey)
+	}
+	return nil
+}
+
+// live record at loc, lock held.
+func (db *DB) read(loc types.FileOffset) (bitcask.Record, error) {
+	return db.family.read(loc)
+}
+
+// data.txt is read through the active file, a write may still sit in its
+// buffer.
+func (f *family) read(loc types.FileOffset) (bitcask.Record, error) {
+	if loc.FileID != f.active.FileID() {
+		return readAt(loc)
+	}
+	rec, err := f.active.ReadRecord(loc.Offset)
+	if err != nil {
+		return bitcask.Record{}, fmt.Errorf("read %s@%d: %w", loc.FileID, loc.Offset, err)
+	}
+	return liveRecord(rec)
+}
+
+// loc may be in any family, its FileID carries the family's dir.
+func readAt(loc types.FileOffset) (bitcask.Record, error) {
+	file, err := os.Open(loc.FileID)
+	if err != nil {
+		return bitcask.Record{}, fmt.Errorf("open %s: %w", loc.FileID, err)
+	}
+	defer file.Close()
+	return readRecord(file, loc)
+}
+
+// seals the default family's data.txt & merges once enough immutables
+// pile up.
+func (db *DB) Rotate(ctx context.Context, progress bitcask.ProgressFunc) error {
+	return db.rotate(&db.family, ctx, progress)
+}
+
+// seals under the lock, merges without it & takes it back to install, reads
+// & writes go on meanwhile. both moves the keyDir sees bump the epoch when
+// f is the default family, the one transactions run on.
+func (db *DB) rotate(f *family, ctx context.Context, progress bitcask.ProgressFunc) error {
+	db.rotating.Lock()
+	defer db.rotating.Unlock()
+
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return ErrClosed
+	}
+	r, err := bitcask.Seal(ctx, f.active)
+	if err != nil {
+		db.mu.Unlock()
+		return err
+	}
+	defer r.Close()
+	f.active = r.Active
+	if f == &db.family {
+		db.epoch++
+	}
+	db.mu.Unlock()
+
+	if err := r.Merge(ctx, progress); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	// closed mid-merge, the merge is dropped.
+	if db.closed {
+		return ErrClosed
+	}
+	if err := r.Install(ctx, f.keyDir); err != nil {
+		return err
+	}
+	if f == &db.family {
+		db.epoch++
+	}
+	return nil
+}
+
+// the keyDir only points at live values, a tombstone or an expired value
+// there means it went stale.
+func readRecord(file *os.File, loc types.FileOffset) (bitcask.Record, error) {
+	rec, err := bitcask.ReadRecordAt(file, loc.Offset)
+	if err != nil {
+		return bitcask.Record{}, fmt.Errorf("read %s@%d: %w", loc.FileID, loc.Offset, err)
+	}
+	return liveRecord(rec)
+}
+
+func liveRecord(rec bitcask.Record) (bitcask.Record, error) {
+	if rec.Flag == types.FlagTombstone || rec.Expired(time.Now().UnixNano()) {
+		return bitcask.Record{}, ErrNotFound
+	}
+	return rec, nil
+}
+
+func readValue(file *os.File, loc types.FileOffset) ([]byte, error) {
+	rec, err := readRecord(file, loc)
+	if err != nil {
+		return nil, err
+	}
+	return rec.Val, nil
+}
@@ -0,0 +1,444 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pro0o/deslocado/bitcask"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func openTestDB(t *testing.T) *DB {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	tempDir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(tempDir)
+	t.Cleanup(func() { os.Chdir(oldDir) })
+
+	db, err := Open()
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func mustPut(t *testing.T, db *DB, key, val string) {
+	t.Helper()
+	if _, err := db.Put([]byte(key), []byte(val)); err != nil {
+		t.Fatalf("Put %s failed: %v", key, err)
+	}
+}
+
+func TestDBReopen(t *testing.T) {
+	db := openTestDB(t)
+	mustPut(t, db, "a", "1")
+	mustPut(t, db, "b", "2")
+	if err := db.Rotate(context.Background(), nil); err != nil {
+		t.Fatalf("Rotate failed: %v", err)
+	}
+	mustPut(t, db, "a", "3")
+	if _, err := db.Delete([]byte("b")); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	db.Close()
+
+	db, err := Open()
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer db.Close()
+	if val, err := db.Get([]byte("a")); err != nil || string(val) != "3" {
+		t.Errorf("Expected a=3, got %q (%v)", val, err)
+	}
+	if _, err := db.Get([]byte("b")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected b deleted, got %v", err)
+	}
+}
+
+func TestReopenWithoutHint(t *testing.T) {
+	db := openTestDB(t)
+	mustPut(t, db, "a", "1")
+	if err := db.Rotate(context.Background(), nil); err != nil {
+		t.Fatalf("Rotate failed: %v", err)
+	}
+	db.Close()
+
+	// a crash before the hint got written.
+	if err := os.Remove("data_000001.hint"); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	db, err := Open()
+	if err != nil {
+		t.Fatalf("Open without the hint failed: %v", err)
+	}
+	defer db.Close()
+	if val, err := db.Get([]byte("a")); err != nil || string(val) != "1" {
+		t.Errorf("Expected a=1, got %q (%v)", val, err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	db := openTestDB(t)
+	mustPut(t, db, "a", "1")
+	mustPut(t, db, "b", "2")
+
+	snap, err := db.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+
+	mustPut(t, db, "a", "changed")
+	mustPut(t, db, "c", "new")
+	if _, err := db.Delete([]byte("b")); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	// rotate until a merge drops the file the snapshot reads from.
+	for i := range 3 {
+		if err := db.Rotate(context.Background(), nil); err != nil {
+			t.Fatalf("Rotate %d failed: %v", i, err)
+		}
+		mustPut(t, db, "filler", "x")
+	}
+	sealed := "data_000001.log"
+	if _, err := os.Stat(sealed); err != nil {
+		t.Fatalf("Expected %s pinned by the snapshot, got %v", sealed, err)
+	}
+
+	expected := map[string]string{"a": "1", "b": "2"}
+	for key, want := range expected {
+		if val, err := snap.Get([]byte(key)); err != nil || string(val) != want {
+			t.Errorf("Snapshot %s: expected %q, got %q (%v)", key, want, val, err)
+		}
+	}
+	if _, err := snap.Get([]byte("c")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected c invisible to the snapshot, got %v", err)
+	}
+
+	var seen []string
+	if err := snap.Iterate(func(key, val []byte) error {
+		seen = append(seen, string(key)+"="+string(val))
+		return nil
+	}); err != nil {
+		t.Fatalf("Iterate failed: %v", err)
+	}
+	if len(seen) != 2 || seen[0] != "a=1" || seen[1] != "b=2" {
+		t.Errorf("Expected [a=1 b=2], got %v", seen)
+	}
+
+	if val, err := db.Get([]byte("a")); err != nil || string(val) != "changed" {
+		t.Errorf("Expected the db to see a=changed, got %q (%v)", val, err)
+	}
+
+	snap.Release()
+	if _, err := os.Stat(sealed); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected %s deleted on release, got %v", sealed, err)
+	}
+	if _, err := snap.Get([]byte("a")); !errors.Is(err, ErrSnapshotReleased) {
+		t.Errorf("Expected ErrSnapshotReleased, got %v", err)
+	}
+	if logs, _ := filepath.Glob("data_*.log"); len(logs) != 1 || logs[0] != "data_compacted_000004.log" {
+		t.Errorf("Expected only the compacted log left, got %v", logs)
+	}
+}
+
+func TestSeq(t *testing.T) {
+	db := openTestDB(t)
+	db.Close()
+	open := func() *DB {
+		t.Helper()
+		db, err := Open(WithFamily("hot", 0))
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		return db
+	}
+	db = open()
+	hot, _ := db.Family("hot")
+	users, _ := db.Bucket("users")
+
+	// every kind of write gets a seq past the one before, in any family.
+	var seqs []uint64
+	record := func(seq uint64, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		seqs = append(seqs, seq)
+	}
+	record(db.Put([]byte("a"), []byte("1")))
+	record(hot.Put([]byte("a"), []byte("2")))
+	record(users.Put([]byte("a"), []byte("3")))
+	record(db.Delete([]byte("a")))
+	tx := db.Begin()
+	tx.Put([]byte("b"), []byte("4"))
+	tx.Put([]byte("c"), []byte("5"))
+	record(tx.Commit())
+	var b Batch
+	b.Put("", []byte("d"), []byte("6"))
+	b.Put("hot", []byte("d"), []byte("7"))
+	record(db.Write(&b))
+	if err := db.Rotate(context.Background(), nil); err != nil {
+		t.Fatalf("Rotate failed: %v", err)
+	}
+	record(hot.Put([]byte("e"), []byte("8")))
+
+	for i := 1; i < len(seqs); i++ {
+		if seqs[i] <= seqs[i-1] {
+			t.Fatalf("Seqs not increasing: %v", seqs)
+		}
+	}
+	last := seqs[len(seqs)-1]
+	if db.LastSeq() != last {
+		t.Errorf("LastSeq = %d, want %d", db.LastSeq(), last)
+	}
+	snap, err := db.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	if snap.Seq() != last {
+		t.Errorf("Snapshot Seq = %d, want %d", snap.Seq(), last)
+	}
+	snap.Release()
+
+	// the newest write was to hot, the default family picks up past it.
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	db = open()
+	defer db.Close()
+	seq, err := db.Put([]byte("f"), []byte("9"))
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if seq != last+1 {
+		t.Errorf("Seq after reopen = %d, want %d", seq, last+1)
+	}
+}
+
+func TestReadYourWrites(t *testing.T) {
+	db := openTestDB(t)
+	big := make([]byte, 10000)
+	for i := range 50 {
+		key := []byte("k")
+		val := append(big[:i*200], byte(i))
+		if _, err := db.Put(key, val); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		got, err := db.Get(key)
+		if err != nil {
+			t.Fatalf("Get right after Put %d failed: %v", i, err)
+		}
+		if len(got) != len(val) || got[len(got)-1] != byte(i) {
+			t.Fatalf("Get right after Put %d read a stale value", i)
+		}
+	}
+	if _, err := db.Delete([]byte("k")); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := db.Get([]byte("k")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get right after Delete = %v, want ErrNotFound", err)
+	}
+
+	// small writes sit in data.txt's buffer, the file doesn't have them.
+	info, err := os.Stat("data.txt")
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	mustPut(t, db, "small", "v")
+	if after, _ := os.Stat("data.txt"); after.Size() != info.Size() {
+		t.Fatalf("Expected the put unflushed, data.txt grew by %d", after.Size()-info.Size())
+	}
+	if val, err := db.Get([]byte("small")); err != nil || string(val) != "v" {
+		t.Errorf("Get of an unflushed put = %q (%v), want v", val, err)
+	}
+	// the size a rotation goes by counts it.
+	if size := db.ActiveSize(); size <= info.Size() {
+		t.Errorf("ActiveSize = %d, want past the %d bytes on disk", size, info.Size())
+	}
+}
+
+func TestRotateKeepsLocations(t *testing.T) {
+	db := openTestDB(t)
+	mustPut(t, db, "a", "1")
+	mustPut(t, db, "b", "2")
+	// one sealed file, below the merge threshold -> keyDir isn't rebuilt.
+	if err := db.Rotate(context.Background(), nil); err != nil {
+		t.Fatalf("Rotate failed: %v", err)
+	}
+	if size := db.ActiveSize(); size != 0 {
+		t.Errorf("ActiveSize after rotate = %d, want 0", size)
+	}
+	mustPut(t, db, "c", "3")
+	check := func(when string) {
+		t.Helper()
+		for key, want := range map[string]string{"a": "1", "b": "2", "c": "3"} {
+			if val, err := db.Get([]byte(key)); err != nil || string(val) != want {
+				t.Errorf("%s: Get %s = %q (%v), want %s", when, key, val, err, want)
+			}
+		}
+	}
+	check("after rotate")
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	var err error
+	db, err = Open()
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	defer db.Close()
+	check("after reopen")
+}
+
+func TestValueEndingLikeAFooter(t *testing.T) {
+	db := openTestDB(t)
+	// the sealed log ends in the footer magic, "deslocad".
+	mustPut(t, db, "b", "i really love deslocad")
+	if err := db.Rotate(context.Background(), nil); err != nil {
+		t.Fatalf("Rotate failed: %v", err)
+	}
+	r, err := db.Changes(0)
+	if err != nil {
+		t.Fatalf("Changes failed: %v", err)
+	}
+	if got := drain(t, r); len(got) != 1 || string(got[0].Val) != "i really love deslocad" {
+		t.Errorf("Changes = %+v, want the one put", got)
+	}
+	r.Close()
+
+	// a broken hint is rebuilt from the log.
+	db.Close()
+	os.WriteFile("data_000001.hint", []byte("junk"), 0644)
+	db, err = Open()
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	for range 2 {
+		if err := db.Rotate(context.Background(), nil); err != nil {
+			t.Fatalf("Rotate failed: %v", err)
+		}
+	}
+	if val, err := db.Get([]byte("b")); err != nil || string(val) != "i really love deslocad" {
+		t.Errorf("Get after the merge = %q (%v)", val, err)
+	}
+}
+
+func TestLegacyGet(t *testing.T) {
+	db := openTestDB(t)
+	if _, err := db.PutExpiring([]byte("k"), []byte("v"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("PutExpiring failed: %v", err)
+	}
+	if err := db.Rotate(context.Background(), nil); err != nil {
+		t.Fatalf("Rotate failed: %v", err)
+	}
+	db.Close()
+
+	keyDir, err := bitcask.BuildKeyDir()
+	if err != nil {
+		t.Fatalf("BuildKeyDir failed: %v", err)
+	}
+	if val, err := Get(keyDir, "k"); err != nil || val != "v" {
+		t.Errorf("Get = %q (%v), want v", val, err)
+	}
+}
+
+func TestWritesDuringMerge(t *testing.T) {
+	db := openTestDB(t)
+	mustPut(t, db, "a", "1")
+	mustPut(t, db, "b", "2")
+	mustPut(t, db, "c", "3")
+	for range bitcask.MAX_IMMUTABLES - 1 {
+		if err := db.Rotate(context.Background(), nil); err != nil {
+			t.Fatalf("Rotate failed: %v", err)
+		}
+	}
+
+	// the merge holds no lock, writes & reads go through while it runs.
+	var once bool
+	progress := func(bitcask.MergeProgress) {
+		if once {
+			return
+		}
+		once = true
+		done := make(chan error, 1)
+		go func() {
+			if _, err := db.Put([]byte("b"), []byte("new")); err != nil {
+				done <- err
+				return
+			}
+			if _, err := db.Delete([]byte("c")); err != nil {
+				done <- err
+				return
+			}
+			_, err := db.Get([]byte("a"))
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Write during the merge failed: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Writes blocked behind the merge")
+		}
+	}
+	if err := db.Rotate(context.Background(), progress); err != nil {
+		t.Fatalf("Rotate failed: %v", err)
+	}
+	if !once {
+		t.Fatal("Expected the rotation to merge")
+	}
+
+	check := func(when string) {
+		t.Helper()
+		if val, err := db.Get([]byte("a")); err != nil || string(val) != "1" {
+			t.Errorf("%s: Get a = %q (%v), want 1", when, val, err)
+		}
+		if val, err := db.Get([]byte("b")); err != nil || string(val) != "new" {
+			t.Errorf("%s: Get b = %q (%v), want the write made during the merge", when, val, err)
+		}
+		if _, err := db.Get([]byte("c")); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: Get c = %v, want ErrNotFound", when, err)
+		}
+	}
+	check("after the merge")
+	db.Close()
+	var err error
+	db, err = Open()
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	defer db.Close()
+	check("after reopen")
+}
+
+func TestLegacyGetAfterMerge(t *testing.T) {
+	db := openTestDB(t)
+	mustPut(t, db, "k", "v")
+	if err := db.Rotate(context.Background(), nil); err != nil {
+		t.Fatalf("Rotate failed: %v", err)
+	}
+	keyDir, err := bitcask.BuildKeyDir()
+	if err != nil {
+		t.Fatalf("BuildKeyDir failed: %v", err)
+	}
+	// the merge removes data_000001.log, data.txt holds something else by
+	// then.
+	for range bitcask.MAX_IMMUTABLES - 1 {
+		if err := db.Rotate(context.Background(), nil); err != nil {
+			t.Fatalf("Rotate failed: %v", err)
+		}
+	}
+	mustPut(t, db, "other", "x")
+	if _, err := Get(keyDir, "k"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Get off a merged file = %v, want ErrNotExist", err)
+	}
+}
@@ -0,0 +1,173 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pro0o/deslocado/bitcask"
+)
+
+var ErrNoFamily = errors.New("no such column family")
+
+// one set of files & the keyDir over them. every method expects the db
+// lock held.
+type family struct {
+	active  *bitcask.Active
+	keyDir  *bitcask.KeyDir
+	indexes map[string]*index
+	// only the default family is watched.
+	hub *hub
+}
+
+// WithFamily opens the column family name next to the default one, with
+// its own files & merge threshold. maxImmutables 0 keeps the default
+// threshold, name "" tunes the default family itself.
+func WithFamily(name string, maxImmutables int) Option {
+	return func(o *options) {
+		spec := bitcask.Family{Name: name, MaxImmutables: maxImmutables}
+		for i := range o.families {
+			if o.families[i].Name == name {
+				o.families[i] = spec
+				return
+			}
+		}
+		o.families = append(o.families, spec)
+	}
+}
+
+// writes stay in data.txt's buffer, reads get them off the active file.
+// returns the write's seq.
+func (f *family) putIn(bucket string, key, val []byte, expiry int64) (uint64, error) {
+	if err := checkKey(bucket, key); err != nil {
+		return 0, err
+	}
+	loc, err := f.active.PutIn(bucket, key, val, expiry)
+	if err != nil {
+		return 0, fmt.Errorf("put %q: %w", key, err)
+	}
+	seq := f.active.LastSeq()
+	f.keyDir.Put(bitcask.BucketKey(bucket, key), loc)
+	f.changed(bucket, key, val, expiry, false, seq)
+	return seq, nil
+}
+
+func (f *family) deleteIn(bucket string, key []byte) (uint64, error) {
+	if err := checkKey(bucket, key); err != nil {
+		return 0, err
+	}
+	if err := f.active.DeleteIn(bucket, key); err != nil {
+		return 0, fmt.Errorf("delete %q: %w", key, err)
+	}
+	seq := f.active.LastSeq()
+	f.keyDir.Delete(bitcask.BucketKey(bucket, key))
+	f.changed(bucket, key, nil, 0, true, seq)
+	return seq, nil
+}
+
+func (f *family) getIn(bucket string, key []byte) ([]byte, error) {
+	if err := checkKey(bucket, key); err != nil {
+		return nil, err
+	}
+	loc, ok := f.keyDir.Get(bitcask.BucketKey(bucket, key))
+	if !ok {
+		return nil, ErrNotFound
+	}
+	rec, err := f.read(loc)
+	if err != nil {
+		return nil, err
+	}
+	return rec.Val, nil
+}
+
+// keeps indexes & watchers in step with a committed write, seq is its
+// record's.
+func (f *family) changed(bucket string, key, val []byte, expiry int64, deleted bool, seq uint64) {
+	op := OpPut
+	if deleted {
+		op = OpDelete
+		f.indexDelete(bucket, key)
+	} else {
+		f.indexPut(bucket, key, val)
+	}
+	if f.hub != nil && bucket == "" {
+		f.hub.publish(op, key, val, expiry, seq)
+	}
+}
+
+// the default family first.
+func (db *DB) all() []*family {
+	all := []*family{&db.family}
+	for _, f := range db.families {
+		all = append(all, f)
+	}
+	return all
+}
+
+// "" is the default family.
+func (db *DB) lookup(name string) (*family, error) {
+	if name == "" {
+		return &db.family, nil
+	}
+	f, ok := db.families[name]
+	if !ok {
+		return nil, fmt.Errorf("family %q: %w", name, ErrNoFamily)
+	}
+	return f, nil
+}
+
+// Family is a handle on one column family. it shares the db's lock, only
+// the files & merges are its own.
+type Family struct {
+	db   *DB
+	name string
+	f    *family
+}
+
+// Family looks up a family opened with WithFamily.
+func (db *DB) Family(name string) (*Family, error) {
+	f, err := db.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return &Family{db: db, name: name, f: f}, nil
+}
+
+func (c *Family) Name() string {
+	return c.name
+}
+
+func (c *Family) Get(key []byte) ([]byte, error) {
+	c.db.mu.RLock()
+	defer c.db.mu.RUnlock()
+	return c.f.getIn("", key)
+}
+
+func (c *Family) Put(key, val []byte) (uint64, error) {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	return c.f.putIn("", key, val, 0)
+}
+
+func (c *Family) PutExpiring(key, val []byte, expiry time.Time) (uint64, error) {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	return c.f.putIn("", key, val, expiry.UnixNano())
+}
+
+func (c *Family) Delete(key []byte) (uint64, error) {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	return c.f.deleteIn("", key)
+}
+
+func (c *Family) Len() int {
+	return c.f.keyDir.Count("")
+}
+
+// Rotate seals the family's data.txt & merges it once the family's own
+// threshold is reached, other families aren't touched.
+func (c *Family) Rotate(ctx context.Context, progress bitcask.ProgressFunc) error {
+	return c.db.rotate(c.f, ctx, progress)
+}
@@ -0,0 +1,94 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestFamilies(t *testing.T) {
+	db := openTestDB(t)
+	db.Close()
+	open := func() *DB {
+		t.Helper()
+		db, err := Open(WithFamily("hot", 1), WithFamily("archive", 0))
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		return db
+	}
+	db = open()
+	if _, err := db.Family("missing"); !errors.Is(err, ErrNoFamily) {
+		t.Errorf("Expected ErrNoFamily, got %v", err)
+	}
+	if _, err := Open(WithFamily("../escape", 0)); err == nil {
+		t.Error("Expected a family name with a separator to be rejected")
+	}
+	hot, _ := db.Family("hot")
+	archive, _ := db.Family("archive")
+
+	// the same key in three families.
+	mustPut(t, db, "k", "default")
+	if _, err := hot.Put([]byte("k"), []byte("hot")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, err := archive.Put([]byte("k"), []byte("archive")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	var b Batch
+	b.Put("hot", []byte("x"), []byte("1"))
+	b.Put("archive", []byte("x"), []byte("2"))
+	b.Delete("", []byte("k"))
+	if _, err := db.Write(&b); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	var bad Batch
+	bad.Put("hot", []byte("y"), []byte("1"))
+	bad.Put("missing", []byte("y"), []byte("1"))
+	if _, err := db.Write(&bad); !errors.Is(err, ErrNoFamily) {
+		t.Errorf("Expected ErrNoFamily, got %v", err)
+	}
+
+	// hot merges on every rotation, archive keeps its sealed file.
+	for _, f := range []*Family{hot, archive} {
+		if err := f.Rotate(context.Background(), nil); err != nil {
+			t.Fatalf("Rotate %s failed: %v", f.Name(), err)
+		}
+	}
+	if n, _ := filepath.Glob(filepath.Join("families", "hot", "data_compacted_*.log")); len(n) != 1 {
+		t.Errorf("Expected hot merged, got %v", n)
+	}
+	if n, _ := filepath.Glob(filepath.Join("families", "archive", "data_0*.log")); len(n) != 1 {
+		t.Errorf("Expected archive sealed but not merged, got %v", n)
+	}
+	if n, _ := filepath.Glob("data_*.log"); len(n) != 0 {
+		t.Errorf("Expected the default family not rotated, got %v", n)
+	}
+
+	check := func(when string) {
+		t.Helper()
+		hot, _ := db.Family("hot")
+		archive, _ := db.Family("archive")
+		for _, c := range []struct {
+			f         *Family
+			key, want string
+		}{{hot, "k", "hot"}, {hot, "x", "1"}, {archive, "k", "archive"}, {archive, "x", "2"}} {
+			if val, err := c.f.Get([]byte(c.key)); err != nil || string(val) != c.want {
+				t.Errorf("%s: expected %s %s=%s, got %q (%v)", when, c.f.Name(), c.key, c.want, val, err)
+			}
+		}
+		if _, err := db.Get([]byte("k")); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: expected default k deleted by the batch, got %v", when, err)
+		}
+		if _, err := hot.Get([]byte("y")); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: expected the failed batch to write nothing, got %v", when, err)
+		}
+	}
+	check("before reopen")
+	db.Close()
+	db = open()
+	defer db.Close()
+	check("after reopen")
+}
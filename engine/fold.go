@@ -0,0 +1,92 @@
+package engine
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/pro0o/deslocado/bitcask"
+	"github.com/pro0o/deslocado/types"
+)
+
+// Keys lists every live, non-expired key of the default bucket in key
+// order. it only reads the keyDir, no data file is touched.
+func (db *DB) Keys() [][]byte {
+	return db.keysIn("")
+}
+
+func (db *DB) keysIn(bucket string) [][]byte {
+	now := time.Now().UnixNano()
+	var keys [][]byte
+	for k, loc := range db.keyDir.Snapshot() {
+		if b, key := bitcask.SplitBucketKey(k); b == bucket && !loc.Expired(now) {
+			keys = append(keys, []byte(key))
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+	return keys
+}
+
+// Fold calls fn for every live, non-expired entry of the default bucket as
+// of the call. it runs on a snapshot, so fn may write to the db. an error
+// from fn stops the fold & comes back as is.
+func (db *DB) Fold(fn func(key, val []byte) error) error {
+	return db.foldIn("", fn)
+}
+
+func (db *DB) foldIn(bucket string, fn func(key, val []byte) error) error {
+	snap, err := db.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+	return snap.foldIn(bucket, fn)
+}
+
+// Fold walks the snapshot's default bucket file by file, offsets ascending,
+// so values are read sequentially. key order is whatever falls out of that.
+func (s *Snapshot) Fold(fn func(key, val []byte) error) error {
+	return s.foldIn("", fn)
+}
+
+func (s *Snapshot) foldIn(bucket string, fn func(key, val []byte) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pin == nil {
+		return ErrSnapshotReleased
+	}
+
+	now := time.Now().UnixNano()
+	type entry struct {
+		key string
+		loc types.FileOffset
+	}
+	entries := make([]entry, 0, len(s.entries))
+	for k, loc := range s.entries {
+		if b, key := bitcask.SplitBucketKey(k); b == bucket && !loc.Expired(now) {
+			entries = append(entries, entry{key: key, loc: loc})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].loc.FileID != entries[j].loc.FileID {
+			return entries[i].loc.FileID < entries[j].loc.FileID
+		}
+		return entries[i].loc.Offset < entries[j].loc.Offset
+	})
+
+	for _, e := range entries {
+		val, err := readValue(s.files[e.loc.FileID], e.loc)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := fn([]byte(e.key), val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
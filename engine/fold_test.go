@@ -0,0 +1,60 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeysAndFold(t *testing.T) {
+	db := openTestDB(t)
+	mustPut(t, db, "z", "1")
+	mustPut(t, db, "y", "2")
+	if err := db.Rotate(context.Background(), nil); err != nil {
+		t.Fatalf("Rotate failed: %v", err)
+	}
+	mustPut(t, db, "x", "3")
+	mustPut(t, db, "w", "4")
+	db.Delete([]byte("w"))
+	if _, err := db.PutExpiring([]byte("old"), []byte("5"), time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("PutExpiring failed: %v", err)
+	}
+	if _, err := db.PutExpiring([]byte("later"), []byte("6"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("PutExpiring failed: %v", err)
+	}
+
+	var keys []string
+	for _, key := range db.Keys() {
+		keys = append(keys, string(key))
+	}
+	if strings.Join(keys, ",") != "later,x,y,z" {
+		t.Errorf("Expected keys later,x,y,z, got %v", keys)
+	}
+
+	// the sealed file before data.txt, which is named after the file it
+	// gets sealed as, offsets ascending in each.
+	var folded []string
+	if err := db.Fold(func(key, val []byte) error {
+		folded = append(folded, string(key)+"="+string(val))
+		// a write from inside the fold doesn't block or show up.
+		_, err := db.Put([]byte("during_"+string(key)), val)
+		return err
+	}); err != nil {
+		t.Fatalf("Fold failed: %v", err)
+	}
+	if strings.Join(folded, ",") != "z=1,y=2,x=3,later=6" {
+		t.Errorf("Expected file/offset order z,y,x,later, got %v", folded)
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err := db.Fold(func(key, val []byte) error {
+		calls++
+		return stop
+	})
+	if !errors.Is(err, stop) || calls != 1 {
+		t.Errorf("Expected the fold to stop after one call with stop, got %d calls (%v)", calls, err)
+	}
+}
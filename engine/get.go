@@ -1,43 +1,39 @@
 package engine
 
 import (
-	"encoding/binary"
 	"fmt"
-	"io"
 	"os"
+	"time"
 
+	"github.com/pro0o/deslocado/bitcask"
 	"github.com/pro0o/deslocado/types"
 )
 
 // fetch keydir
-// seek the offset to curr file offset
-// read key & set offset -> val
+// read the record at the offset, the reader knows the header layout
 // return val
 func Get(keyDir map[string]types.FileOffset, key string) (string, error) {
 	fileOffset, ok := keyDir[key]
 	if !ok {
 		return "", fmt.Errorf("key not found")
 	}
+	// the keyDir comes off the hints, every entry is in a sealed file. one a
+	// merge removed since is gone, not somewhere else.
 	file, err := os.Open(fileOffset.FileID)
 	if err != nil {
-		return "", fmt.Errorf("file not found from hint")
+		return "", fmt.Errorf("file not found from hint: %w", err)
 	}
-	file.Seek(fileOffset.Offset, io.SeekStart)
-	flag := make([]byte, 1)
-	file.Read(flag)
-	if flag[0] == byte(types.FlagTombstone) {
+	defer file.Close()
+
+	rec, err := bitcask.ReadRecordAt(file, fileOffset.Offset)
+	if err != nil {
+		return "", fmt.Errorf("read %s@%d: %w", fileOffset.FileID, fileOffset.Offset, err)
+	}
+	if rec.Flag == types.FlagTombstone {
 		return "", fmt.Errorf("the kv entry was deleted")
 	}
-
-	var keyLen, valLen uint32
-	binary.Read(file, binary.BigEndian, &keyLen)
-	binary.Read(file, binary.BigEndian, &valLen)
-
-	file.Seek(int64(keyLen), io.SeekCurrent)
-
-	valBuffer := make([]byte, valLen)
-	io.ReadFull(file, valBuffer)
-
-	file.Close()
-	return string(valBuffer), nil
+	if rec.Expired(time.Now().UnixNano()) {
+		return "", fmt.Errorf("the kv entry has expired")
+	}
+	return string(rec.Val), nil
 }
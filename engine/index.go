@@ -0,0 +1,354 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pro0o/deslocado/bitcask"
+	"github.com/pro0o/deslocado/types"
+)
+
+var (
+	ErrNoIndex = errors.New("no such index")
+	ErrIndex   = errors.New("invalid index")
+)
+
+// Extractor derives the secondary keys of one value, none is fine.
+type Extractor func(key, val []byte) [][]byte
+
+// IndexHit is one secondary key & the primary key it points at.
+type IndexHit struct {
+	Value []byte
+	Key   []byte
+}
+
+// secondary -> primary pairs kept sorted, one key per pair in an ordered
+// keyDir: escaped secondary | \x00\x00 | primary. a \x00 in the secondary
+// becomes \x00\xff, so the order & prefixes of secondaries carry over.
+// byKey remembers what each primary key was indexed under, for updates.
+type index struct {
+	name    string
+	bucket  string
+	extract Extractor
+	pairs   *bitcask.KeyDir
+	byKey   map[string][]string
+}
+
+func escapeIndex(value []byte) []byte {
+	out := make([]byte, 0, len(value)+2)
+	for _, b := range value {
+		out = append(out, b)
+		if b == 0 {
+			out = append(out, 0xff)
+		}
+	}
+	return out
+}
+
+func indexPair(value, key []byte) string {
+	return string(append(append(escapeIndex(value), 0, 0), key...))
+}
+
+func splitIndexPair(pair string) ([]byte, []byte) {
+	var value []byte
+	for i := 0; i < len(pair); i++ {
+		if pair[i] != 0 {
+			value = append(value, pair[i])
+			continue
+		}
+		if i+1 < len(pair) && pair[i+1] == 0 {
+			return value, []byte(pair[i+2:])
+		}
+		value = append(value, 0)
+		i++
+	}
+	return value, nil
+}
+
+func (ix *index) add(key, val []byte) {
+	ix.remove(key)
+	var pairs []string
+	for _, value := range ix.extract(key, val) {
+		pair := indexPair(value, key)
+		ix.pairs.Put(pair, types.FileOffset{})
+		pairs = append(pairs, pair)
+	}
+	if len(pairs) > 0 {
+		ix.byKey[string(key)] = pairs
+	}
+}
+
+func (ix *index) remove(key []byte) {
+	for _, pair := range ix.byKey[string(key)] {
+		ix.pairs.Delete(pair)
+	}
+	delete(ix.byKey, string(key))
+}
+
+// hits under prefix, in secondary then primary key order.
+func (ix *index) hits(prefix string) []IndexHit {
+	entries, _, _ := ix.pairs.Range(bitcask.PrefixRange([]byte(prefix)))
+	hits := make([]IndexHit, 0, len(entries))
+	for _, entry := range entries {
+		value, key := splitIndexPair(entry.Key)
+		hits = append(hits, IndexHit{Value: value, Key: key})
+	}
+	return hits
+}
+
+// keeps the family's indexes in step with a write, lock held.
+func (f *family) indexPut(bucket string, key, val []byte) {
+	for _, ix := range f.indexes {
+		if ix.bucket == bucket {
+			ix.add(key, val)
+		}
+	}
+}
+
+func (f *family) indexDelete(bucket string, key []byte) {
+	for _, ix := range f.indexes {
+		if ix.bucket == bucket {
+			ix.remove(key)
+		}
+	}
+}
+
+func (f *family) indexDropBucket(bucket string) {
+	for _, ix := range f.indexes {
+		if ix.bucket == bucket {
+			ix.pairs = bitcask.NewOrderedKeyDir(nil)
+			ix.byKey = make(map[string][]string)
+		}
+	}
+}
+
+// CreateIndex registers extract on bucket, "" being the default bucket,
+// & keeps it up to date on every write from then on. the index comes back
+// from index_<name>.idx if the data files haven't changed since Close saved
+// it, else it's rebuilt from the values. an extractor that changes needs a
+// new name.
+func (db *DB) CreateIndex(name, bucket string, extract Extractor) error {
+	if name == "" || filepath.Base(name) != name || name == "." || name == ".." {
+		return fmt.Errorf("index %q: %w", name, ErrIndex)
+	}
+	if bucket != "" {
+		if _, err := db.Bucket(bucket); err != nil {
+			return err
+		}
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.indexes[name]; ok {
+		return fmt.Errorf("index %q already exists: %w", name, ErrIndex)
+	}
+
+	ix := &index{name: name, bucket: bucket, extract: extract, pairs: bitcask.NewOrderedKeyDir(nil), byKey: make(map[string][]string)}
+	fingerprint, err := db.fingerprint()
+	if err != nil {
+		return err
+	}
+	if loaded, err := ix.load(fingerprint); err != nil || !loaded {
+		ix.pairs, ix.byKey = bitcask.NewOrderedKeyDir(nil), make(map[string][]string)
+		if err := db.buildIndex(ix); err != nil {
+			return fmt.Errorf("build index %q: %w", name, err)
+		}
+	}
+	if db.indexes == nil {
+		db.indexes = make(map[string]*index)
+	}
+	db.indexes[name] = ix
+	return nil
+}
+
+// CreateIndex is DB.CreateIndex on this bucket.
+func (b *Bucket) CreateIndex(name string, extract Extractor) error {
+	return b.db.CreateIndex(name, b.name, extract)
+}
+
+// every live value of the bucket through the extractor, lock held.
+func (db *DB) buildIndex(ix *index) error {
+	now := time.Now().UnixNano()
+	for k, loc := range db.keyDir.Snapshot() {
+		bucket, key := bitcask.SplitBucketKey(k)
+		if bucket != ix.bucket || loc.Expired(now) {
+			continue
+		}
+		rec, err := db.read(loc)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		ix.add([]byte(key), rec.Val)
+	}
+	return nil
+}
+
+// IndexLookup returns the keys whose value indexes to value, in key order.
+// expired & deleted keys are left out.
+func (db *DB) IndexLookup(name string, value []byte) ([][]byte, error) {
+	hits, err := db.indexHits(name, indexPair(value, nil))
+	if err != nil {
+		return nil, err
+	}
+	keys := make([][]byte, 0, len(hits))
+	for _, hit := range hits {
+		keys = append(keys, hit.Key)
+	}
+	return keys, nil
+}
+
+// IndexPrefix returns every hit whose secondary key starts with prefix.
+func (db *DB) IndexPrefix(name string, prefix []byte) ([]IndexHit, error) {
+	return db.indexHits(name, string(escapeIndex(prefix)))
+}
+
+func (db *DB) indexHits(name, prefix string) ([]IndexHit, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	ix, ok := db.indexes[name]
+	if !ok {
+		return nil, fmt.Errorf("index %q: %w", name, ErrNoIndex)
+	}
+
+	now := time.Now().UnixNano()
+	var live []IndexHit
+	for _, hit := range ix.hits(prefix) {
+		loc, ok := db.keyDir.Get(bitcask.BucketKey(ix.bucket, hit.Key))
+		if ok && !loc.Expired(now) {
+			live = append(live, hit)
+		}
+	}
+	return live, nil
+}
+
+// the default family's data files & their sizes, every write or merge
+// changes it. write lock held, data.txt's buffer goes out first.
+func (db *DB) fingerprint() (uint64, error) {
+	if err := db.active.Flush(); err != nil {
+		return 0, fmt.Errorf("flush %s: %w", db.active.Path(), err)
+	}
+	manifest, err := bitcask.LoadManifest()
+	if err != nil {
+		return 0, err
+	}
+	paths := []string{db.active.Path()}
+	for _, meta := range manifest.Files {
+		paths = append(paths, meta.Data)
+	}
+	sort.Strings(paths)
+
+	h := fnv.New64a()
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return 0, fmt.Errorf("stat %s: %w", path, err)
+		}
+		fmt.Fprintf(h, "%s:%d;", path, info.Size())
+	}
+	return h.Sum64(), nil
+}
+
+func indexFile(name string) string {
+	return "index_" + name + ".idx"
+}
+
+// pairs | count u32 | fingerprint u64 | crc32 u32
+// pair: len u32 | pair
+// the crc covers everything before it, like a hint.
+func (ix *index) save(fingerprint uint64) error {
+	tmp := indexFile(ix.name) + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("create %s: %w", tmp, err)
+	}
+	crc := crc32.NewIEEE()
+	writer := bufio.NewWriter(io.MultiWriter(file, crc))
+
+	entries, _, _ := ix.pairs.Range(bitcask.KeyRange{})
+	for _, entry := range entries {
+		binary.Write(writer, binary.BigEndian, uint32(len(entry.Key)))
+		writer.WriteString(entry.Key)
+	}
+	binary.Write(writer, binary.BigEndian, uint32(len(entries)))
+	binary.Write(writer, binary.BigEndian, fingerprint)
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return fmt.Errorf("write %s: %w", tmp, err)
+	}
+	if err := binary.Write(file, binary.BigEndian, crc.Sum32()); err != nil {
+		file.Close()
+		return fmt.Errorf("write %s: %w", tmp, err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("sync %s: %w", tmp, err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("close %s: %w", tmp, err)
+	}
+	return os.Rename(tmp, indexFile(ix.name))
+}
+
+// false when there's no file or it's from other data files, a damaged
+// file is an error.
+func (ix *index) load(fingerprint uint64) (bool, error) {
+	raw, err := os.ReadFile(indexFile(ix.name))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if len(raw) < 16 {
+		return false, fmt.Errorf("%s: %w: too short", indexFile(ix.name), ErrIndex)
+	}
+	body := raw[:len(raw)-4]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(raw[len(raw)-4:]) {
+		return false, fmt.Errorf("%s: %w: checksum mismatch", indexFile(ix.name), ErrIndex)
+	}
+	if binary.BigEndian.Uint64(body[len(body)-8:]) != fingerprint {
+		return false, nil
+	}
+	count := binary.BigEndian.Uint32(body[len(body)-12:])
+
+	reader := bytes.NewReader(body[:len(body)-12])
+	for range count {
+		var n uint32
+		if err := binary.Read(reader, binary.BigEndian, &n); err != nil || int(n) > reader.Len() {
+			return false, fmt.Errorf("%s: %w: bad pair", indexFile(ix.name), ErrIndex)
+		}
+		pair := make([]byte, n)
+		io.ReadFull(reader, pair)
+		ix.pairs.Put(string(pair), types.FileOffset{})
+		_, key := splitIndexPair(string(pair))
+		ix.byKey[string(key)] = append(ix.byKey[string(key)], string(pair))
+	}
+	return true, nil
+}
+
+// lock held, before data.txt gets closed.
+func (db *DB) saveIndexes() error {
+	if len(db.indexes) == 0 {
+		return nil
+	}
+	fingerprint, err := db.fingerprint()
+	if err != nil {
+		return err
+	}
+	for _, ix := range db.indexes {
+		if err := ix.save(fingerprint); err != nil {
+			return fmt.Errorf("save index %q: %w", ix.name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package engine
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+// user values look like "name|email".
+func byEmail(calls *int) Extractor {
+	return func(key, val []byte) [][]byte {
+		*calls++
+		_, email, ok := bytes.Cut(val, []byte("|"))
+		if !ok {
+			return nil
+		}
+		return [][]byte{email}
+	}
+}
+
+func lookup(t *testing.T, db *DB, name, value string) string {
+	t.Helper()
+	keys, err := db.IndexLookup(name, []byte(value))
+	if err != nil {
+		t.Fatalf("IndexLookup failed: %v", err)
+	}
+	return string(bytes.Join(keys, []byte(",")))
+}
+
+func TestSecondaryIndex(t *testing.T) {
+	db := openTestDB(t)
+	mustPut(t, db, "u1", "ana|ana@x.io")
+	mustPut(t, db, "u2", "bo|bo@y.io")
+
+	var calls int
+	if err := db.CreateIndex("email", "", byEmail(&calls)); err != nil {
+		t.Fatalf("CreateIndex failed: %v", err)
+	}
+	if err := db.CreateIndex("email", "", byEmail(&calls)); !errors.Is(err, ErrIndex) {
+		t.Errorf("Expected a second email index to fail, got %v", err)
+	}
+	if _, err := db.IndexLookup("missing", nil); !errors.Is(err, ErrNoIndex) {
+		t.Errorf("Expected ErrNoIndex, got %v", err)
+	}
+
+	mustPut(t, db, "u3", "cy|ana@x.io")
+	mustPut(t, db, "u2", "bo|bo@x.io")
+	mustPut(t, db, "u4", "di|d\x00@z.io")
+	if got := lookup(t, db, "email", "ana@x.io"); got != "u1,u3" {
+		t.Errorf("Expected u1,u3, got %q", got)
+	}
+	if got := lookup(t, db, "email", "bo@y.io"); got != "" {
+		t.Errorf("Expected the old email of u2 gone, got %q", got)
+	}
+	if got := lookup(t, db, "email", "d\x00@z.io"); got != "u4" {
+		t.Errorf("Expected u4, got %q", got)
+	}
+	if _, err := db.Delete([]byte("u1")); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	tx := db.Begin()
+	tx.Put([]byte("u5"), []byte("ed|ed@x.io"))
+	if _, err := tx.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+
+	hits, err := db.IndexPrefix("email", []byte("b"))
+	if err != nil {
+		t.Fatalf("IndexPrefix failed: %v", err)
+	}
+	if len(hits) != 1 || string(hits[0].Value) != "bo@x.io" || string(hits[0].Key) != "u2" {
+		t.Errorf("Expected bo@x.io -> u2, got %q", hits)
+	}
+	hits, _ = db.IndexPrefix("email", nil)
+	var all []string
+	for _, hit := range hits {
+		all = append(all, fmt.Sprintf("%s=%s", hit.Value, hit.Key))
+	}
+	want := []string{"ana@x.io=u3", "bo@x.io=u2", "d\x00@z.io=u4", "ed@x.io=u5"}
+	if !slices.Equal(all, want) {
+		t.Errorf("Expected %q, got %q", want, all)
+	}
+
+	// a bucket index only sees its bucket.
+	users, _ := db.Bucket("users")
+	if _, err := users.Put([]byte("u9"), []byte("zz|ana@x.io")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := users.CreateIndex("users_email", byEmail(&calls)); err != nil {
+		t.Fatalf("CreateIndex failed: %v", err)
+	}
+	if got := lookup(t, db, "users_email", "ana@x.io"); got != "u9" {
+		t.Errorf("Expected u9 in the bucket index, got %q", got)
+	}
+	if got := lookup(t, db, "email", "ana@x.io"); got != "u3" {
+		t.Errorf("Expected only u3 in the store index, got %q", got)
+	}
+
+	// nothing changed since Close, the saved index is used as is.
+	reopen := func() {
+		t.Helper()
+		db.Close()
+		var err error
+		if db, err = Open(); err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+	}
+	reopen()
+	calls = 0
+	if err := db.CreateIndex("email", "", byEmail(&calls)); err != nil {
+		t.Fatalf("CreateIndex failed: %v", err)
+	}
+	if calls != 0 {
+		t.Errorf("Expected the saved index loaded, extractor ran %d times", calls)
+	}
+	if got := lookup(t, db, "email", "ana@x.io"); got != "u3" {
+		t.Errorf("Expected u3 after reopen, got %q", got)
+	}
+
+	// a write the index never saw -> rebuilt from the values.
+	reopen()
+	mustPut(t, db, "u6", "fy|ana@x.io")
+	reopen()
+	defer db.Close()
+	if err := db.CreateIndex("email", "", byEmail(&calls)); err != nil {
+		t.Fatalf("CreateIndex failed: %v", err)
+	}
+	if calls == 0 {
+		t.Error("Expected the stale index rebuilt")
+	}
+	if got := lookup(t, db, "email", "ana@x.io"); got != "u3,u6" {
+		t.Errorf("Expected u3,u6 after the rebuild, got %q", got)
+	}
+}
@@ -0,0 +1,96 @@
+package engine
+
+import (
+	"errors"
+	"time"
+
+	"github.com/pro0o/deslocado/bitcask"
+)
+
+// KV is one entry a scan returned.
+type KV struct {
+	Key []byte
+	Val []byte
+}
+
+// Scan returns one page of r in key order (descending for r.Reverse) & the
+// cursor for the next page, nil once r is exhausted. pass it back as
+// r.Cursor to continue. expired & concurrently deleted keys are skipped, so
+// a page can come back shorter than r.Limit. only the default bucket is
+// scanned.
+func (db *DB) Scan(r bitcask.KeyRange) ([]KV, []byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	// bucket keys are \x00bucket\x00key in the same index, they sort after ""
+	// & before every other default key. the range starts past them & the
+	// empty key is taken on its own, first going up & last going down.
+	rest := r
+	if string(rest.Start) < bucketsEnd {
+		rest.Start = []byte(bucketsEnd)
+	}
+	loc, empty := db.keyDir.Get("")
+	empty = empty && len(r.Start) == 0 && (r.End == nil || len(r.End) > 0)
+	emptyEntry := bitcask.RangeEntry{Key: "", Loc: loc}
+	var page []bitcask.RangeEntry
+	switch {
+	case r.Reverse && r.Cursor != nil && len(r.Cursor) == 0:
+		// the empty key was the last page.
+		return nil, nil, nil
+	case !r.Reverse && r.Cursor != nil && string(r.Cursor) < bucketsEnd:
+		// resumes right past the empty key.
+		rest.Cursor = nil
+		empty = false
+	case !r.Reverse && r.Cursor == nil && empty:
+		page = append(page, emptyEntry)
+		if r.Limit == 1 {
+			return db.live(page, []byte{})
+		}
+		if rest.Limit > 0 {
+			rest.Limit--
+		}
+	}
+
+	more, next, err := db.keyDir.Range(rest)
+	if err != nil {
+		return nil, nil, err
+	}
+	page = append(page, more...)
+	if r.Reverse && empty && next == nil {
+		if r.Limit > 0 && len(page) == r.Limit {
+			next = []byte(page[len(page)-1].Key)
+		} else {
+			page = append(page, emptyEntry)
+		}
+	}
+	return db.live(page, next)
+}
+
+// the first key past every bucket key, no default key starts below it but "".
+const bucketsEnd = "\x01"
+
+// reads the page's values, skipping what expired or got deleted. lock held.
+func (db *DB) live(page []bitcask.RangeEntry, next []byte) ([]KV, []byte, error) {
+	now := time.Now().UnixNano()
+	kvs := make([]KV, 0, len(page))
+	for _, entry := range page {
+		if entry.Loc.Expired(now) {
+			continue
+		}
+		rec, err := db.read(entry.Loc)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+		kvs = append(kvs, KV{Key: []byte(entry.Key), Val: rec.Val})
+	}
+	return kvs, next, nil
+}
+
+// ScanPrefix is Scan over every key starting with prefix.
+func (db *DB) ScanPrefix(prefix []byte, limit int, cursor []byte) ([]KV, []byte, error) {
+	r := bitcask.PrefixRange(prefix)
+	r.Limit, r.Cursor = limit, cursor
+	return db.Scan(r)
+}
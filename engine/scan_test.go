@@ -0,0 +1,134 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/pro0o/deslocado/bitcask"
+)
+
+func scanKeys(t *testing.T, db *DB, r bitcask.KeyRange) []string {
+	t.Helper()
+	var keys []string
+	for {
+		page, next, err := db.Scan(r)
+		if err != nil {
+			t.Fatalf("Scan failed: %v", err)
+		}
+		for _, kv := range page {
+			keys = append(keys, string(kv.Key))
+		}
+		if next == nil {
+			return keys
+		}
+		r.Cursor = next
+	}
+}
+
+func TestScan(t *testing.T) {
+	db := openTestDB(t)
+	db.Close()
+	db, err := Open(WithOrderedIndex())
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer db.Close()
+
+	for _, user := range []int{1, 12, 123} {
+		for _, field := range []string{"name", "email", "age"} {
+			mustPut(t, db, fmt.Sprintf("user:%d:%s", user, field), field)
+		}
+	}
+	mustPut(t, db, "session:1", "x")
+
+	page, next, err := db.ScanPrefix([]byte("user:12:"), 2, nil)
+	if err != nil || len(page) != 2 || next == nil {
+		t.Fatalf("Expected a first page of 2 with a cursor, got %d (%v)", len(page), err)
+	}
+	if string(page[0].Key) != "user:12:age" || string(page[0].Val) != "age" {
+		t.Errorf("Expected user:12:age=age first, got %s=%s", page[0].Key, page[0].Val)
+	}
+	page, next, _ = db.ScanPrefix([]byte("user:12:"), 2, next)
+	if len(page) != 1 || string(page[0].Key) != "user:12:name" || next != nil {
+		t.Errorf("Expected the last page with user:12:name, got %v next=%q", page, next)
+	}
+
+	// deletes & a merge keep the index in step with the keyDir.
+	db.Delete([]byte("user:1:email"))
+	for range 3 {
+		if err := db.Rotate(context.Background(), nil); err != nil {
+			t.Fatalf("Rotate failed: %v", err)
+		}
+		mustPut(t, db, "session:2", "y")
+	}
+	got := scanKeys(t, db, bitcask.KeyRange{Start: []byte("user:1"), End: []byte("user:2"), Reverse: true, Limit: 2})
+	// ':' sorts after the digits.
+	want := "user:1:name,user:1:age,user:12:name,user:12:email,user:12:age,user:123:name,user:123:email,user:123:age"
+	if strings.Join(got, ",") != want {
+		t.Errorf("Expected %s, got %v", want, got)
+	}
+
+	// rebuilt on open.
+	db.Close()
+	db, err = Open(WithOrderedIndex())
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if got := scanKeys(t, db, bitcask.PrefixRange([]byte("session:"))); strings.Join(got, ",") != "session:1,session:2" {
+		t.Errorf("Expected both sessions after reopen, got %v", got)
+	}
+
+	plain := openTestDB(t)
+	if _, _, err := plain.Scan(bitcask.KeyRange{}); !errors.Is(err, bitcask.ErrNotOrdered) {
+		t.Errorf("Expected ErrNotOrdered without the index, got %v", err)
+	}
+}
+
+func TestScanSkipsBuckets(t *testing.T) {
+	db := openTestDB(t)
+	db.Close()
+	db, err := Open(WithOrderedIndex())
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer db.Close()
+
+	users, err := db.Bucket("users")
+	if err != nil {
+		t.Fatalf("Bucket failed: %v", err)
+	}
+	for i := range 30 {
+		if _, err := users.Put(fmt.Appendf(nil, "k%02d", i), []byte("v")); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	mustPut(t, db, "a", "1")
+	mustPut(t, db, "b", "2")
+
+	// bucket keys sort first, a page mustn't be spent on them.
+	page, next, err := db.Scan(bitcask.KeyRange{Limit: 10})
+	if err != nil || len(page) != 2 || next != nil {
+		t.Fatalf("Expected a & b in one page, got %d next=%q (%v)", len(page), next, err)
+	}
+	if got := scanKeys(t, db, bitcask.KeyRange{Reverse: true, Limit: 1}); strings.Join(got, ",") != "b,a" {
+		t.Errorf("Expected b,a going down, got %v", got)
+	}
+
+	// the empty key sorts below the bucket keys.
+	mustPut(t, db, "", "0")
+	for _, r := range []bitcask.KeyRange{{Limit: 1}, {Limit: 2}, {}} {
+		if got := scanKeys(t, db, r); strings.Join(got, ",") != ",a,b" {
+			t.Errorf("Scan %+v = %q, want the empty key, a & b", r, got)
+		}
+		r.Reverse = true
+		if got := scanKeys(t, db, r); strings.Join(got, ",") != "b,a," {
+			t.Errorf("Scan %+v = %q, want b, a & the empty key", r, got)
+		}
+	}
+	if got := scanKeys(t, db, bitcask.KeyRange{Start: []byte("a")}); strings.Join(got, ",") != "a,b" {
+		t.Errorf("Expected a start past the empty key to leave it out, got %q", got)
+	}
+}
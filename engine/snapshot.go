@@ -0,0 +1,133 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/pro0o/deslocado/bitcask"
+	"github.com/pro0o/deslocado/types"
+)
+
+var ErrSnapshotReleased = errors.New("snapshot released")
+
+// Snapshot is the store as it was when it was taken. it keeps the files it
+// reads open & pinned, so merges can't delete them until Release.
+type Snapshot struct {
+	mu      sync.Mutex
+	seq     uint64
+	entries map[string]types.FileOffset
+	files   map[string]*os.File
+	pin     *bitcask.Pin
+}
+
+// flush data.txt -> keyDir copy -> open every file it points at -> pin them
+// writes wait on the lock, so nothing moves while the files are opened.
+func (db *DB) Snapshot() (*Snapshot, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// the snapshot reads data.txt off its own handle, not the buffer.
+	if err := db.active.Flush(); err != nil {
+		return nil, fmt.Errorf("flush %s: %w", db.active.Path(), err)
+	}
+
+	s := &Snapshot{seq: db.active.LastSeq(), entries: db.keyDir.Snapshot(), files: make(map[string]*os.File)}
+	var paths []string
+	for _, loc := range s.entries {
+		if s.files[loc.FileID] != nil {
+			continue
+		}
+		// data.txt isn't under its FileID until it's sealed.
+		path := loc.FileID
+		if path == db.active.FileID() {
+			path = db.active.Path()
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			s.closeFiles()
+			return nil, fmt.Errorf("open %s: %w", path, err)
+		}
+		s.files[loc.FileID] = file
+		paths = append(paths, loc.FileID)
+	}
+	s.pin = bitcask.PinFiles(paths)
+	return s, nil
+}
+
+// Seq is the newest write the snapshot holds, every later seq is past it.
+func (s *Snapshot) Seq() uint64 {
+	return s.seq
+}
+
+func (s *Snapshot) Get(key []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pin == nil {
+		return nil, ErrSnapshotReleased
+	}
+	if err := checkKey("", key); err != nil {
+		return nil, err
+	}
+
+	loc, ok := s.entries[string(key)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return readValue(s.files[loc.FileID], loc)
+}
+
+// Iterate walks every key of the default bucket in the snapshot in key
+// order, an error from fn stops it & comes back as is. values expired since
+// the snapshot are skipped.
+func (s *Snapshot) Iterate(fn func(key, val []byte) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pin == nil {
+		return ErrSnapshotReleased
+	}
+
+	keys := make([]string, 0, len(s.entries))
+	for key := range s.entries {
+		if bucket, _ := bitcask.SplitBucketKey(key); bucket == "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		loc := s.entries[key]
+		val, err := readValue(s.files[loc.FileID], loc)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := fn([]byte(key), val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Release closes the files & drops the pins, files merged away meanwhile
+// get deleted with the last pin. safe to call more than once.
+func (s *Snapshot) Release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pin == nil {
+		return
+	}
+	s.closeFiles()
+	s.pin.Release()
+	s.pin = nil
+}
+
+func (s *Snapshot) closeFiles() {
+	for _, file := range s.files {
+		file.Close()
+	}
+	s.files = nil
+}
@@ -0,0 +1,182 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/pro0o/deslocado/bitcask"
+	"github.com/pro0o/deslocado/types"
+)
+
+var (
+	// ErrConflict means a key the transaction read changed before it
+	// committed, the whole transaction can be retried.
+	ErrConflict = errors.New("transaction conflict, retry")
+	ErrTxnDone  = errors.New("transaction already committed or rolled back")
+)
+
+// what a transaction saw the first time it read a key.
+type txnRead struct {
+	loc   types.FileOffset
+	found bool
+	seq   uint64
+	epoch uint64
+}
+
+// Txn buffers writes until Commit. reads go to the store & are validated
+// against the keyDir at commit, nothing is locked in between.
+type Txn struct {
+	db     *DB
+	reads  map[string]txnRead
+	writes map[string]bitcask.BatchOp
+	order  []string
+	done   bool
+}
+
+func (db *DB) Begin() *Txn {
+	return &Txn{db: db, reads: make(map[string]txnRead), writes: make(map[string]bitcask.BatchOp)}
+}
+
+// Get sees the transaction's own writes first.
+func (tx *Txn) Get(key []byte) ([]byte, error) {
+	if tx.done {
+		return nil, ErrTxnDone
+	}
+	if err := checkKey("", key); err != nil {
+		return nil, err
+	}
+	if op, ok := tx.writes[string(key)]; ok {
+		if op.Delete {
+			return nil, ErrNotFound
+		}
+		return op.Val, nil
+	}
+
+	db := tx.db
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	loc, ok := db.keyDir.Get(string(key))
+	read := txnRead{loc: loc, found: ok, epoch: db.epoch}
+	var val []byte
+	if ok {
+		rec, err := db.read(loc)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+		read.seq, val = rec.Seq, rec.Val
+		read.found = err == nil
+	}
+	if _, seen := tx.reads[string(key)]; !seen {
+		tx.reads[string(key)] = read
+	}
+	if !read.found {
+		return nil, ErrNotFound
+	}
+	return val, nil
+}
+
+func (tx *Txn) Put(key, val []byte) error {
+	return tx.buffer(bitcask.BatchOp{Key: key, Val: val})
+}
+
+func (tx *Txn) Delete(key []byte) error {
+	return tx.buffer(bitcask.BatchOp{Key: key, Delete: true})
+}
+
+func (tx *Txn) buffer(op bitcask.BatchOp) error {
+	if tx.done {
+		return ErrTxnDone
+	}
+	if err := checkKey("", op.Key); err != nil {
+		return err
+	}
+	key := string(op.Key)
+	if _, ok := tx.writes[key]; !ok {
+		tx.order = append(tx.order, key)
+	}
+	tx.writes[key] = op
+	return nil
+}
+
+func (tx *Txn) Rollback() {
+	tx.done = true
+}
+
+// validate reads -> one batch in the log -> keyDir
+// ErrConflict leaves the store untouched. returns the seq of the last
+// write, 0 when there was nothing to write.
+func (tx *Txn) Commit() (uint64, error) {
+	if tx.done {
+		return 0, ErrTxnDone
+	}
+	tx.done = true
+
+	db := tx.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for key, read := range tx.reads {
+		if err := tx.validate(key, read); err != nil {
+			return 0, err
+		}
+	}
+	if len(tx.order) == 0 {
+		return 0, nil
+	}
+
+	ops := make([]bitcask.BatchOp, 0, len(tx.order))
+	for _, key := range tx.order {
+		ops = append(ops, tx.writes[key])
+	}
+	locs, seqs, err := db.active.WriteBatch(ops)
+	if err != nil {
+		return 0, fmt.Errorf("write batch: %w", err)
+	}
+	for i, op := range ops {
+		if op.Delete {
+			db.keyDir.Delete(string(op.Key))
+		} else {
+			db.keyDir.Put(string(op.Key), locs[i])
+		}
+		db.changed("", op.Key, op.Val, 0, op.Delete, seqs[i])
+	}
+	return db.active.LastSeq(), nil
+}
+
+// same location in the same epoch is the same record. a rotation since may
+// have moved the key or reused the data.txt offset, then the record's seq
+// decides. a key read as missing has to still be missing, an
+// expired value left in the keyDir counts as missing.
+func (tx *Txn) validate(key string, read txnRead) error {
+	db := tx.db
+	conflict := fmt.Errorf("key %q: %w", key, ErrConflict)
+
+	loc, ok := db.keyDir.Get(key)
+	if !ok {
+		if read.found {
+			return conflict
+		}
+		return nil
+	}
+	if read.found && loc == read.loc && db.epoch == read.epoch {
+		return nil
+	}
+	if read.found && db.epoch == read.epoch {
+		return conflict
+	}
+
+	rec, err := db.read(loc)
+	if errors.Is(err, ErrNotFound) {
+		if read.found {
+			return conflict
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !read.found || rec.Seq != read.seq {
+		return conflict
+	}
+	return nil
+}
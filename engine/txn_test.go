@@ -0,0 +1,104 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestTxnCommit(t *testing.T) {
+	db := openTestDB(t)
+	mustPut(t, db, "from", "10")
+	mustPut(t, db, "gone", "x")
+
+	tx := db.Begin()
+	if val, err := tx.Get([]byte("from")); err != nil || string(val) != "10" {
+		t.Fatalf("Expected from=10, got %q (%v)", val, err)
+	}
+	tx.Put([]byte("from"), []byte("7"))
+	tx.Put([]byte("to"), []byte("3"))
+	tx.Delete([]byte("gone"))
+
+	// own writes are visible, the store's aren't touched yet.
+	if val, _ := tx.Get([]byte("to")); string(val) != "3" {
+		t.Errorf("Expected the txn to read its own write, got %q", val)
+	}
+	if _, err := db.Get([]byte("to")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected to invisible before commit, got %v", err)
+	}
+
+	if _, err := tx.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	for key, want := range map[string]string{"from": "7", "to": "3"} {
+		if val, err := db.Get([]byte(key)); err != nil || string(val) != want {
+			t.Errorf("Expected %s=%s, got %q (%v)", key, want, val, err)
+		}
+	}
+	if _, err := db.Get([]byte("gone")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected gone deleted, got %v", err)
+	}
+	if _, err := tx.Commit(); !errors.Is(err, ErrTxnDone) {
+		t.Errorf("Expected ErrTxnDone on a second commit, got %v", err)
+	}
+
+	// survives a restart as one batch.
+	db.Close()
+	reopened, err := Open()
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer reopened.Close()
+	if val, err := reopened.Get([]byte("to")); err != nil || string(val) != "3" {
+		t.Errorf("Expected to=3 after reopen, got %q (%v)", val, err)
+	}
+}
+
+func TestTxnConflict(t *testing.T) {
+	db := openTestDB(t)
+	mustPut(t, db, "counter", "1")
+
+	t.Run("changed_value", func(t *testing.T) {
+		tx := db.Begin()
+		tx.Get([]byte("counter"))
+		tx.Put([]byte("counter"), []byte("2"))
+		mustPut(t, db, "counter", "5")
+
+		if _, err := tx.Commit(); !errors.Is(err, ErrConflict) {
+			t.Fatalf("Expected ErrConflict, got %v", err)
+		}
+		if val, _ := db.Get([]byte("counter")); string(val) != "5" {
+			t.Errorf("Expected the conflicting commit to write nothing, got %q", val)
+		}
+	})
+
+	t.Run("created_key", func(t *testing.T) {
+		tx := db.Begin()
+		if _, err := tx.Get([]byte("lock")); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("Expected lock missing, got %v", err)
+		}
+		tx.Put([]byte("lock"), []byte("mine"))
+		mustPut(t, db, "lock", "theirs")
+
+		if _, err := tx.Commit(); !errors.Is(err, ErrConflict) {
+			t.Fatalf("Expected ErrConflict, got %v", err)
+		}
+	})
+
+	t.Run("rotation_only", func(t *testing.T) {
+		tx := db.Begin()
+		tx.Get([]byte("counter"))
+		tx.Put([]byte("counter"), []byte("6"))
+		if err := db.Rotate(context.Background(), nil); err != nil {
+			t.Fatalf("Rotate failed: %v", err)
+		}
+
+		// moved, not changed.
+		if _, err := tx.Commit(); err != nil {
+			t.Fatalf("Expected commit after a plain rotation, got %v", err)
+		}
+		if val, _ := db.Get([]byte("counter")); string(val) != "6" {
+			t.Errorf("Expected counter=6, got %q", val)
+		}
+	})
+}
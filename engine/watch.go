@@ -0,0 +1,304 @@
+package engine
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pro0o/deslocado/bitcask"
+)
+
+// Op is what happened to a watched key.
+type Op uint8
+
+const (
+	OpPut Op = iota
+	OpDelete
+	// OpExpire is a value whose expiry passed, nothing wrote it.
+	OpExpire
+	// OpResync means the watcher fell behind & events were dropped, the
+	// consumer has to re-read what it cares about. Key is nil.
+	OpResync
+	// OpDropBucket only comes from a ChangeReader, Bucket went away whole.
+	OpDropBucket
+)
+
+func (o Op) String() string {
+	switch o {
+	case OpPut:
+		return "put"
+	case OpDelete:
+		return "delete"
+	case OpExpire:
+		return "expire"
+	case OpResync:
+		return "resync"
+	case OpDropBucket:
+		return "drop bucket"
+	}
+	return "unknown"
+}
+
+// Event is one change to the default bucket. Seq is its record's, the one
+// the write returned & a ChangeReader reports, so it grows in commit order.
+// an OpExpire has no record, it carries the seq of the newest write before
+// it. Val is only set for puts on a watch WithValues.
+type Event struct {
+	Op  Op
+	Key []byte
+	Val []byte
+	Seq uint64
+}
+
+// WatchOption tunes Watch.
+type WatchOption func(*watcher)
+
+// WithValues sends the written value along with every put.
+func WithValues() WatchOption {
+	return func(w *watcher) { w.values = true }
+}
+
+// WithBuffer holds up to n events for a slow consumer, past that they're
+// dropped & the consumer gets an OpResync. the default is 256.
+func WithBuffer(n int) WatchOption {
+	return func(w *watcher) { w.limit = max(n, 1) }
+}
+
+// Watch streams every committed change to keys starting with prefix until
+// ctx is done or the db closes, then the channel is closed. writers never
+// wait on a watcher: past its buffer a watcher loses events & gets one
+// OpResync once it catches up.
+func (db *DB) Watch(ctx context.Context, prefix []byte, opts ...WatchOption) <-chan Event {
+	ctx, cancel := context.WithCancel(ctx)
+	w := &watcher{
+		prefix: bytes.Clone(prefix),
+		limit:  256,
+		notify: make(chan struct{}, 1),
+		out:    make(chan Event),
+		cancel: cancel,
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+
+	// the lock keeps writes out while the expiry queue is seeded.
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		cancel()
+		close(w.out)
+		return w.out
+	}
+	db.hub.add(w, db)
+	db.mu.Unlock()
+
+	go func() {
+		w.pump(ctx)
+		db.hub.remove(w)
+	}()
+	return w.out
+}
+
+// a watcher queues events until its pump hands them to the consumer.
+type watcher struct {
+	prefix []byte
+	values bool
+	limit  int
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	queue    []Event
+	overflow bool
+	lost     uint64
+	notify   chan struct{}
+	out      chan Event
+}
+
+// never blocks, a full queue turns into an overflow.
+func (w *watcher) push(e Event) {
+	if !bytes.HasPrefix(e.Key, w.prefix) {
+		return
+	}
+	if !w.values {
+		e.Val = nil
+	}
+	w.mu.Lock()
+	switch {
+	case w.overflow || len(w.queue) == w.limit:
+		w.overflow, w.lost = true, e.Seq
+	default:
+		w.queue = append(w.queue, e)
+	}
+	w.mu.Unlock()
+
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+// queued events -> consumer, the resync goes right after what was queued
+// before the overflow.
+func (w *watcher) pump(ctx context.Context) {
+	defer close(w.out)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.notify:
+		}
+
+		w.mu.Lock()
+		queue, overflow, lost := w.queue, w.overflow, w.lost
+		w.queue, w.overflow = nil, false
+		w.mu.Unlock()
+
+		// Seq is the last event lost.
+		if overflow {
+			queue = append(queue, Event{Op: OpResync, Seq: lost})
+		}
+		for _, e := range queue {
+			select {
+			case <-ctx.Done():
+				return
+			case w.out <- e:
+			}
+		}
+	}
+}
+
+// hub fans events out to the watchers. while anyone watches it also tracks
+// expiring values, to report them as they expire.
+type hub struct {
+	mu       sync.Mutex
+	watchers map[*watcher]bool
+	expiring expiryQueue
+	wake     chan struct{}
+}
+
+// db lock held.
+func (h *hub) add(w *watcher, db *DB) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.watchers == nil {
+		h.watchers = make(map[*watcher]bool)
+	}
+	h.watchers[w] = true
+	if len(h.watchers) > 1 {
+		return
+	}
+
+	h.expiring = h.expiring[:0]
+	for k, loc := range db.keyDir.Snapshot() {
+		if bucket, _ := bitcask.SplitBucketKey(k); bucket == "" && loc.Expiry != 0 {
+			h.expiring = append(h.expiring, expiring{key: k, at: loc.Expiry})
+		}
+	}
+	heap.Init(&h.expiring)
+	h.wake = make(chan struct{}, 1)
+	go h.expire(db, h.wake)
+}
+
+func (h *hub) remove(w *watcher) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.watchers, w)
+	if len(h.watchers) == 0 && h.wake != nil {
+		close(h.wake)
+		h.wake = nil
+		h.expiring = nil
+	}
+}
+
+// a committed write & its record's seq, db lock held.
+func (h *hub) publish(op Op, key, val []byte, expiry int64, seq uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.watchers) == 0 {
+		return
+	}
+	e := Event{Op: op, Key: bytes.Clone(key), Val: bytes.Clone(val), Seq: seq}
+	for w := range h.watchers {
+		w.push(e)
+	}
+
+	if expiry != 0 {
+		heap.Push(&h.expiring, expiring{key: string(key), at: expiry})
+		if h.expiring[0].at == expiry {
+			select {
+			case h.wake <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// sleeps until the next expiry, a value that was overwritten or deleted
+// since doesn't count. stops once wake closes.
+func (h *hub) expire(db *DB, wake chan struct{}) {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		h.mu.Lock()
+		next := time.Hour
+		if len(h.expiring) > 0 {
+			next = time.Until(time.Unix(0, h.expiring[0].at))
+		}
+		h.mu.Unlock()
+
+		timer.Reset(max(next, 0))
+		select {
+		case _, ok := <-wake:
+			if !ok {
+				return
+			}
+			continue
+		case <-timer.C:
+		}
+
+		db.mu.RLock()
+		h.mu.Lock()
+		now := time.Now().UnixNano()
+		for len(h.expiring) > 0 && h.expiring[0].at <= now {
+			e := heap.Pop(&h.expiring).(expiring)
+			if loc, ok := db.keyDir.Get(e.key); ok && loc.Expiry == e.at {
+				event := Event{Op: OpExpire, Key: []byte(e.key), Seq: db.active.LastSeq()}
+				for w := range h.watchers {
+					w.push(event)
+				}
+			}
+		}
+		h.mu.Unlock()
+		db.mu.RUnlock()
+	}
+}
+
+// stops every watcher, db lock held.
+func (h *hub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for w := range h.watchers {
+		w.cancel()
+	}
+}
+
+type expiring struct {
+	key string
+	at  int64
+}
+
+// min-heap on at.
+type expiryQueue []expiring
+
+func (q expiryQueue) Len() int           { return len(q) }
+func (q expiryQueue) Less(i, j int) bool { return q[i].at < q[j].at }
+func (q expiryQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q *expiryQueue) Push(x any)        { *q = append(*q, x.(expiring)) }
+func (q *expiryQueue) Pop() any {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
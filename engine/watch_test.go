@@ -0,0 +1,111 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func next(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+	select {
+	case e, ok := <-events:
+		if !ok {
+			t.Fatal("Watch channel closed early")
+		}
+		return e
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for an event")
+	}
+	return Event{}
+}
+
+func TestWatch(t *testing.T) {
+	db := openTestDB(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	events := db.Watch(ctx, []byte("user:"), WithValues())
+
+	// every event carries the seq its write returned.
+	var seqs []uint64
+	record := func(seq uint64, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		seqs = append(seqs, seq)
+	}
+	record(db.Put([]byte("user:1"), []byte("a")))
+	mustPut(t, db, "other", "b")
+	record(db.Delete([]byte("user:1")))
+	record(db.PutExpiring([]byte("user:2"), []byte("c"), time.Now().Add(50*time.Millisecond)))
+	// overwritten before it expires, only the new value's expiry counts.
+	record(db.PutExpiring([]byte("user:3"), []byte("d"), time.Now().Add(30*time.Millisecond)))
+	record(db.Put([]byte("user:3"), []byte("e")))
+	// nothing wrote the expiry, it goes with the newest write.
+	seqs = append(seqs, seqs[len(seqs)-1])
+
+	want := []string{"put user:1=a", "delete user:1=", "put user:2=c", "put user:3=d", "put user:3=e", "expire user:2="}
+	for i, w := range want {
+		e := next(t, events)
+		if got := fmt.Sprintf("%s %s=%s", e.Op, e.Key, e.Val); got != w {
+			t.Errorf("Expected %q, got %q", w, got)
+		}
+		if e.Seq != seqs[i] {
+			t.Errorf("%s: expected seq %d, got %d", w, seqs[i], e.Seq)
+		}
+	}
+
+	// a batch's ops each have a record of their own.
+	var b Batch
+	b.Put("", []byte("user:4"), []byte("f"))
+	b.Put("", []byte("user:5"), []byte("g"))
+	last, err := db.Write(&b)
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if e1, e2 := next(t, events), next(t, events); e1.Seq != last-1 || e2.Seq != last {
+		t.Errorf("Expected the batch at seqs %d & %d, got %d & %d", last-1, last, e1.Seq, e2.Seq)
+	}
+
+	cancel()
+	for range events {
+	}
+}
+
+func TestWatchSlowConsumer(t *testing.T) {
+	db := openTestDB(t)
+	events := db.Watch(context.Background(), nil, WithBuffer(2))
+
+	for i := range 20 {
+		mustPut(t, db, fmt.Sprintf("k%02d", i), "v")
+	}
+	var puts int
+	for {
+		e := next(t, events)
+		if e.Op == OpResync {
+			if e.Key != nil {
+				t.Errorf("Expected no key on a resync, got %q", e.Key)
+			}
+			break
+		}
+		if e.Val != nil {
+			t.Errorf("Expected no value without WithValues, got %q", e.Val)
+		}
+		puts++
+	}
+	if puts >= 20 {
+		t.Errorf("Expected events dropped, got all %d", puts)
+	}
+
+	// caught up, events flow again.
+	mustPut(t, db, "after", "v")
+	if e := next(t, events); e.Op != OpPut || string(e.Key) != "after" {
+		t.Errorf("Expected put after, got %s %q", e.Op, e.Key)
+	}
+
+	db.Close()
+	if _, ok := <-events; ok {
+		t.Error("Expected Close to end the watch")
+	}
+}
@@ -0,0 +1,415 @@
+package resp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pro0o/deslocado/engine"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	version = "0.1.0"
+	// SCAN's page size without COUNT, same as redis.
+	defaultCount = 10
+)
+
+// command is a handler & its arity, redis style: the name counts, a
+// negative arity is a minimum.
+type command struct {
+	arity int
+	fn    func(c *conn, args [][]byte)
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"ping":   {-1, (*conn).ping},
+		"hello":  {-1, (*conn).hello},
+		"quit":   {1, (*conn).quitCmd},
+		"get":    {2, (*conn).get},
+		"set":    {-3, (*conn).set},
+		"del":    {-2, (*conn).del},
+		"exists": {-2, (*conn).exists},
+		"mget":   {-2, (*conn).mget},
+		"mset":   {-3, (*conn).mset},
+		"scan":   {-2, (*conn).scan},
+		"ttl":    {2, (*conn).ttl},
+		"info":   {-1, (*conn).info},
+	}
+}
+
+func (c *conn) dispatch(args [][]byte) {
+	name := strings.ToLower(string(args[0]))
+	cmd, ok := commands[name]
+	if !ok {
+		c.w.errorf("unknown command '%s'", args[0])
+		return
+	}
+	if cmd.arity > 0 && len(args) != cmd.arity || cmd.arity < 0 && len(args) < -cmd.arity {
+		c.w.errorf("wrong number of arguments for '%s' command", name)
+		return
+	}
+	cmd.fn(c, args)
+}
+
+// redis has no invalid keys, a read of one finds nothing.
+func missing(err error) bool {
+	return errors.Is(err, engine.ErrNotFound) || errors.Is(err, engine.ErrInvalidKey)
+}
+
+// engine errors -> error replies, a bad key is the client's fault.
+func (c *conn) fail(err error) {
+	if errors.Is(err, engine.ErrInvalidKey) {
+		c.w.errorf("invalid key, keys can't start with \\x00")
+		return
+	}
+	log.Error().Err(err).Msg("RESP command failed!!")
+	c.w.errorf("%v", err)
+}
+
+func (c *conn) ping(args [][]byte) {
+	switch len(args) {
+	case 1:
+		c.w.simple("PONG")
+	case 2:
+		c.w.bulk(args[1])
+	default:
+		c.w.errorf("wrong number of arguments for 'ping' command")
+	}
+}
+
+// HELLO [protover [AUTH user pass] [SETNAME name]] switches the protocol &
+// describes the server. there are no users, AUTH is refused.
+func (c *conn) hello(args [][]byte) {
+	proto := c.w.proto
+	if len(args) > 1 {
+		n, err := strconv.Atoi(string(args[1]))
+		if err != nil {
+			c.w.errorf("Protocol version is not an integer or out of range")
+			return
+		}
+		if n != 2 && n != 3 {
+			c.w.error("NOPROTO unsupported protocol version")
+			return
+		}
+		proto = n
+	}
+	for i := 2; i < len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
+		case "auth":
+			c.w.errorf("AUTH is not supported")
+			return
+		case "setname":
+			if i+1 >= len(args) {
+				c.w.errorf("syntax error")
+				return
+			}
+			i++
+		default:
+			c.w.errorf("syntax error")
+			return
+		}
+	}
+	c.w.proto = proto
+
+	c.w.mapHeader(7)
+	c.w.bulkString("server")
+	c.w.bulkString("deslocado")
+	c.w.bulkString("version")
+	c.w.bulkString(version)
+	c.w.bulkString("proto")
+	c.w.integer(int64(proto))
+	c.w.bulkString("id")
+	c.w.integer(0)
+	c.w.bulkString("mode")
+	c.w.bulkString("standalone")
+	c.w.bulkString("role")
+	c.w.bulkString("master")
+	c.w.bulkString("modules")
+	c.w.array(0)
+}
+
+func (c *conn) quitCmd(args [][]byte) {
+	c.w.simple("OK")
+	c.quit = true
+}
+
+func (c *conn) get(args [][]byte) {
+	val, err := c.server.db.Get(args[1])
+	if missing(err) {
+		c.w.null()
+		return
+	} else if err != nil {
+		c.fail(err)
+		return
+	}
+	c.w.bulk(val)
+}
+
+// SET key val [EX seconds | PX millis] [NX | XX], a condition that doesn't
+// hold replies null.
+func (c *conn) set(args [][]byte) {
+	key, val := args[1], args[2]
+	now := time.Now()
+	var ttl time.Duration
+	var nx, xx bool
+	for i := 3; i < len(args); i++ {
+		switch opt := strings.ToLower(string(args[i])); opt {
+		case "nx":
+			nx = true
+		case "xx":
+			xx = true
+		case "ex", "px":
+			if ttl != 0 || i+1 >= len(args) {
+				c.w.errorf("syntax error")
+				return
+			}
+			i++
+			n, err := strconv.ParseInt(string(args[i]), 10, 64)
+			if err != nil {
+				c.w.errorf("value is not an integer or out of range")
+				return
+			}
+			unit := time.Second
+			if opt == "px" {
+				unit = time.Millisecond
+			}
+			// the expiry is kept in unix nanos, it has to fit in them.
+			if n <= 0 || n > (math.MaxInt64-now.UnixNano())/int64(unit) {
+				c.w.errorf("invalid expire time in 'set' command")
+				return
+			}
+			ttl = time.Duration(n) * unit
+		default:
+			c.w.errorf("syntax error")
+			return
+		}
+	}
+	if nx && xx {
+		c.w.errorf("syntax error")
+		return
+	}
+
+	db := c.server.db
+	expiry := now.Add(ttl)
+	ok := true
+	var err error
+	switch {
+	case nx && ttl != 0:
+		ok, err = db.PutExpiringIfAbsent(key, val, expiry)
+	case nx:
+		ok, err = db.PutIfAbsent(key, val)
+	case xx && ttl != 0:
+		ok, err = db.PutExpiringIfPresent(key, val, expiry)
+	case xx:
+		ok, err = db.PutIfPresent(key, val)
+	case ttl != 0:
+		_, err = db.PutExpiring(key, val, expiry)
+	default:
+		_, err = db.Put(key, val)
+	}
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	if !ok {
+		c.w.null()
+		return
+	}
+	c.w.simple("OK")
+}
+
+func (c *conn) del(args [][]byte) {
+	var n int64
+	for _, key := range args[1:] {
+		ok, err := c.server.db.DeleteIfPresent(key)
+		if err != nil && !missing(err) {
+			c.fail(err)
+			return
+		}
+		if ok {
+			n++
+		}
+	}
+	c.w.integer(n)
+}
+
+// a key named twice counts twice, like redis.
+func (c *conn) exists(args [][]byte) {
+	var n int64
+	for _, key := range args[1:] {
+		_, err := c.server.db.Get(key)
+		if missing(err) {
+			continue
+		} else if err != nil {
+			c.fail(err)
+			return
+		}
+		n++
+	}
+	c.w.integer(n)
+}
+
+// reads each key on its own, a write can land between two of them.
+func (c *conn) mget(args [][]byte) {
+	vals := make([][]byte, 0, len(args)-1)
+	for _, key := range args[1:] {
+		val, err := c.server.db.Get(key)
+		if missing(err) {
+			val = nil
+		} else if err != nil {
+			c.fail(err)
+			return
+		}
+		vals = append(vals, val)
+	}
+	c.w.array(len(vals))
+	for _, val := range vals {
+		if val == nil {
+			c.w.null()
+		} else {
+			c.w.bulk(val)
+		}
+	}
+}
+
+// every pair goes in as one batch, all of them or none.
+func (c *conn) mset(args [][]byte) {
+	if len(args)%2 != 1 {
+		c.w.errorf("wrong number of arguments for 'mset' command")
+		return
+	}
+	var b engine.Batch
+	for i := 1; i < len(args); i += 2 {
+		b.Put("", args[i], args[i+1])
+	}
+	if _, err := c.server.db.Write(&b); err != nil {
+		c.fail(err)
+		return
+	}
+	c.w.simple("OK")
+}
+
+// SCAN cursor [MATCH pattern] [COUNT n] walks the keys in order. clients
+// expect numeric cursors, so the key a page stopped at stays with the
+// server & the client gets a number for it, see cursorTable.
+func (c *conn) scan(args [][]byte) {
+	id, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		c.w.errorf("invalid cursor")
+		return
+	}
+	now := time.Now()
+	var after []byte
+	if id != 0 {
+		var ok bool
+		if after, ok = c.server.cursors.get(id, now); !ok {
+			c.w.errorf("invalid cursor")
+			return
+		}
+	}
+
+	var pattern []byte
+	count := defaultCount
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			c.w.errorf("syntax error")
+			return
+		}
+		switch strings.ToLower(string(args[i])) {
+		case "match":
+			pattern = args[i+1]
+		case "count":
+			n, err := strconv.Atoi(string(args[i+1]))
+			if err != nil || n < 1 {
+				c.w.errorf("value is not an integer or out of range")
+				return
+			}
+			count = n
+		default:
+			c.w.errorf("syntax error")
+			return
+		}
+	}
+
+	// the literal start of the pattern narrows the range, the rest is
+	// matched key by key.
+	page, next, err := c.server.db.ScanPrefix(literalPrefix(pattern), count, after)
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	var keys [][]byte
+	for _, kv := range page {
+		if pattern == nil || match(pattern, kv.Key) {
+			keys = append(keys, kv.Key)
+		}
+	}
+
+	cursor := "0"
+	if next != nil {
+		cursor = strconv.FormatUint(c.server.cursors.put(next, now), 10)
+	}
+	c.w.array(2)
+	c.w.bulkString(cursor)
+	c.w.array(len(keys))
+	for _, key := range keys {
+		c.w.bulk(key)
+	}
+}
+
+// TTL is the seconds key has left, -1 if it never expires & -2 if it's
+// missing.
+func (c *conn) ttl(args [][]byte) {
+	expiry, err := c.server.db.Expiry(args[1])
+	if missing(err) {
+		c.w.integer(-2)
+		return
+	} else if err != nil {
+		c.fail(err)
+		return
+	}
+	if expiry.IsZero() {
+		c.w.integer(-1)
+		return
+	}
+	// rounded like redis, a key with under half a second left reads 0.
+	left := time.Until(expiry)
+	c.w.integer(int64((left + time.Second/2) / time.Second))
+}
+
+// INFO [section] reports the server & keyspace sections, the only ones
+// there are. keys counts expired ones a merge hasn't dropped yet.
+func (c *conn) info(args [][]byte) {
+	section := "default"
+	if len(args) > 1 {
+		section = strings.ToLower(string(args[1]))
+	}
+	all := section == "default" || section == "all" || section == "everything"
+
+	var b bytes.Buffer
+	if all || section == "server" {
+		b.WriteString("# Server\r\n")
+		// some clients check it before using newer commands.
+		b.WriteString("redis_version:7.0.0\r\n")
+		fmt.Fprintf(&b, "deslocado_version:%s\r\n", version)
+		b.WriteString("redis_mode:standalone\r\n")
+		fmt.Fprintf(&b, "proto:%d\r\n", c.w.proto)
+		fmt.Fprintf(&b, "last_seq:%d\r\n", c.server.db.LastSeq())
+	}
+	if all || section == "keyspace" {
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString("# Keyspace\r\n")
+		fmt.Fprintf(&b, "db0:keys=%d\r\n", c.server.db.Len())
+	}
+	c.w.bulk(b.Bytes())
+}
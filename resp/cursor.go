@@ -0,0 +1,88 @@
+package resp
+
+import (
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+const (
+	// a cursor nobody used for this long is forgotten.
+	cursorTTL = 5 * time.Minute
+	// cursors held at once, the one closest to expiring goes past it.
+	maxCursors = 1 << 16
+)
+
+// cursorTable holds the SCAN cursors of the whole server, pooled clients
+// send the next SCAN over whichever connection is free. a cursor is the key
+// a page stopped at, good until it expires & for as many calls as the
+// client likes, so a retried SCAN gets the same page again. ids are random,
+// a client can't walk into another's by counting.
+type cursorTable struct {
+	mu      sync.Mutex
+	cursors map[uint64]cursor
+	swept   time.Time
+}
+
+type cursor struct {
+	after   []byte
+	expires time.Time
+}
+
+// a fresh cursor resuming after key, never 0.
+func (t *cursorTable) put(after []byte, now time.Time) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.cursors == nil {
+		t.cursors = make(map[uint64]cursor)
+	}
+	t.sweep(now)
+	if len(t.cursors) >= maxCursors {
+		t.evict()
+	}
+	id := rand.Uint64()
+	for _, taken := t.cursors[id]; id == 0 || taken; _, taken = t.cursors[id] {
+		id = rand.Uint64()
+	}
+	t.cursors[id] = cursor{after: after, expires: now.Add(cursorTTL)}
+	return id
+}
+
+// the key id resumes after, false once it expired or never was. using a
+// cursor keeps it alive.
+func (t *cursorTable) get(id uint64, now time.Time) ([]byte, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c, ok := t.cursors[id]
+	if !ok || !now.Before(c.expires) {
+		delete(t.cursors, id)
+		return nil, false
+	}
+	c.expires = now.Add(cursorTTL)
+	t.cursors[id] = c
+	return c.after, true
+}
+
+// drops the expired cursors, at most once a TTL so SCAN stays cheap.
+func (t *cursorTable) sweep(now time.Time) {
+	if now.Sub(t.swept) < cursorTTL {
+		return
+	}
+	t.swept = now
+	for id, c := range t.cursors {
+		if !now.Before(c.expires) {
+			delete(t.cursors, id)
+		}
+	}
+}
+
+func (t *cursorTable) evict() {
+	var oldest uint64
+	var at time.Time
+	for id, c := range t.cursors {
+		if at.IsZero() || c.expires.Before(at) {
+			oldest, at = id, c.expires
+		}
+	}
+	delete(t.cursors, oldest)
+}
@@ -0,0 +1,194 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+)
+
+const (
+	maxArgs   = 1 << 20
+	maxBulk   = 512 << 20
+	maxInline = 64 << 10
+	// a bulk is read this much at a time, memory follows the bytes that
+	// came in rather than the length the client claims.
+	bulkChunk = 64 << 10
+)
+
+// errProtocol is a request the reader can't make sense of, the connection
+// is dropped after replying.
+var errProtocol = errors.New("protocol error")
+
+// reader splits a connection into commands: RESP arrays of bulk strings,
+// or inline ones (space separated, one per line) for telnet & nc.
+type reader struct {
+	r *bufio.Reader
+}
+
+func newReader(r io.Reader) *reader {
+	return &reader{r: bufio.NewReaderSize(r, maxInline)}
+}
+
+// buffered reports whether more of a pipeline already came in, replies are
+// flushed once it's drained.
+func (r *reader) buffered() bool {
+	return r.r.Buffered() > 0
+}
+
+// next command, nil for a blank inline line.
+func (r *reader) command() ([][]byte, error) {
+	line, err := r.line()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return inline(line), nil
+	}
+	n, err := parseLen(line[1:], maxArgs)
+	if err != nil {
+		return nil, fmt.Errorf("multibulk length: %w", err)
+	}
+	args := make([][]byte, 0, min(n, 1024))
+	for range n {
+		arg, err := r.bulk()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+func (r *reader) bulk() ([]byte, error) {
+	line, err := r.line()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '$' {
+		return nil, fmt.Errorf("expected '$', got %q: %w", line, errProtocol)
+	}
+	n, err := parseLen(line[1:], maxBulk)
+	if err != nil {
+		return nil, fmt.Errorf("bulk length: %w", err)
+	}
+	buf := make([]byte, 0, min(n+2, bulkChunk))
+	for len(buf) < n+2 {
+		start, chunk := len(buf), min(n+2-len(buf), bulkChunk)
+		buf = slices.Grow(buf, chunk)[:start+chunk]
+		if _, err := io.ReadFull(r.r, buf[start:]); err != nil {
+			return nil, err
+		}
+	}
+	if buf[n] != '\r' || buf[n+1] != '\n' {
+		return nil, fmt.Errorf("bulk not terminated by CRLF: %w", errProtocol)
+	}
+	return buf[:n], nil
+}
+
+// one line without its \r\n, a bare \n ends it too.
+func (r *reader) line() ([]byte, error) {
+	line, err := r.r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return nil, fmt.Errorf("line too long: %w", errProtocol)
+	} else if err != nil {
+		return nil, err
+	}
+	line = bytes.TrimSuffix(line[:len(line)-1], []byte("\r"))
+	// ReadSlice's buffer is reused by the next read.
+	return append([]byte(nil), line...), nil
+}
+
+func inline(line []byte) [][]byte {
+	fields := bytes.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+	return fields
+}
+
+func parseLen(b []byte, limit int) (int, error) {
+	n, err := strconv.Atoi(string(b))
+	if err != nil || n < 0 || n > limit {
+		return 0, fmt.Errorf("invalid length %q: %w", b, errProtocol)
+	}
+	return n, nil
+}
+
+// writer encodes replies for the protocol version the client picked with
+// HELLO. RESP3 has its own null & map types, RESP2 gets the closest thing.
+type writer struct {
+	w     *bufio.Writer
+	proto int
+}
+
+func newWriter(w io.Writer) *writer {
+	return &writer{w: bufio.NewWriter(w), proto: 2}
+}
+
+func (w *writer) flush() error {
+	return w.w.Flush()
+}
+
+func (w *writer) simple(s string) {
+	w.w.WriteByte('+')
+	w.w.WriteString(s)
+	w.w.WriteString("\r\n")
+}
+
+// error replies start with their code, ERR unless the message has one.
+func (w *writer) error(msg string) {
+	w.w.WriteByte('-')
+	w.w.WriteString(msg)
+	w.w.WriteString("\r\n")
+}
+
+func (w *writer) errorf(format string, args ...any) {
+	w.error("ERR " + fmt.Sprintf(format, args...))
+}
+
+func (w *writer) integer(n int64) {
+	w.w.WriteByte(':')
+	w.w.WriteString(strconv.FormatInt(n, 10))
+	w.w.WriteString("\r\n")
+}
+
+func (w *writer) bulk(b []byte) {
+	w.w.WriteByte('$')
+	w.w.WriteString(strconv.Itoa(len(b)))
+	w.w.WriteString("\r\n")
+	w.w.Write(b)
+	w.w.WriteString("\r\n")
+}
+
+func (w *writer) bulkString(s string) {
+	w.bulk([]byte(s))
+}
+
+func (w *writer) null() {
+	if w.proto == 3 {
+		w.w.WriteString("_\r\n")
+		return
+	}
+	w.w.WriteString("$-1\r\n")
+}
+
+func (w *writer) array(n int) {
+	w.w.WriteByte('*')
+	w.w.WriteString(strconv.Itoa(n))
+	w.w.WriteString("\r\n")
+}
+
+// map of n pairs, a flat array of 2n under RESP2.
+func (w *writer) mapHeader(n int) {
+	if w.proto == 3 {
+		w.w.WriteByte('%')
+		w.w.WriteString(strconv.Itoa(n))
+		w.w.WriteString("\r\n")
+		return
+	}
+	w.array(2 * n)
+}
@@ -0,0 +1,164 @@
+package resp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/pro0o/deslocado/engine"
+	"github.com/rs/zerolog/log"
+)
+
+// ErrServerClosed is what Serve returns once Close stopped it.
+var ErrServerClosed = errors.New("resp: server closed")
+
+// Server speaks the Redis protocol (RESP2, RESP3 after HELLO 3) on top of
+// the default bucket of a DB. replies to a pipeline are written back in one
+// go once every command that came in with it ran.
+type Server struct {
+	db      *engine.DB
+	cursors cursorTable
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// NewServer serves db, which stays the caller's to close after the server.
+func NewServer(db *engine.DB) *Server {
+	return &Server{
+		db:        db,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+// ListenAndServe listens on addr & serves it, see Serve.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until Close, one goroutine each. it
+// always returns an error, ErrServerClosed after Close.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.track(l) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer s.untrack(l)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops the listeners, drops every connection & waits for their
+// commands to finish.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	var err error
+	for l := range s.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) track(l net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(l net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.listeners, l)
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *Server) serveConn(nc net.Conn) {
+	defer func() {
+		nc.Close()
+		s.mu.Lock()
+		delete(s.conns, nc)
+		s.mu.Unlock()
+		s.wg.Done()
+	}()
+
+	c := &conn{
+		server: s,
+		r:      newReader(nc),
+		w:      newWriter(nc),
+	}
+	for !c.quit {
+		args, err := c.r.command()
+		if err != nil {
+			if errors.Is(err, errProtocol) {
+				c.w.error("ERR Protocol error: " + err.Error())
+				c.w.flush()
+			} else if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Debug().Err(err).Str("remote", nc.RemoteAddr().String()).Msg("RESP connection dropped!!")
+			}
+			return
+		}
+		if len(args) > 0 {
+			c.dispatch(args)
+		}
+		// the rest of a pipeline is already here, answer it all at once.
+		if c.r.buffered() && !c.quit {
+			continue
+		}
+		if err := c.w.flush(); err != nil {
+			return
+		}
+	}
+}
+
+// conn is one client's state, only its own goroutine touches it.
+type conn struct {
+	server *Server
+	r      *reader
+	w      *writer
+	quit   bool
+}
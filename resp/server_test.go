@@ -0,0 +1,409 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pro0o/deslocado/engine"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// a server on a random port over a fresh store in a temp dir.
+func startServer(t *testing.T) string {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	tempDir := t.TempDir()
+	oldDir, _ := os.Getwd()
+	os.Chdir(tempDir)
+	t.Cleanup(func() { os.Chdir(oldDir) })
+
+	db, err := engine.Open(engine.WithOrderedIndex())
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	s := NewServer(db)
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(l) }()
+	t.Cleanup(func() {
+		s.Close()
+		if err := <-done; !errors.Is(err, ErrServerClosed) {
+			t.Errorf("Serve returned %v, want ErrServerClosed", err)
+		}
+		db.Close()
+	})
+	return l.Addr().String()
+}
+
+// client is a bare RESP client, replies come back as Go values: string for
+// simple strings, respError, int64, []byte or nil for bulk strings, []any &
+// map[string]any.
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+type respError string
+
+func dial(t *testing.T, addr string) *client {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &client{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+func encode(args ...string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return b.String()
+}
+
+func (c *client) write(s string) {
+	c.t.Helper()
+	if _, err := io.WriteString(c.conn, s); err != nil {
+		c.t.Fatalf("Write failed: %v", err)
+	}
+}
+
+func (c *client) do(args ...string) any {
+	c.t.Helper()
+	c.write(encode(args...))
+	return c.reply()
+}
+
+func (c *client) reply() any {
+	c.t.Helper()
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("Read failed: %v", err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	body := line[1:]
+	switch line[0] {
+	case '+':
+		return body
+	case '-':
+		return respError(body)
+	case ':':
+		n, _ := strconv.ParseInt(body, 10, 64)
+		return n
+	case '_':
+		return nil
+	case '$':
+		n, _ := strconv.Atoi(body)
+		if n < 0 {
+			return nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			c.t.Fatalf("Read failed: %v", err)
+		}
+		return buf[:n]
+	case '*':
+		n, _ := strconv.Atoi(body)
+		arr := make([]any, n)
+		for i := range arr {
+			arr[i] = c.reply()
+		}
+		return arr
+	case '%':
+		n, _ := strconv.Atoi(body)
+		m := make(map[string]any, n)
+		for range n {
+			key := c.reply().([]byte)
+			m[string(key)] = c.reply()
+		}
+		return m
+	}
+	c.t.Fatalf("Unknown reply %q", line)
+	return nil
+}
+
+func expect(t *testing.T, got, want any) {
+	t.Helper()
+	if s, ok := want.(string); ok && strings.HasPrefix(s, "$") {
+		want = []byte(s[1:])
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %#v, want %#v", got, want)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	c := dial(t, startServer(t))
+
+	expect(t, c.do("PING"), "PONG")
+	expect(t, c.do("ping", "hi"), "$hi")
+	expect(t, c.do("GET", "k"), nil)
+	expect(t, c.do("SET", "k", "v"), "OK")
+	expect(t, c.do("GET", "k"), "$v")
+
+	// NX & XX only write when the key is missing & present.
+	expect(t, c.do("SET", "k", "nx", "NX"), nil)
+	expect(t, c.do("SET", "k", "xx", "XX"), "OK")
+	expect(t, c.do("SET", "other", "xx", "XX"), nil)
+	expect(t, c.do("SET", "other", "nx", "NX"), "OK")
+	expect(t, c.do("MGET", "k", "other", "missing"), []any{[]byte("xx"), []byte("nx"), nil})
+
+	expect(t, c.do("TTL", "k"), int64(-1))
+	expect(t, c.do("TTL", "missing"), int64(-2))
+	expect(t, c.do("SET", "k", "short", "EX", "100", "XX"), "OK")
+	expect(t, c.do("TTL", "k"), int64(100))
+	// a plain SET drops the expiry.
+	expect(t, c.do("SET", "k", "v"), "OK")
+	expect(t, c.do("TTL", "k"), int64(-1))
+	expect(t, c.do("SET", "gone", "v", "PX", "1"), "OK")
+	for c.do("GET", "gone") != nil {
+	}
+	expect(t, c.do("TTL", "gone"), int64(-2))
+
+	expect(t, c.do("MSET", "a", "1", "b", "2"), "OK")
+	expect(t, c.do("EXISTS", "a", "b", "a", "missing"), int64(3))
+	expect(t, c.do("DEL", "a", "missing", "b"), int64(2))
+	expect(t, c.do("EXISTS", "a", "b"), int64(0))
+
+	// k, other & the expired gone, no merge dropped it yet.
+	info := string(c.do("INFO").([]byte))
+	if !strings.Contains(info, "# Server") || !strings.Contains(info, "db0:keys=3") {
+		t.Errorf("INFO = %q, want the server section & 3 keys", info)
+	}
+	if info := string(c.do("INFO", "keyspace").([]byte)); strings.Contains(info, "# Server") {
+		t.Errorf("INFO keyspace = %q, want only the keyspace section", info)
+	}
+
+	for _, bad := range [][]string{
+		{"NOPE"},
+		{"GET"},
+		{"GET", "a", "b"},
+		{"MSET", "a", "1", "b"},
+		{"SET", "k", "v", "NX", "XX"},
+		{"SET", "k", "v", "EX", "0"},
+		{"SET", "k", "v", "EX", "ten"},
+		// past 2262, the expiry wouldn't fit in unix nanos.
+		{"SET", "k", "v", "EX", "9000000000"},
+		{"SET", "k", "v", "PX", "9000000000000"},
+		{"SET", "k", "v", "EX"},
+		{"SET", "\x00k", "v"},
+	} {
+		if _, ok := c.do(bad...).(respError); !ok {
+			t.Errorf("Expected %q to fail", bad)
+		}
+	}
+	// errors don't drop the connection.
+	expect(t, c.do("GET", "k"), "$v")
+}
+
+func TestPipeline(t *testing.T) {
+	c := dial(t, startServer(t))
+
+	var b strings.Builder
+	for i := range 100 {
+		b.WriteString(encode("SET", fmt.Sprint("k", i), fmt.Sprint(i)))
+		b.WriteString(encode("GET", fmt.Sprint("k", i)))
+	}
+	// inline commands can sit in the same pipeline.
+	b.WriteString("EXISTS k0 k99\r\n\r\nPING\n")
+	c.write(b.String())
+	for i := range 100 {
+		expect(t, c.reply(), "OK")
+		expect(t, c.reply(), "$"+fmt.Sprint(i))
+	}
+	expect(t, c.reply(), int64(2))
+	expect(t, c.reply(), "PONG")
+
+	c.write(encode("PING") + encode("QUIT") + encode("PING"))
+	expect(t, c.reply(), "PONG")
+	expect(t, c.reply(), "OK")
+	if _, err := c.r.ReadByte(); !errors.Is(err, io.EOF) {
+		t.Errorf("Expected QUIT to close the connection, got %v", err)
+	}
+
+	// a broken request gets a protocol error & the connection closes.
+	c = dial(t, c.conn.RemoteAddr().String())
+	c.write("*1\r\n+PING\r\n")
+	if _, ok := c.reply().(respError); !ok {
+		t.Error("Expected a protocol error")
+	}
+	if _, err := c.r.ReadByte(); !errors.Is(err, io.EOF) {
+		t.Errorf("Expected the connection closed, got %v", err)
+	}
+}
+
+func TestRESP3(t *testing.T) {
+	c := dial(t, startServer(t))
+
+	if _, ok := c.do("HELLO", "4").(respError); !ok {
+		t.Error("Expected HELLO 4 to fail")
+	}
+	expect(t, c.do("GET", "missing"), nil)
+	c.write(encode("GET", "missing"))
+	if line, _ := c.r.ReadString('\n'); line != "$-1\r\n" {
+		t.Errorf("RESP2 null = %q, want $-1", line)
+	}
+
+	hello, ok := c.do("HELLO", "3", "SETNAME", "test").(map[string]any)
+	if !ok || hello["proto"] != int64(3) || string(hello["server"].([]byte)) != "deslocado" {
+		t.Fatalf("HELLO 3 = %#v, want a map with proto 3", hello)
+	}
+	c.write(encode("GET", "missing"))
+	if line, _ := c.r.ReadString('\n'); line != "_\r\n" {
+		t.Errorf("RESP3 null = %q, want _", line)
+	}
+	expect(t, c.do("SET", "k", "v"), "OK")
+	expect(t, c.do("MGET", "k", "missing"), []any{[]byte("v"), nil})
+
+	// back to RESP2, the map is a flat array again.
+	if hello, ok := c.do("HELLO", "2").([]any); !ok || len(hello) != 14 {
+		t.Errorf("HELLO 2 = %#v, want 7 pairs in an array", hello)
+	}
+}
+
+func TestScan(t *testing.T) {
+	addr := startServer(t)
+	c := dial(t, addr)
+	// a pooled client, every other page goes over another connection.
+	conns := []*client{c, dial(t, addr)}
+
+	args := []string{"MSET"}
+	var want []string
+	for i := range 25 {
+		key := fmt.Sprintf("user:%02d", i)
+		args = append(args, key, "v")
+		want = append(want, key)
+	}
+	args = append(args, "order:1", "v", "order:2", "v")
+	expect(t, c.do(args...), "OK")
+
+	scan := func(args ...string) []string {
+		t.Helper()
+		var keys []string
+		cursor := "0"
+		for pages := 0; ; pages++ {
+			if pages > 100 {
+				t.Fatal("SCAN never finished")
+			}
+			reply := conns[pages%2].do(append([]string{"SCAN", cursor}, args...)...).([]any)
+			cursor = string(reply[0].([]byte))
+			for _, key := range reply[1].([]any) {
+				keys = append(keys, string(key.([]byte)))
+			}
+			if cursor == "0" {
+				return keys
+			}
+		}
+	}
+	if keys := scan("MATCH", "user:*", "COUNT", "7"); !reflect.DeepEqual(keys, want) {
+		t.Errorf("SCAN user:* = %v, want %v", keys, want)
+	}
+	if keys := scan(); len(keys) != 27 || !sort.StringsAreSorted(keys) {
+		t.Errorf("SCAN = %v, want all 27 keys in order", keys)
+	}
+	if keys := scan("MATCH", "*:1?", "COUNT", "100"); len(keys) != 10 {
+		t.Errorf("SCAN *:1? = %v, want user:10..19", keys)
+	}
+	if _, ok := c.do("SCAN", "12345").(respError); !ok {
+		t.Error("Expected an unknown cursor to fail")
+	}
+
+	// a retried SCAN gets the same page again.
+	first := c.do("SCAN", "0", "COUNT", "5").([]any)
+	cursor := string(first[0].([]byte))
+	page := conns[1].do("SCAN", cursor, "COUNT", "5").([]any)
+	expect(t, conns[0].do("SCAN", cursor, "COUNT", "5").([]any)[1], page[1])
+}
+
+func TestCursorExpiry(t *testing.T) {
+	var table cursorTable
+	now := time.Now()
+	id := table.put([]byte("k"), now)
+	if after, ok := table.get(id, now.Add(cursorTTL/2)); !ok || string(after) != "k" {
+		t.Fatalf("Expected the cursor to resume after k, got %q %v", after, ok)
+	}
+	// using it kept it alive past the first TTL.
+	if _, ok := table.get(id, now.Add(cursorTTL)); !ok {
+		t.Error("Expected a used cursor to live another TTL")
+	}
+	if _, ok := table.get(id, now.Add(3*cursorTTL)); ok {
+		t.Error("Expected the cursor to expire")
+	}
+
+	// a full table drops the cursor closest to expiring.
+	table = cursorTable{}
+	oldest := table.put([]byte("old"), now)
+	for i := range maxCursors - 1 {
+		table.put(nil, now.Add(time.Duration(i+1)))
+	}
+	table.put(nil, now.Add(time.Second))
+	if _, ok := table.get(oldest, now); ok || len(table.cursors) != maxCursors {
+		t.Errorf("Expected the oldest cursor evicted, %d left", len(table.cursors))
+	}
+}
+
+func TestMatch(t *testing.T) {
+	for _, c := range []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"*", "", true},
+		{"user:*", "user:1", true},
+		{"user:*", "order:1", false},
+		{"*:1", "user:1", true},
+		{"u?er", "user", true},
+		{"u?er", "uer", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{`\*x`, "*x", true},
+		{`\*x`, "ax", false},
+		{"a*b*c", "aXXbYYc", true},
+		{"a*b*c", "aXXbYY", false},
+	} {
+		if got := match([]byte(c.pattern), []byte(c.s)); got != c.want {
+			t.Errorf("match(%q, %q) = %v, want %v", c.pattern, c.s, got, c.want)
+		}
+	}
+}
+
+func TestBulkReadInChunks(t *testing.T) {
+	c := dial(t, startServer(t))
+
+	// spans a few chunks & comes back whole.
+	val := strings.Repeat("0123456789", 30000)
+	expect(t, c.do("SET", "big", val), "OK")
+	expect(t, c.do("GET", "big"), "$"+val)
+
+	// a claimed 512MiB that never comes costs what arrived, not the claim.
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	r := newReader(strings.NewReader("*1\r\n$536870912\r\nPING"))
+	if _, err := r.command(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected a cut short bulk to fail, got %v", err)
+	}
+	runtime.ReadMemStats(&after)
+	if grown := after.TotalAlloc - before.TotalAlloc; grown > 1<<20 {
+		t.Errorf("Expected the bulk read as it comes in, allocated %d bytes", grown)
+	}
+}
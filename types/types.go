@@ -2,17 +2,35 @@ package types
 
 type RecordFlag byte
 
+// FlagBatch opens an atomic batch, its key is the count (u32) of records
+// that follow. a batch missing records at the tail of data.txt is dropped whole.
+// FlagDropBucket has no key, it deletes every older record of its bucket.
 const (
-	FlagNormal    RecordFlag = 0
-	FlagTombstone RecordFlag = 1
+	FlagNormal     RecordFlag = 0
+	FlagTombstone  RecordFlag = 1
+	FlagBatch      RecordFlag = 2
+	FlagDropBucket RecordFlag = 3
 )
 
+// FileOffset is where a key's latest record lives. Expiry is the record's,
+// unix nanos & 0 never expires, so expired keys can be told apart without a
+// read.
 type FileOffset struct {
 	FileID string
 	Offset int64
+	Expiry int64
 }
 
+func (f FileOffset) Expired(now int64) bool {
+	return f.Expiry != 0 && f.Expiry <= now
+}
+
+// Timestamp & Expiry are unix nanos, Expiry 0 never expires. Seq is the
+// record's, a merge keeps it.
 type KeyState struct {
 	Val           []byte
 	FlagTombstone bool
+	Timestamp     int64
+	Seq           uint64
+	Expiry        int64
 }